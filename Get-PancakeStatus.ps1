@@ -0,0 +1,54 @@
+param (
+    [string]$RunName = "*",
+    [int]$MaxAgeHours = 0
+)
+
+# Reads the run status published by ntfs_pancake -publish-status from
+# HKLM:\SOFTWARE\ntfs_pancake\Runs and emits one object per run name.
+# With -MaxAgeHours the output is reduced to a single compliance value
+# (True/False) suitable for an SCCM configuration item or Intune
+# detection script.
+
+$runsKey = "HKLM:\SOFTWARE\ntfs_pancake\Runs"
+
+if (-not (Test-Path -Path $runsKey)) {
+    if ($MaxAgeHours -gt 0) {
+        return $false
+    }
+    Write-Host "No ntfs_pancake runs have been recorded on this machine"
+    return
+}
+
+$runs = Get-ChildItem -Path $runsKey | Where-Object { $_.PSChildName -like $RunName } | ForEach-Object {
+    $values = Get-ItemProperty -Path $_.PSPath
+
+    [PSCustomObject]@{
+        RunName            = $_.PSChildName
+        State              = $values.State
+        Root               = $values.Root
+        StartTime          = $values.StartTime
+        EndTime            = $values.EndTime
+        ProcessId          = $values.ProcessId
+        FilesProcessed     = $values.FilesProcessed
+        FilesCompressed    = $values.FilesCompressed
+        FilesDecompressed  = $values.FilesDecompressed
+        FilesActiveSkipped = $values.FilesActiveSkipped
+        SpaceSaved         = $values.SpaceSaved
+    }
+}
+
+if ($MaxAgeHours -le 0) {
+    return $runs
+}
+
+# Compliant when every selected run completed within the allowed age
+$cutoff = (Get-Date).ToUniversalTime().AddHours(-$MaxAgeHours)
+foreach ($run in $runs) {
+    if ($run.State -ne "Completed" -or -not $run.EndTime) {
+        return $false
+    }
+    if ([DateTime]::Parse($run.EndTime).ToUniversalTime() -lt $cutoff) {
+        return $false
+    }
+}
+return [bool]$runs
@@ -0,0 +1,38 @@
+package main
+
+import (
+    "time"
+)
+
+// decompressSpeed is the rough single-core decompression throughput of each
+// backend in MiB/s on current x64 CPUs. Only the relative figures matter
+// much: LZX saves the most space but costs several times the CPU per read.
+var decompressSpeed = map[string]float64{
+    BACKEND_NAME_NTFS: 800, // LZNT1
+    "xpress4k":        600,
+    "xpress8k":        700,
+    "xpress16k":       800,
+    "lzx":             150,
+}
+
+// accessCost estimates the CPU time it takes to decompress a file of size
+// bytes compressed with backend, each time it is read in full.
+func accessCost(backend string, size int64) time.Duration {
+    speed, ok := decompressSpeed[backend]
+    if !ok {
+        return 0
+    }
+    return time.Duration(float64(size) / (speed * (1 << 20)) * float64(time.Second))
+}
+
+// tooCostly reports whether cost per read buys too little space by
+// -max-access-cost, in milliseconds of CPU per MiB saved.
+func tooCostly(cost time.Duration, saved int64) bool {
+    if opts.MaxAccessCost <= 0 || cost <= 0 {
+        return false
+    }
+    if saved <= 0 {
+        return true
+    }
+    return cost.Seconds()*1000/(float64(saved)/(1<<20)) > opts.MaxAccessCost
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+const MAX_ADVICE_LISTED = 20
+
+// Types that applications read and write at random offsets: databases,
+// mailboxes and virtual disks. Compression decompresses a whole unit for
+// every small read and recompresses it for every write, so these can get
+// much slower even when they compress well.
+var randomAccessExtensions = map[string]bool{
+    ".mdb": true, ".accdb": true, ".pst": true, ".ost": true, ".edb": true,
+    ".sqlite": true, ".db": true, ".mdf": true, ".ndf": true, ".ldf": true,
+    ".vhd": true, ".vhdx": true, ".vmdk": true,
+}
+
+func isRandomAccess(path string) bool {
+    return randomAccessExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// recordReadAdvice keeps compressed random-access files in the worker's
+// shard for the advice printed after the run.
+func recordReadAdvice(shard *statsShard, rec fileRecord) {
+    if rec.Action == ACTION_COMPRESS && isRandomAccess(rec.Path) {
+        shard.randomAccess = append(shard.randomAccess, rec)
+    }
+}
+
+// printReadAdvice lists the largest random-access files that were, or
+// would be, compressed because their ratio passed the threshold.
+func printReadAdvice() {
+    stats.mu.Lock()
+    var records []fileRecord
+    for _, shard := range stats.shards {
+        records = append(records, shard.randomAccess...)
+    }
+    stats.mu.Unlock()
+    if len(records) == 0 {
+        return
+    }
+
+    sort.Slice(records, func(i, j int) bool { return records[i].Size > records[j].Size })
+    fmt.Printf("\nCompressed files read at random offsets, which may get slower (exclude them with -skip-random-access):\n")
+    for _, rec := range records[:min(len(records), MAX_ADVICE_LISTED)] {
+        fmt.Printf("  %15d bytes  %15d bytes saved  %s\n", rec.Size, rec.Saved, displayPath(rec.Path))
+    }
+    if len(records) > MAX_ADVICE_LISTED {
+        fmt.Printf("  ... and %d more\n", len(records)-MAX_ADVICE_LISTED)
+    }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "golang.org/x/sys/windows"
+)
+
+const (
+    ARCHIVE_BIT_LEAVE   = "leave"   // Leave whatever state the compression change produced
+    ARCHIVE_BIT_CLEAR   = "clear"   // Clear the archive bit so backups don't pick the file up again
+    ARCHIVE_BIT_RESTORE = "restore" // Put the archive bit back the way it was before processing
+
+    // Attributes that SetFileAttributes accepts; the rest are managed by the file system
+    SETTABLE_ATTRIBUTES = windows.FILE_ATTRIBUTE_READONLY |
+        windows.FILE_ATTRIBUTE_HIDDEN |
+        windows.FILE_ATTRIBUTE_SYSTEM |
+        windows.FILE_ATTRIBUTE_ARCHIVE |
+        windows.FILE_ATTRIBUTE_TEMPORARY |
+        windows.FILE_ATTRIBUTE_OFFLINE |
+        windows.FILE_ATTRIBUTE_NOT_CONTENT_INDEXED
+
+    // Files whose data lives on another storage tier (tape, cloud); reading
+    // them would recall the data
+    STUB_ATTRIBUTES = windows.FILE_ATTRIBUTE_OFFLINE |
+        windows.FILE_ATTRIBUTE_RECALL_ON_OPEN |
+        windows.FILE_ATTRIBUTE_RECALL_ON_DATA_ACCESS
+)
+
+// isStub reports whether attrs mark an offline or HSM stub file.
+func isStub(attrs uint32) bool {
+    return attrs&STUB_ATTRIBUTES != 0
+}
+
+func getFileAttributes(path string) (uint32, error) {
+    name, err := windows.UTF16PtrFromString(path)
+    if err != nil {
+        return 0, err
+    }
+    return windows.GetFileAttributes(name)
+}
+
+func setFileAttributes(path string, attrs uint32) error {
+    name, err := windows.UTF16PtrFromString(path)
+    if err != nil {
+        return err
+    }
+
+    attrs &= SETTABLE_ATTRIBUTES
+    if attrs == 0 {
+        attrs = windows.FILE_ATTRIBUTE_NORMAL
+    }
+    return windows.SetFileAttributes(name, attrs)
+}
+
+// applyArchiveBitPolicy adjusts the archive attribute once the compression
+// state of a file has been changed. originalAttrs are the attributes captured
+// before the file was processed.
+func applyArchiveBitPolicy(path string, originalAttrs uint32) error {
+    if opts.ArchiveBit == ARCHIVE_BIT_LEAVE {
+        return nil
+    }
+
+    currentAttrs, err := getFileAttributes(path)
+    if err != nil {
+        return err
+    }
+
+    wantAttrs := currentAttrs &^ windows.FILE_ATTRIBUTE_ARCHIVE
+    if opts.ArchiveBit == ARCHIVE_BIT_RESTORE {
+        wantAttrs |= originalAttrs & windows.FILE_ATTRIBUTE_ARCHIVE
+    }
+
+    if wantAttrs == currentAttrs {
+        return nil
+    }
+    return setFileAttributes(path, wantAttrs)
+}
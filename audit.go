@@ -0,0 +1,134 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "sync"
+    "time"
+)
+
+const DEFAULT_FLUSH_INTERVAL = 30 * time.Second
+
+// auditEntry is one line of the -audit-log file, written as soon as a
+// file's compression state has been changed.
+type auditEntry struct {
+    Time     time.Time `json:"time"`
+    Path     string    `json:"path"`
+    Action   string    `json:"action"`
+    Previous string    `json:"previous,omitempty"` // How the file was stored before, see storedAs
+    New      string    `json:"new,omitempty"`
+    Saved    int64     `json:"saved"`
+}
+
+// auditLog appends entries straight to the file, so they survive the
+// process being killed; sync makes them survive a crash of the machine.
+type auditLog struct {
+    mu   sync.Mutex
+    file *os.File
+}
+
+var audit *auditLog
+
+func openAuditLog(path string) (*auditLog, error) {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &auditLog{file: f}, nil
+}
+
+// record logs a change of how path is stored from previous to stored.
+// Without -audit-log it does nothing.
+func (a *auditLog) record(path string, action string, previous string, stored string, saved int64) {
+    if a == nil {
+        return
+    }
+
+    line, err := json.Marshal(auditEntry{Time: time.Now().UTC(), Path: path, Action: action, Previous: previous, New: stored, Saved: saved})
+    if err != nil {
+        return
+    }
+
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.file.Write(append(line, '\n'))
+}
+
+func (a *auditLog) sync() {
+    if a == nil {
+        return
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.file.Sync()
+}
+
+func (a *auditLog) close() {
+    if a == nil {
+        return
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.file.Close()
+}
+
+// runSummary is the content of the -summary-file, rewritten while the run
+// progresses so a killed run still leaves its partial totals behind.
+type runSummary struct {
+    RunName   string        `json:"run_name,omitempty"`
+    Roots     []string      `json:"roots"`
+    State     string        `json:"state"`
+    StartTime time.Time     `json:"start_time"`
+    Updated   time.Time     `json:"updated"`
+    Totals    statsSnapshot `json:"totals"`
+}
+
+var summaryMu sync.Mutex
+
+// writeSummaryFile replaces the summary file atomically with the current
+// totals.
+func writeSummaryFile(path string, runState string, startTime time.Time) error {
+    summaryMu.Lock()
+    defer summaryMu.Unlock()
+
+    data, err := json.MarshalIndent(runSummary{
+        RunName:   opts.RunName,
+        Roots:     opts.Roots,
+        State:     runState,
+        StartTime: startTime.UTC(),
+        Updated:   time.Now().UTC(),
+        Totals:    stats.snapshot(),
+    }, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+// flushProgress writes the partial summary and syncs the audit log every
+// interval until done is closed.
+func flushProgress(interval time.Duration, startTime time.Time, done <-chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            if opts.SummaryFile != "" {
+                writeSummaryFile(opts.SummaryFile, RUN_STATE_RUNNING, startTime)
+            }
+            audit.sync()
+            if checkpoint != nil {
+                totals := stats.snapshot()
+                checkpoint.sync(&totals)
+            }
+        case <-done:
+            return
+        }
+    }
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+)
+
+const (
+    DEFAULT_ERROR_WINDOW = 500 // Files per window the error rate is measured over
+
+    ERROR_STORM_ABORT = "abort"
+    ERROR_STORM_PAUSE = "pause"
+)
+
+// errorBreaker watches the error rate over consecutive windows of files. A
+// storm of failures usually means a systemic problem such as a failing disk
+// or missing permissions rather than trouble with individual files, so the
+// run is stopped (or paused) instead of failing on every remaining file.
+type errorBreaker struct {
+    files   atomic.Int64
+    errors  atomic.Int64
+    tripped atomic.Bool
+    mu      sync.Mutex
+}
+
+var breaker errorBreaker
+
+// record counts the outcome of one file and trips the breaker when the
+// errors in the current window exceed -max-error-rate.
+func (b *errorBreaker) record(result resultCode) {
+    if opts.MaxErrorRate <= 0 {
+        return
+    }
+
+    errors := b.errors.Load()
+    if result.isError() {
+        errors = b.errors.Add(1)
+    }
+    files := b.files.Add(1)
+
+    limit := int64(opts.MaxErrorRate * float64(opts.ErrorWindow) / 100)
+    if errors > limit {
+        b.trip(errors, files)
+        return
+    }
+    if files >= int64(opts.ErrorWindow) {
+        b.reset()
+    }
+}
+
+func (b *errorBreaker) reset() {
+    b.files.Store(0)
+    b.errors.Store(0)
+}
+
+func (b *errorBreaker) trip(errors int64, files int64) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.tripped.Load() || gate.paused.Load() {
+        return
+    }
+
+    noticef("\nALERT: %d of the last %d files failed, more than %g%% of a %d file window\n",
+        errors, files, opts.MaxErrorRate, opts.ErrorWindow)
+    if opts.OnErrorStorm == ERROR_STORM_PAUSE {
+        noticef("Paused; press r to resume once the cause has been fixed\n")
+        b.reset()
+        gate.pause()
+        return
+    }
+
+    noticef("Aborting the run\n")
+    b.tripped.Store(true)
+    stopWalking()
+}
+
+// aborted reports whether the breaker stopped the run.
+func (b *errorBreaker) aborted() bool {
+    return b.tripped.Load()
+}
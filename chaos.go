@@ -0,0 +1,51 @@
+package main
+
+import (
+    "flag"
+    "math/rand/v2"
+    "os"
+    "sync/atomic"
+
+    "golang.org/x/sys/windows"
+)
+
+// Errors -chaos picks from, the ones real runs see most
+var chaosErrors = []error{
+    windows.ERROR_SHARING_VIOLATION,
+    windows.ERROR_ACCESS_DENIED,
+    windows.ERROR_IO_DEVICE,
+}
+
+var chaosInjected atomic.Int64
+
+// defineHiddenFlags defines testing options left out of the usage text and
+// the completion scripts.
+func defineHiddenFlags(fs *flag.FlagSet) {
+    fs.Float64Var(&opts.Chaos, "chaos", 0,
+        "fail this fraction (0 to 1) of opens and FSCTLs with synthetic errors, to try out monitoring and alerting")
+}
+
+var hiddenFlags = map[string]bool{"chaos": true}
+
+// printVisibleDefaults prints the defaults of the flags in fs other than
+// the hidden ones.
+func printVisibleDefaults(fs *flag.FlagSet) {
+    visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+    visible.SetOutput(fs.Output())
+    fs.VisitAll(func(f *flag.Flag) {
+        if !hiddenFlags[f.Name] {
+            visible.Var(f.Value, f.Name, f.Usage)
+        }
+    })
+    visible.PrintDefaults()
+}
+
+// chaosFailure returns a synthetic error for op on path at the -chaos rate,
+// and nil otherwise.
+func chaosFailure(op string, path string) error {
+    if opts.Chaos <= 0 || rand.Float64() >= opts.Chaos {
+        return nil
+    }
+    chaosInjected.Add(1)
+    return &os.PathError{Op: op + " (chaos)", Path: path, Err: chaosErrors[rand.IntN(len(chaosErrors))]}
+}
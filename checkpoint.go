@@ -0,0 +1,173 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// checkpointHeader is the first line of a -checkpoint file, identifying
+// the run it belongs to.
+type checkpointHeader struct {
+    Roots   []string  `json:"roots"`
+    Mode    string    `json:"mode"`
+    Policy  string    `json:"policy"`
+    Started time.Time `json:"started"`
+}
+
+// checkpointEntry is each following line: a file the run is done with, or
+// the totals so far, written every -flush-interval.
+type checkpointEntry struct {
+    Path   string         `json:"path,omitempty"`
+    Totals *statsSnapshot `json:"totals,omitempty"`
+}
+
+// checkpointLog appends finished files to the -checkpoint file through a
+// buffer, only flushed and synced every -flush-interval: a run killed in
+// between redoes at most that much work on -resume.
+type checkpointLog struct {
+    mu   sync.Mutex
+    file *os.File
+    w    *bufio.Writer
+}
+
+var checkpoint *checkpointLog
+
+// What the checkpoint resumed from says was done before; only read once
+// the workers start
+var (
+    resumedFiles  map[string]bool
+    resumedTotals *statsSnapshot
+)
+
+// checkpointHeaderFor describes this run.
+func checkpointHeaderFor(roots []string, start time.Time) checkpointHeader {
+    keys := make([]string, len(roots))
+    for i, root := range roots {
+        keys[i] = stateKey(root)
+    }
+    return checkpointHeader{Roots: keys, Mode: opts.mode, Policy: policyFingerprint(), Started: start.UTC()}
+}
+
+// openCheckpoint starts a new checkpoint at path, or continues the one
+// there with resume after loading what it says was done.
+func openCheckpoint(path string, resume bool, roots []string, start time.Time) (*checkpointLog, error) {
+    header := checkpointHeaderFor(roots, start)
+    flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+    if resume {
+        if err := loadCheckpoint(path, header); err != nil {
+            return nil, err
+        }
+        flags = os.O_WRONLY | os.O_APPEND
+    }
+
+    f, err := os.OpenFile(path, flags, 0644)
+    if err != nil {
+        return nil, err
+    }
+    c := &checkpointLog{file: f, w: bufio.NewWriter(f)}
+    if !resume {
+        line, err := json.Marshal(header)
+        if err != nil {
+            f.Close()
+            return nil, err
+        }
+        c.w.Write(append(line, '\n'))
+        c.sync(nil)
+    }
+    return c, nil
+}
+
+// loadCheckpoint reads the files done by the run that left the checkpoint
+// at path, which has to have covered the same folders the same way.
+func loadCheckpoint(path string, want checkpointHeader) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 1<<20)
+    if !scanner.Scan() {
+        return fmt.Errorf("checkpoint %s is empty", path)
+    }
+    var header checkpointHeader
+    if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+        return fmt.Errorf("parsing checkpoint %s: %v", path, err)
+    }
+    if strings.Join(header.Roots, "|") != strings.Join(want.Roots, "|") || header.Mode != want.Mode || header.Policy != want.Policy {
+        return fmt.Errorf("checkpoint %s is of a run over other folders or with other settings; run without -resume to start over", path)
+    }
+
+    resumedFiles = map[string]bool{}
+    for scanner.Scan() {
+        var entry checkpointEntry
+        // A line torn by the interruption is simply redone
+        if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+            continue
+        }
+        if entry.Path != "" {
+            resumedFiles[entry.Path] = true
+        }
+        if entry.Totals != nil {
+            resumedTotals = entry.Totals
+        }
+    }
+    noticef("Resuming the run started %s: %d files were done already\n", header.Started.Local().Format(time.DateTime), len(resumedFiles))
+    return scanner.Err()
+}
+
+// resumed reports whether the run resumed from says task was done.
+func resumed(task fileTask) bool {
+    return resumedFiles != nil && resumedFiles[stateKey(task.path)]
+}
+
+// done records that the run is done with path. Without -checkpoint it does
+// nothing.
+func (c *checkpointLog) done(path string) {
+    if c == nil {
+        return
+    }
+    line, err := json.Marshal(checkpointEntry{Path: stateKey(path)})
+    if err != nil {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.w.Write(append(line, '\n'))
+}
+
+// sync writes out the buffered files, after the totals so far if given.
+func (c *checkpointLog) sync(totals *statsSnapshot) {
+    if c == nil {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if totals != nil {
+        if line, err := json.Marshal(checkpointEntry{Totals: totals}); err == nil {
+            c.w.Write(append(line, '\n'))
+        }
+    }
+    c.w.Flush()
+    c.file.Sync()
+}
+
+// finish removes the checkpoint once the run has gone through every file,
+// so the next one starts afresh. Runs whose walk was stopped keep theirs.
+func (c *checkpointLog) finish(path string) {
+    if c == nil {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.file.Close()
+    os.Remove(path)
+}
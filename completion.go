@@ -0,0 +1,160 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+)
+
+var completionShells = []string{"powershell", "bash", "zsh"}
+
+// completionFlag is an option offered for completion.
+type completionFlag struct {
+    name  string
+    usage string
+}
+
+// completionFlags lists the options defined by define, sorted by name.
+func completionFlags(define func(fs *flag.FlagSet)) []completionFlag {
+    fs := flag.NewFlagSet("", flag.ContinueOnError)
+    define(fs)
+
+    var flags []completionFlag
+    fs.VisitAll(func(f *flag.Flag) {
+        // The first line is enough for a completion menu
+        usage, _, _ := strings.Cut(f.Usage, "\n")
+        flags = append(flags, completionFlag{name: "-" + f.Name, usage: usage})
+    })
+    sort.Slice(flags, func(i, j int) bool { return flags[i].name < flags[j].name })
+    return flags
+}
+
+var subcommands = append([]completionFlag{
+    {name: "self-update", usage: "update the binary"},
+    {name: "completion", usage: "print a shell completion script"},
+    {name: "report", usage: "compare the latest run with the previous one (report diff)"},
+    {name: "maintain", usage: "snapshot, compress incrementally and snapshot a volume in one go"},
+    {name: "undo", usage: "restore the compression state files had before the changes in an audit log"},
+}, modes...)
+
+// completionWords lists what can be completed after the command itself
+// (its options and, as first word, its subcommands) and after self-update.
+func completionWords() (main []completionFlag, update []completionFlag) {
+    main = completionFlags(func(fs *flag.FlagSet) { defineFlags(fs) })
+
+    var u updateOptions
+    update = completionFlags(u.defineFlags)
+    return main, update
+}
+
+func names(flags []completionFlag) string {
+    var words []string
+    for _, f := range flags {
+        words = append(words, f.name)
+    }
+    return strings.Join(words, " ")
+}
+
+func writePowerShellCompletion(w io.Writer) {
+    main, update := completionWords()
+    quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+    table := func(flags []completionFlag) string {
+        var entries []string
+        for _, f := range flags {
+            entries = append(entries, fmt.Sprintf("        %s = %s", quote(f.name), quote(f.usage)))
+        }
+        return "@{\n" + strings.Join(entries, "\n") + "\n    }"
+    }
+
+    fmt.Fprintf(w, `# ntfs_pancake completion; load with: ntfs_pancake completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName ntfs_pancake, ntfs_pancake.exe -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+
+    $main = %s
+    $update = %s
+    $shells = @{ 'powershell' = 'PowerShell'; 'bash' = 'bash'; 'zsh' = 'zsh' }
+
+    $words = switch ($commandAst.CommandElements[1].Value) {
+        'self-update' { $update }
+        'completion' { $shells }
+        default { $main }
+    }
+    if ($commandAst.CommandElements.Count -lt 2 -or ($commandAst.CommandElements.Count -eq 2 -and $wordToComplete)) {
+        $words = $main
+    }
+
+    $words.GetEnumerator() | Where-Object { $_.Key -like "$wordToComplete*" } | Sort-Object Key | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_.Key, $_.Key, 'ParameterName', $_.Value)
+    }
+}
+`, table(append(main, subcommands...)), table(update))
+}
+
+func writeBashCompletion(w io.Writer) {
+    main, update := completionWords()
+    fmt.Fprintf(w, `# ntfs_pancake completion; load with: source <(ntfs_pancake completion bash)
+_ntfs_pancake() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" words
+    case "${COMP_WORDS[1]}" in
+        self-update) words=%q ;;
+        completion) words=%q ;;
+        *) words=%q ;;
+    esac
+    if [[ $COMP_CWORD -eq 1 ]]; then
+        words=%q
+    fi
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+    [[ $cur != -* ]] && COMPREPLY+=($(compgen -f -- "$cur"))
+}
+complete -F _ntfs_pancake ntfs_pancake ntfs_pancake.exe
+`, names(update), strings.Join(completionShells, " "), names(main), names(append(main, subcommands...)))
+}
+
+func writeZshCompletion(w io.Writer) {
+    main, update := completionWords()
+    spec := func(flags []completionFlag) string {
+        var entries []string
+        for _, f := range flags {
+            entry := strings.ReplaceAll(f.name, ":", `\:`) + ":" + f.usage
+            entries = append(entries, "        '"+strings.ReplaceAll(entry, "'", `'\''`)+"'")
+        }
+        return "(\n" + strings.Join(entries, "\n") + "\n    )"
+    }
+
+    fmt.Fprintf(w, `#compdef ntfs_pancake ntfs_pancake.exe
+# ntfs_pancake completion; load with: source <(ntfs_pancake completion zsh)
+_ntfs_pancake() {
+    local -a main update
+    main=%s
+    update=%s
+    case "${words[2]}" in
+        self-update) _describe 'option' update ;;
+        completion) _values 'shell' %s ;;
+        *) _describe 'option' main; _files ;;
+    esac
+}
+compdef _ntfs_pancake ntfs_pancake ntfs_pancake.exe
+`, spec(append(main, subcommands...)), spec(update), strings.Join(completionShells, " "))
+}
+
+// printCompletion implements the completion subcommand.
+func printCompletion(args []string) error {
+    if len(args) != 1 {
+        return fmt.Errorf("usage: %s completion %s", os.Args[0], strings.Join(completionShells, "|"))
+    }
+
+    switch args[0] {
+    case "powershell":
+        writePowerShellCompletion(os.Stdout)
+    case "bash":
+        writeBashCompletion(os.Stdout)
+    case "zsh":
+        writeZshCompletion(os.Stdout)
+    default:
+        return fmt.Errorf("unknown shell %q (want %s)", args[0], strings.Join(completionShells, ", "))
+    }
+    return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+// limiter bounds how many workers may be inside a kind of operation at
+// once. A nil limiter doesn't limit anything.
+type limiter chan struct{}
+
+// Filter drivers such as antivirus and backup agents often serialize
+// FSCTLs, so the best number of concurrent compression changes can be far
+// below the best number of concurrent read streams.
+var (
+    readSlots  limiter
+    fsctlSlots limiter
+)
+
+func newLimiter(n int) limiter {
+    if n <= 0 {
+        return nil
+    }
+    return make(limiter, n)
+}
+
+func (l limiter) acquire() {
+    if l != nil {
+        l <- struct{}{}
+    }
+}
+
+func (l limiter) release() {
+    if l != nil {
+        <-l
+    }
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Config files (-config) hold the same settings as the command line, named
+// after the options without the leading dash, in a subset of TOML:
+//
+//   threshold = 15
+//   workers = 8
+//   exclude = ["*.mp4", 'node_modules\**']
+//
+//   [extensions]
+//   ".log" = 5       # threshold for files with this extension
+//   ".pst" = "skip"  # never processed
+//   ".xml" = "always" # compressed without an estimate
+//
+// Options given on the command line override the file, repeatable ones
+// replacing its whole list; Group Policy overrides both. Repeatable options
+// may be given on several lines, which add up; others only once.
+
+// configValue is a setting read from a config file.
+type configValue struct {
+    line   int
+    name   string
+    values []string
+}
+
+// applyConfigFile sets the options in the config file at path on fs,
+// except for those given on the command line.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+    settings, err := readConfigFile(path)
+    if err != nil {
+        return err
+    }
+
+    // Taken before the file sets anything, which would count as given
+    cli := map[string]bool{}
+    fs.Visit(func(f *flag.Flag) {
+        cli[f.Name] = true
+    })
+
+    seen := map[string]int{}
+    for _, setting := range settings {
+        f := fs.Lookup(setting.name)
+        if f == nil {
+            return fmt.Errorf("%s:%d: unknown setting %s", path, setting.line, setting.name)
+        }
+        if _, repeatable := f.Value.(repeatableValue); !repeatable {
+            if first, ok := seen[setting.name]; ok {
+                return fmt.Errorf("%s:%d: %s is already set on line %d", path, setting.line, setting.name, first)
+            }
+            // An array needs a repeatable option just as a repeated key does
+            if len(setting.values) > 1 {
+                return fmt.Errorf("%s:%d: %s takes a single value", path, setting.line, setting.name)
+            }
+        }
+        seen[setting.name] = setting.line
+        if cli[setting.name] {
+            continue
+        }
+        for _, value := range setting.values {
+            if err := fs.Set(setting.name, value); err != nil {
+                return fmt.Errorf("%s:%d: %s: %v", path, setting.line, setting.name, err)
+            }
+        }
+    }
+    return nil
+}
+
+// readConfigFile parses a config file. Entries of the [extensions] table
+// become -extension values.
+func readConfigFile(path string) ([]configValue, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var settings []configValue
+    extensions := configValue{name: "extension"}
+    section := ""
+    scanner := bufio.NewScanner(f)
+    for line := 1; scanner.Scan(); line++ {
+        text := strings.TrimSpace(stripConfigComment(scanner.Text()))
+        if text == "" {
+            continue
+        }
+
+        if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+            section = strings.TrimSpace(text[1 : len(text)-1])
+            if section != "extensions" {
+                return nil, fmt.Errorf("%s:%d: unknown table [%s]", path, line, section)
+            }
+            continue
+        }
+
+        key, raw, ok := strings.Cut(text, "=")
+        if !ok {
+            return nil, fmt.Errorf("%s:%d: expected name = value", path, line)
+        }
+        name, err := parseConfigScalar(strings.TrimSpace(key))
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+        }
+        values, err := parseConfigValue(strings.TrimSpace(raw))
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+        }
+
+        if section == "extensions" {
+            if extensions.line == 0 {
+                extensions.line = line
+            }
+            for _, value := range values {
+                extensions.values = append(extensions.values, name+"="+value)
+            }
+            continue
+        }
+        settings = append(settings, configValue{line: line, name: name, values: values})
+    }
+    if extensions.line != 0 {
+        settings = append(settings, extensions)
+    }
+    return settings, scanner.Err()
+}
+
+// stripConfigComment removes a # comment that isn't inside a string.
+func stripConfigComment(line string) string {
+    var quote byte
+    for i := 0; i < len(line); i++ {
+        switch c := line[i]; {
+        case quote == '"' && c == '\\':
+            i++
+        case quote != 0 && c == quote:
+            quote = 0
+        case quote == 0 && (c == '"' || c == '\''):
+            quote = c
+        case quote == 0 && c == '#':
+            return line[:i]
+        }
+    }
+    return line
+}
+
+// parseConfigValue parses a scalar or a one-line array of scalars.
+func parseConfigValue(raw string) ([]string, error) {
+    if !strings.HasPrefix(raw, "[") {
+        value, err := parseConfigScalar(raw)
+        if err != nil {
+            return nil, err
+        }
+        return []string{value}, nil
+    }
+    if !strings.HasSuffix(raw, "]") {
+        return nil, fmt.Errorf("arrays must be on one line")
+    }
+
+    var values []string
+    for _, item := range splitConfigArray(raw[1 : len(raw)-1]) {
+        if item = strings.TrimSpace(item); item == "" {
+            continue
+        }
+        value, err := parseConfigScalar(item)
+        if err != nil {
+            return nil, err
+        }
+        values = append(values, value)
+    }
+    return values, nil
+}
+
+// splitConfigArray splits array items at commas outside strings.
+func splitConfigArray(items string) []string {
+    var parts []string
+    var quote byte
+    start := 0
+    for i := 0; i < len(items); i++ {
+        switch c := items[i]; {
+        case quote == '"' && c == '\\':
+            i++
+        case quote != 0 && c == quote:
+            quote = 0
+        case quote == 0 && (c == '"' || c == '\''):
+            quote = c
+        case quote == 0 && c == ',':
+            parts = append(parts, items[start:i])
+            start = i + 1
+        }
+    }
+    return append(parts, items[start:])
+}
+
+// parseConfigScalar returns the text of a basic "..." or literal '...'
+// string, or a bare number, boolean or name as it is.
+func parseConfigScalar(raw string) (string, error) {
+    switch {
+    case strings.HasPrefix(raw, `"`):
+        value, err := strconv.Unquote(raw)
+        if err != nil {
+            return "", fmt.Errorf("invalid string %s", raw)
+        }
+        return value, nil
+    case strings.HasPrefix(raw, "'"):
+        if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+            return "", fmt.Errorf("invalid string %s", raw)
+        }
+        return raw[1 : len(raw)-1], nil
+    case raw == "":
+        return "", fmt.Errorf("missing value")
+    }
+    return raw, nil
+}
+
+// extensionRule overrides the threshold for files with one extension,
+// skips them altogether or compresses them without an estimate.
+type extensionRule struct {
+    threshold float64
+    skip      bool
+    always    bool
+}
+
+// extensionRules implements flag.Value for repeatable -extension values
+// such as .log=5, .pst=skip or .log,.txt,.xml=always.
+type extensionRules map[string]extensionRule
+
+func (r *extensionRules) String() string {
+    var parts []string
+    for ext, rule := range *r {
+        if rule.skip {
+            parts = append(parts, ext+"=skip")
+        } else if rule.always {
+            parts = append(parts, ext+"=always")
+        } else {
+            parts = append(parts, ext+"="+strconv.FormatFloat(rule.threshold, 'g', -1, 64))
+        }
+    }
+    sort.Strings(parts)
+    return strings.Join(parts, ",")
+}
+
+func (r *extensionRules) Set(value string) error {
+    list, setting, ok := strings.Cut(value, "=")
+    var exts []string
+    for _, ext := range strings.Split(list, ",") {
+        ext = strings.ToLower(strings.TrimSpace(ext))
+        if !ok || !strings.HasPrefix(ext, ".") {
+            return fmt.Errorf("invalid extension rule %q (want .ext=threshold, .ext=skip or .ext=always)", value)
+        }
+        exts = append(exts, ext)
+    }
+
+    rule := extensionRule{}
+    switch setting {
+    case "skip", "never":
+        rule.skip = true
+    case "always":
+        rule.always = true
+    default:
+        threshold, err := strconv.ParseFloat(setting, 64)
+        if err != nil || threshold < 0 || threshold > 100 {
+            return fmt.Errorf("invalid threshold in extension rule %q", value)
+        }
+        rule.threshold = threshold
+    }
+    if *r == nil {
+        *r = extensionRules{}
+    }
+    for _, ext := range exts {
+        (*r)[ext] = rule
+    }
+    return nil
+}
+
+func (r *extensionRules) reset() {
+    *r = nil
+}
+
+// skipped reports whether path has an extension that is never processed.
+func (r extensionRules) skipped(path string) bool {
+    return r[strings.ToLower(filepath.Ext(path))].skip
+}
+
+// always reports whether path has an extension that is compressed without
+// being read for an estimate.
+func (r extensionRules) always(path string) bool {
+    return r[strings.ToLower(filepath.Ext(path))].always
+}
+
+// thresholdFor returns the saving threshold that applies to path.
+func thresholdFor(path string) float64 {
+    rule, ok := opts.Extensions[strings.ToLower(filepath.Ext(path))]
+    if !ok {
+        return opts.Threshold
+    }
+    if opts.Safe {
+        return max(rule.threshold, SAFE_THRESHOLD)
+    }
+    return rule.threshold
+}
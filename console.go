@@ -0,0 +1,182 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "golang.org/x/sys/windows"
+)
+
+// pauseGate lets workers be held between files. The paused flag is checked
+// atomically so the common, unpaused case takes no lock.
+type pauseGate struct {
+    paused atomic.Bool
+    mu     sync.Mutex
+    cond   *sync.Cond
+}
+
+var gate = newPauseGate()
+
+func newPauseGate() *pauseGate {
+    g := &pauseGate{}
+    g.cond = sync.NewCond(&g.mu)
+    return g
+}
+
+func (g *pauseGate) pause() {
+    g.mu.Lock()
+    g.paused.Store(true)
+    g.mu.Unlock()
+}
+
+func (g *pauseGate) resume() {
+    g.mu.Lock()
+    g.paused.Store(false)
+    g.mu.Unlock()
+    g.cond.Broadcast()
+}
+
+// wait blocks while the run is paused.
+func (g *pauseGate) wait() {
+    if !g.paused.Load() {
+        return
+    }
+
+    g.mu.Lock()
+    for g.paused.Load() {
+        g.cond.Wait()
+    }
+    g.mu.Unlock()
+}
+
+// startHotkeys switches an interactive console to unbuffered input and
+// handles p (pause), r (resume) and space (status snapshot) key presses.
+// It returns a function restoring the console mode, or nil when stdin is
+// not a console (scheduled tasks, redirected input).
+func startHotkeys() func() {
+    stdin := windows.Handle(os.Stdin.Fd())
+
+    var originalMode uint32
+    if err := windows.GetConsoleMode(stdin, &originalMode); err != nil {
+        return nil
+    }
+
+    rawMode := originalMode &^ (windows.ENABLE_LINE_INPUT | windows.ENABLE_ECHO_INPUT)
+    if err := windows.SetConsoleMode(stdin, rawMode); err != nil {
+        return nil
+    }
+
+    noticef("Press p to pause, r to resume, space for a status snapshot\n")
+
+    hotkeysRunning.Store(true)
+    go func() {
+        key := make([]byte, 1)
+        for {
+            n, err := os.Stdin.Read(key)
+            if err != nil {
+                return
+            }
+            if n == 0 {
+                continue
+            }
+
+            switch key[0] {
+            case 'p', 'P':
+                if !gate.paused.Load() {
+                    gate.pause()
+                    fmt.Printf("Paused, press r to resume\n")
+                }
+            case 'r', 'R':
+                if gate.paused.Load() {
+                    gate.resume()
+                    fmt.Printf("Resumed\n")
+                }
+            case ' ':
+                printStatus(stats.snapshot())
+            case '\r', '\n':
+                select {
+                case enterPressed <- struct{}{}:
+                default:
+                }
+            }
+        }
+    }()
+
+    return func() {
+        windows.SetConsoleMode(stdin, originalMode)
+    }
+}
+
+const OWN_CONSOLE_STATUS_INTERVAL = 10 * time.Second
+
+// Once the hotkeys are running they own stdin and pass Enter on
+var (
+    hotkeysRunning atomic.Bool
+    enterPressed   = make(chan struct{})
+)
+
+// ownConsole reports whether Windows opened a console just for us. That
+// console closes as soon as we exit. Scheduled tasks, services and other
+// launchers get one too, so on its own it says nothing about whether anyone
+// is watching.
+func ownConsole() bool {
+    return consoleProcessCount() == 1
+}
+
+// droppedOnto reports whether a person started us from Explorer, by dropping
+// a folder onto the executable or double-clicking it: a console of our own,
+// read from the keyboard, with explorer.exe as the parent.
+var droppedOnto = sync.OnceValue(func() bool {
+    var mode uint32
+    if !ownConsole() || windows.GetConsoleMode(windows.Handle(os.Stdin.Fd()), &mode) != nil {
+        return false
+    }
+    return strings.EqualFold(parentProcessName(), "explorer.exe")
+})
+
+// pauseBeforeExit reports whether to wait for Enter before exiting: with
+// -pause, or when started from Explorer unless the options say nobody is
+// going to read the output.
+func pauseBeforeExit() bool {
+    if opts.Pause {
+        return true
+    }
+    return droppedOnto() && !opts.Yes && !opts.Plain && opts.Verbosity > VERBOSITY_QUIET && opts.Output != OUTPUT_JSON
+}
+
+// exit keeps the console open until Enter is pressed when pauseBeforeExit
+// says so, so the summary or the error can be read, and then exits with
+// code.
+func exit(code int) {
+    runLog.logf(LOG_RUN, "Exiting with code %d", code)
+    runLog.close()
+    keepConsoleOpen()
+    os.Exit(code)
+}
+
+func keepConsoleOpen() {
+    if !pauseBeforeExit() {
+        return
+    }
+    fmt.Printf("\nPress Enter to close this window\n")
+    if hotkeysRunning.Load() {
+        <-enterPressed
+    } else {
+        fmt.Scanln()
+    }
+}
+
+// cleanDroppedPath undoes what quoting does to dropped and pasted folders:
+// "D:\My Folder\" arrives as D:\My Folder" since the backslash escapes the
+// closing quote.
+func cleanDroppedPath(path string) string {
+    path = strings.TrimSuffix(path, `"`)
+    if len(path) > 3 {
+        path = strings.TrimRight(path, `\`)
+    }
+    return path
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "os"
+    "strings"
+
+    "golang.org/x/sys/windows/registry"
+)
+
+const (
+    CONTAINER_REGISTRY_KEY = `SYSTEM\CurrentControlSet\Control` // Has ContainerType inside Windows containers
+    SANDBOX_ACCOUNT        = "WDAGUtilityAccount"                 // Account Windows Sandbox logs on with
+)
+
+// containerKind names the kind of container the process runs in, or
+// returns an empty string on a regular installation.
+func containerKind() string {
+    if strings.EqualFold(os.Getenv("USERNAME"), SANDBOX_ACCOUNT) {
+        return "Windows Sandbox"
+    }
+
+    key, err := registry.OpenKey(registry.LOCAL_MACHINE, CONTAINER_REGISTRY_KEY, registry.QUERY_VALUE)
+    if err != nil {
+        return ""
+    }
+    defer key.Close()
+    if _, _, err := key.GetIntegerValue("ContainerType"); err == nil {
+        return "Windows container"
+    }
+    return ""
+}
+
+// checkContainer keeps runs inside a container from changing anything by
+// default. The container's volume layers a scratch disk over shared image
+// layers: compressing a file from an image copies it into the scratch
+// layer, which grows instead of freeing space, and the savings reported
+// don't apply to the host. Folders mapped in from the host behave normally,
+// which is what -allow-container is for.
+func checkContainer() {
+    kind := containerKind()
+    if kind == "" {
+        return
+    }
+
+    switch {
+    case !opts.applying():
+        noticef("Running in a %s: estimates for files from image layers don't reflect space on the host\n", kind)
+    case opts.AllowContainer:
+        noticef("Running in a %s: changing files from image layers copies them into the scratch layer\n", kind)
+    default:
+        opts.recommendOnly = true
+        noticef("Running in a %s: recommending only, nothing will be modified (use -allow-container for folders mapped from the host)\n", kind)
+    }
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "sort"
+)
+
+// dirTotals are the sizes, file counts and savings of a directory.
+type dirTotals struct {
+    size     int64
+    files    int64
+    saved    int64
+    forecast backendForecast
+}
+
+// dirStats maps a directory path to its totals.
+type dirStats map[string]*dirTotals
+
+// walkDirStats holds, per root, the sizes and counts of the files directly
+// inside each directory as seen by the walkers. Each walker only writes to
+// its own entry.
+var walkDirStats []dirStats
+
+func (d dirStats) get(dir string) *dirTotals {
+    totals, ok := d[dir]
+    if !ok {
+        totals = &dirTotals{}
+        d[dir] = totals
+    }
+    return totals
+}
+
+// recordDirSaving adds the space saved for a file to its directory in the
+// worker's shard.
+func recordDirSaving(shard *statsShard, path string, saved int64) {
+    if shard.dirSavings == nil {
+        shard.dirSavings = map[string]int64{}
+    }
+    shard.dirSavings[filepath.Dir(path)] += saved
+}
+
+// mergedDirStats combines the walkers' sizes with the savings of all
+// workers and rolls every directory up into its ancestors below its root,
+// so each entry covers its whole subtree like du does.
+func mergedDirStats(roots []string) dirStats {
+    direct := dirStats{}
+    for _, dirs := range walkDirStats {
+        for dir, totals := range dirs {
+            t := direct.get(dir)
+            t.size += totals.size
+            t.files += totals.files
+        }
+    }
+
+    stats.mu.Lock()
+    for _, shard := range stats.shards {
+        for dir, saved := range shard.dirSavings {
+            direct.get(dir).saved += saved
+        }
+        for dir, forecast := range shard.dirForecasts {
+            direct.get(dir).forecast.add(*forecast)
+        }
+    }
+    stats.mu.Unlock()
+
+    isRoot := map[string]bool{}
+    for _, root := range roots {
+        isRoot[filepath.Clean(root)] = true
+    }
+
+    cumulative := dirStats{}
+    for dir, totals := range direct {
+        for {
+            t := cumulative.get(dir)
+            t.size += totals.size
+            t.files += totals.files
+            t.saved += totals.saved
+            t.forecast.add(totals.forecast)
+
+            parent := filepath.Dir(dir)
+            if isRoot[dir] || parent == dir {
+                break
+            }
+            dir = parent
+        }
+    }
+    return cumulative
+}
+
+// printTopDirectories prints the largest directories and the directories
+// with the most savings, the two views needed to decide where to act next.
+func printTopDirectories(roots []string, n int) {
+    if n <= 0 {
+        return
+    }
+
+    merged := mergedDirStats(roots)
+
+    bySize := topDirsBySize(merged, n)
+    if len(bySize) > 0 {
+        fmt.Printf("\nTop directories by size:\n")
+        for _, dir := range bySize {
+            t := merged[dir]
+            fmt.Printf("  %15d bytes  %8d files  %15d bytes saved  %s\n", t.size, t.files, t.saved, displayPath(dir))
+        }
+    }
+
+    bySavings := topDirsBySavings(merged, n)
+    if len(bySavings) > 0 {
+        fmt.Printf("\nTop directories by savings:\n")
+        for _, dir := range bySavings {
+            t := merged[dir]
+            fmt.Printf("  %15d bytes saved  %15d bytes  %8d files  %s\n", t.saved, t.size, t.files, displayPath(dir))
+        }
+    }
+}
+
+// topDirsBySize returns up to n directories with the largest size.
+func topDirsBySize(merged dirStats, n int) []string {
+    dirs := make([]string, 0, len(merged))
+    for dir, t := range merged {
+        if t.size > 0 {
+            dirs = append(dirs, dir)
+        }
+    }
+    sort.Slice(dirs, func(i, j int) bool { return merged[dirs[i]].size > merged[dirs[j]].size })
+    return dirs[:min(n, len(dirs))]
+}
+
+// topDirsBySavings returns up to n directories with the most space saved.
+func topDirsBySavings(merged dirStats, n int) []string {
+    dirs := make([]string, 0, len(merged))
+    for dir, t := range merged {
+        if t.saved > 0 {
+            dirs = append(dirs, dir)
+        }
+    }
+    sort.Slice(dirs, func(i, j int) bool { return merged[dirs[i]].saved > merged[dirs[j]].saved })
+    return dirs[:min(n, len(dirs))]
+}
+
+// rootSummary is the totals of one root of a run.
+type rootSummary struct {
+    Root   string `json:"root"`
+    Files  int64  `json:"files"`
+    Size   int64  `json:"size"`
+    Saved  int64  `json:"saved"`
+    Errors int    `json:"errors"`
+}
+
+// rootSummaries returns the totals of each root.
+func rootSummaries(roots []string) []rootSummary {
+    merged := mergedDirStats(roots)
+
+    summaries := make([]rootSummary, len(roots))
+    for i, root := range roots {
+        t := merged.get(filepath.Clean(root))
+        summaries[i] = rootSummary{Root: root, Files: t.files, Size: t.size, Saved: t.saved}
+    }
+
+    stats.mu.Lock()
+    for _, shard := range stats.shards {
+        for _, e := range shard.errors {
+            for i, root := range roots {
+                if within(filepath.Clean(root), e.Path) {
+                    summaries[i].Errors++
+                    break
+                }
+            }
+        }
+    }
+    stats.mu.Unlock()
+    return summaries
+}
+
+// printRootSummaries prints the totals of each root of a run over several,
+// after the combined summary.
+func printRootSummaries(roots []string) {
+    fmt.Printf("\nPer folder:\n")
+    for _, r := range rootSummaries(roots) {
+        fmt.Printf("  %8d files  %15d bytes  %15d bytes saved  %6d errors  %s\n", r.Files, r.Size, r.Saved, r.Errors, r.Root)
+    }
+}
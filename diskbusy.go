@@ -0,0 +1,212 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "unsafe"
+
+    "golang.org/x/sys/windows"
+)
+
+const (
+    IOCTL_DISK_PERFORMANCE = 0x00070020
+
+    DISK_BUSY_INTERVAL      = time.Second // Between samples of the disk counters
+    DISK_BUSY_QUIET_SAMPLES = 3           // Quiet samples in a row before reads resume
+)
+
+// diskPerformance is DISK_PERFORMANCE. Times are in 100ns units.
+type diskPerformance struct {
+    bytesRead           int64
+    bytesWritten        int64
+    readTime            int64
+    writeTime           int64
+    idleTime            int64
+    readCount           uint32
+    writeCount          uint32
+    queueDepth          uint32
+    splitCount          uint32
+    queryTime           int64
+    storageDeviceNumber uint32
+    storageManagerName  [8]uint16
+}
+
+// busyGate holds back reads from one volume while -max-disk-busy is
+// exceeded by the I/O of other processes.
+type busyGate struct {
+    volume string
+    handle windows.Handle
+
+    mu     sync.Mutex
+    cond   *sync.Cond
+    paused bool
+    quiet  int
+
+    last    diskPerformance
+    lastOwn uint64
+}
+
+// Gates by lowercase volume name, set up before the workers start and only
+// read afterwards
+var diskGates map[string]*busyGate
+
+// Time readers spent waiting for a quiet disk
+var diskBusyNanos atomic.Int64
+
+// waitForQuietDisk blocks while reads from the volume of path are paused.
+func waitForQuietDisk(path string) {
+    g := diskGates[strings.ToLower(filepath.VolumeName(path))]
+    if g == nil {
+        return
+    }
+
+    g.mu.Lock()
+    if g.paused {
+        start := time.Now()
+        for g.paused {
+            g.cond.Wait()
+        }
+        diskBusyNanos.Add(int64(time.Since(start)))
+    }
+    g.mu.Unlock()
+}
+
+func (g *busyGate) query() (diskPerformance, error) {
+    var perf diskPerformance
+    var bytesReturned uint32
+    err := windows.DeviceIoControl(g.handle, IOCTL_DISK_PERFORMANCE, nil, 0, (*byte)(unsafe.Pointer(&perf)), uint32(unsafe.Sizeof(perf)), &bytesReturned, nil)
+    return perf, err
+}
+
+// ownBytesTransferred is what this process read and wrote so far, on
+// every volume.
+func ownBytesTransferred() uint64 {
+    var io ioCounters
+    if r, _, _ := procGetProcessIoCounters.Call(uintptr(windows.CurrentProcess()), uintptr(unsafe.Pointer(&io))); r == 0 {
+        return 0
+    }
+    return io.readBytes + io.writeBytes
+}
+
+// otherBusy returns the percentage of the last interval the disk was busy
+// with the I/O of other processes. The disk only reports its total busy
+// time, so the share of our own bytes in its traffic is taken out of it.
+func (g *busyGate) otherBusy(perf diskPerformance, own uint64) float64 {
+    elapsed := perf.queryTime - g.last.queryTime
+    if elapsed <= 0 {
+        return 0
+    }
+    idle := perf.idleTime - g.last.idleTime
+    busy := 100 * (1 - float64(idle)/float64(elapsed))
+    busy = min(max(busy, 0), 100)
+
+    transferred := perf.bytesRead + perf.bytesWritten - g.last.bytesRead - g.last.bytesWritten
+    if transferred > 0 {
+        others := max(transferred-int64(own-g.lastOwn), 0)
+        busy *= float64(others) / float64(transferred)
+    }
+    return busy
+}
+
+// sample pauses or resumes reads from the latest counters.
+func (g *busyGate) sample() {
+    perf, err := g.query()
+    if err != nil {
+        return
+    }
+    own := ownBytesTransferred()
+    busy := g.otherBusy(perf, own)
+    g.last, g.lastOwn = perf, own
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    switch {
+    case busy > opts.MaxDiskBusy:
+        g.quiet = 0
+        if !g.paused {
+            g.paused = true
+            noticef("Disk of %s busy with other I/O %.0f%% of the time, pausing reads\n", g.volume, busy)
+        }
+    case g.paused:
+        g.quiet++
+        if g.quiet >= DISK_BUSY_QUIET_SAMPLES {
+            g.paused = false
+            g.cond.Broadcast()
+            noticef("Disk of %s quiet again, resuming reads\n", g.volume)
+        }
+    }
+}
+
+// release lets every waiting reader go for good.
+func (g *busyGate) release() {
+    g.mu.Lock()
+    g.paused = false
+    g.cond.Broadcast()
+    g.mu.Unlock()
+    windows.CloseHandle(g.handle)
+}
+
+func openBusyGate(path string) (*busyGate, error) {
+    info, err := getVolumeInfo(path)
+    if err != nil {
+        return nil, err
+    }
+    device, err := windows.UTF16PtrFromString(strings.TrimSuffix(info.volumeName, `\`))
+    if err != nil {
+        return nil, err
+    }
+    handle, err := windows.CreateFile(device, 0, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil, windows.OPEN_EXISTING, 0, 0)
+    if err != nil {
+        return nil, err
+    }
+
+    g := &busyGate{volume: filepath.VolumeName(path), handle: handle}
+    g.cond = sync.NewCond(&g.mu)
+    if g.last, err = g.query(); err != nil {
+        windows.CloseHandle(handle)
+        return nil, fmt.Errorf("reading disk counters: %v", err)
+    }
+    g.lastOwn = ownBytesTransferred()
+    return g, nil
+}
+
+// startDiskMonitors samples the disk of each volume holding paths every
+// DISK_BUSY_INTERVAL until done is closed. Volumes whose disk doesn't
+// report its activity are read without pausing.
+func startDiskMonitors(paths []string, done <-chan struct{}) {
+    diskGates = map[string]*busyGate{}
+    for _, path := range paths {
+        key := strings.ToLower(filepath.VolumeName(path))
+        if _, seen := diskGates[key]; seen {
+            continue
+        }
+        g, err := openBusyGate(path)
+        if err != nil {
+            noticef("Cannot watch disk activity for %s, reading without pausing: %v\n", path, err)
+        }
+        diskGates[key] = g
+    }
+
+    for _, g := range diskGates {
+        if g == nil {
+            continue
+        }
+        go func(g *busyGate) {
+            ticker := time.NewTicker(DISK_BUSY_INTERVAL)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-ticker.C:
+                    g.sample()
+                case <-done:
+                    g.release()
+                    return
+                }
+            }
+        }(g)
+    }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+const NO_EXTENSION = "(none)"
+
+// extensionTotals sums the estimates of the files with one extension.
+type extensionTotals struct {
+    files      int64
+    size       int64
+    candidates int64 // Files at or above their threshold
+    projected  int64 // Savings of the candidates
+}
+
+// recordExtension counts an estimated file for the per-extension breakdown.
+func recordExtension(shard *statsShard, path string, size int64, saved int64, candidate bool) {
+    if shard.extensionTotals == nil {
+        shard.extensionTotals = map[string]*extensionTotals{}
+    }
+    ext := strings.ToLower(filepath.Ext(path))
+    if ext == "" {
+        ext = NO_EXTENSION
+    }
+    t, ok := shard.extensionTotals[ext]
+    if !ok {
+        t = &extensionTotals{}
+        shard.extensionTotals[ext] = t
+    }
+    t.files++
+    t.size += size
+    if candidate {
+        t.candidates++
+        t.projected += saved
+    }
+}
+
+// mergedExtensionTotals sums the per-extension totals of all workers.
+func mergedExtensionTotals() map[string]*extensionTotals {
+    stats.mu.Lock()
+    defer stats.mu.Unlock()
+
+    merged := map[string]*extensionTotals{}
+    for _, shard := range stats.shards {
+        for ext, t := range shard.extensionTotals {
+            m, ok := merged[ext]
+            if !ok {
+                m = &extensionTotals{}
+                merged[ext] = m
+            }
+            m.files += t.files
+            m.size += t.size
+            m.candidates += t.candidates
+            m.projected += t.projected
+        }
+    }
+    return merged
+}
+
+// sortedExtensions returns the extensions by projected savings, then size.
+func sortedExtensions(totals map[string]*extensionTotals) []string {
+    exts := make([]string, 0, len(totals))
+    for ext := range totals {
+        exts = append(exts, ext)
+    }
+    sort.Slice(exts, func(i, j int) bool {
+        a, b := totals[exts[i]], totals[exts[j]]
+        if a.projected != b.projected {
+            return a.projected > b.projected
+        }
+        return a.size > b.size
+    })
+    return exts
+}
+
+// printExtensionBreakdown lists the n extensions with the most projected
+// savings, followed by the totals over all of them.
+func printExtensionBreakdown(n int) {
+    if n <= 0 {
+        return
+    }
+    totals := mergedExtensionTotals()
+    exts := sortedExtensions(totals)
+    if len(exts) == 0 {
+        return
+    }
+
+    fmt.Printf("\nProjected savings by extension:\n")
+    fmt.Printf("  %-12s %10s %10s %16s %16s %7s\n", "extension", "files", "candidates", "size", "savings", "ratio")
+    for _, ext := range exts[:min(n, len(exts))] {
+        t := totals[ext]
+        var ratio float64
+        if t.size > 0 {
+            ratio = float64(t.projected) / float64(t.size) * 100
+        }
+        fmt.Printf("  %-12s %10d %10d %16d %16d %6.1f%%\n", ext, t.files, t.candidates, t.size, t.projected, ratio)
+    }
+    if len(exts) > n {
+        fmt.Printf("  ... and %d more extensions\n", len(exts)-n)
+    }
+
+    var all extensionTotals
+    for _, t := range totals {
+        all.files += t.files
+        all.size += t.size
+        all.candidates += t.candidates
+        all.projected += t.projected
+    }
+    if all.size > 0 {
+        fmt.Printf("Candidates for compression: %d of %d files estimated, saving %d of %d bytes (%.1f%%)\n",
+            all.candidates, all.files, all.projected, all.size, float64(all.projected)/float64(all.size)*100)
+    }
+}
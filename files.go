@@ -0,0 +1,105 @@
+package main
+
+import (
+    "bufio"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "syscall"
+)
+
+// readFileList reads the paths listed one per line in path, or on the
+// standard input for -, for -files-from. Empty lines and lines starting
+// with # are ignored.
+func readFileList(path string) ([]string, error) {
+    var r io.Reader = os.Stdin
+    if path != "-" {
+        f, err := os.Open(path)
+        if err != nil {
+            return nil, err
+        }
+        defer f.Close()
+        r = f
+    }
+
+    var paths []string
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        paths = append(paths, line)
+    }
+    return paths, scanner.Err()
+}
+
+// isFile reports whether path names a regular file rather than a folder.
+func isFile(path string) bool {
+    info, err := os.Stat(path)
+    return err == nil && info.Mode().IsRegular()
+}
+
+// usableFiles returns the files whose volume supports compression, checking
+// each volume once.
+func usableFiles(files []string, needWrite bool) []string {
+    checked := map[string]bool{}
+    var usable []string
+    for _, path := range files {
+        volume := strings.ToLower(filepath.VolumeName(path))
+        ok, seen := checked[volume]
+        if !seen {
+            err := checkVolume(path, needWrite)
+            if err != nil {
+                noticef("Skipping files on the volume of %s: %v\n", path, err)
+                recordProblem(PROBLEM_VOLUME, path, err.Error())
+            }
+            ok = err == nil
+            checked[volume] = ok
+        }
+        if ok {
+            usable = append(usable, path)
+        }
+    }
+    return usable
+}
+
+// queueFiles queues the files given on their own, without a walk and so
+// whatever the walk's filters, recording their sizes in dirs.
+func queueFiles(files []string, paths chan<- fileTask, dirs dirStats, shard *statsShard) {
+    for _, path := range files {
+        info, err := os.Stat(path)
+        if err != nil {
+            noticef("Error accessing path %s: %v\n", path, err)
+            recordProblem(PROBLEM_WALK, path, err.Error())
+            continue
+        }
+        if !info.Mode().IsRegular() {
+            noticef("Skipping %s, not a regular file\n", path)
+            continue
+        }
+        if ignored, by := ignoredByFolders(path); ignored {
+            debugf("Skipping %s, ignored by %s\n", path, by)
+            continue
+        }
+
+        task := fileTask{path: path, modTime: info.ModTime(), size: info.Size()}
+        if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+            task.attrs = data.FileAttributes
+        }
+        if isStub(task.attrs) {
+            shard.stubFiles.Add(1)
+            shard.stubBytes.Add(info.Size())
+            continue
+        }
+        select {
+        case paths <- task:
+            totals := dirs.get(filepath.Dir(path))
+            totals.size += info.Size()
+            totals.files++
+        case <-stopWalk:
+            return
+        }
+    }
+}
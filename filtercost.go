@@ -0,0 +1,100 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+// Kinds of file system call timed by -measure-filters
+const (
+    IO_OPEN = iota
+    IO_READ
+    IO_FSCTL
+    IO_CLOSE
+    IO_KINDS
+)
+
+// ioTimings accumulates the time spent in each kind of file system call for
+// -measure-filters. Filter drivers such as antivirus do most of their work
+// when files are opened, closed or changed, so that time growing large
+// against raw reads points at a filter rather than at the disk. Each worker
+// keeps its own in its shard; calls made outside the workers pass nil and
+// aren't timed.
+type ioTimings struct {
+    opens atomic.Int64
+    times [IO_KINDS]atomic.Int64
+}
+
+// ioTotals is the merge of the timings of all workers.
+type ioTotals struct {
+    opens int64
+    times [IO_KINDS]time.Duration
+}
+
+// measure adds the time since start to the given kind of call when
+// measuring.
+func (t *ioTimings) measure(kind int, start time.Time) {
+    if t != nil && opts.MeasureFilters {
+        t.times[kind].Add(int64(time.Since(start)))
+    }
+}
+
+// opened counts one file opened.
+func (t *ioTimings) opened() {
+    if t != nil {
+        t.opens.Add(1)
+    }
+}
+
+// timedFile is a file opened for estimation whose reads and close are
+// measured.
+type timedFile struct {
+    *os.File
+    times *ioTimings
+}
+
+func (f timedFile) Read(p []byte) (int, error) {
+    start := time.Now()
+    n, err := f.File.Read(p)
+    f.times.measure(IO_READ, start)
+    return n, err
+}
+
+func (f timedFile) Close() error {
+    start := time.Now()
+    err := f.File.Close()
+    f.times.measure(IO_CLOSE, start)
+    return err
+}
+
+// printFilterCost reports where file system time went and suggests an
+// antivirus exclusion when opening, closing and changing files cost more
+// than reading them.
+func printFilterCost(t ioTotals) {
+    open := t.times[IO_OPEN]
+    read := t.times[IO_READ]
+    fsctl := t.times[IO_FSCTL]
+    closing := t.times[IO_CLOSE]
+    total := open + read + fsctl + closing
+    if total == 0 {
+        return
+    }
+
+    share := func(d time.Duration) float64 { return float64(d) / float64(total) * 100 }
+    fmt.Printf("\nFile system time (summed over workers):\n")
+    fmt.Printf("  %-20s %12v %5.1f%%\n", "open", open.Round(time.Millisecond), share(open))
+    fmt.Printf("  %-20s %12v %5.1f%%\n", "read", read.Round(time.Millisecond), share(read))
+    fmt.Printf("  %-20s %12v %5.1f%%\n", "compression change", fsctl.Round(time.Millisecond), share(fsctl))
+    fmt.Printf("  %-20s %12v %5.1f%%\n", "close", closing.Round(time.Millisecond), share(closing))
+    if opens := t.opens; opens > 0 {
+        fmt.Printf("  average open: %v over %d opens\n", (open / time.Duration(opens)).Round(time.Microsecond), opens)
+    }
+
+    if open+fsctl+closing > read {
+        fmt.Printf("Opening, closing and changing files took longer than reading them, which usually means\n" +
+            "a filter driver such as antivirus inspects every open. Excluding this program's process\n" +
+            "from real-time scanning for the duration of the run is likely to speed it up considerably.\n")
+    }
+}
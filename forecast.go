@@ -0,0 +1,218 @@
+package main
+
+import (
+    "bytes"
+    "compress/flate"
+    "fmt"
+    "io"
+    "path/filepath"
+)
+
+const (
+    COMPRESSION_FORMAT_LZNT1       = 2
+    COMPRESSION_FORMAT_XPRESS_HUFF = 4
+    COMPRESSION_ENGINE_STANDARD    = 0
+    STATUS_BUFFER_ALL_ZEROS        = 0x00000117
+
+    CLUSTER_SIZE          = 4096      // Allocation granularity assumed for forecasts
+    LZNT1_UNIT_SIZE       = 16 * 4096 // NTFS compresses 16-cluster units
+    XPRESS8K_CHUNK_SIZE   = 8 << 10
+    LZX_CHUNK_SIZE        = 32 << 10
+    WOF_CHUNK_TABLE_ENTRY = 4 // Bytes of chunk offset table per WOF chunk
+)
+
+// Backends forecast side by side
+const (
+    BACKEND_LZNT1 = iota
+    BACKEND_XPRESS8K
+    BACKEND_LZX
+    BACKEND_COUNT
+)
+
+var backendNames = [BACKEND_COUNT]string{"LZNT1", "XPRESS8K", "LZX~"}
+
+// backendForecast is the projected allocation of data under each backend,
+// along with the logical size of the data forecast.
+type backendForecast struct {
+    size  int64
+    alloc [BACKEND_COUNT]int64
+}
+
+func (f *backendForecast) add(other backendForecast) {
+    f.size += other.size
+    for backend := range f.alloc {
+        f.alloc[backend] += other.alloc[backend]
+    }
+}
+
+// rtlCompressor compresses chunks with a format built into Windows.
+type rtlCompressor struct {
+    format    uint16
+    workspace []byte
+    output    []byte
+}
+
+func newRtlCompressor(format uint16, chunkSize int) (*rtlCompressor, error) {
+    status, workspaceSize, _ := rtlGetCompressionWorkSpaceSize(format | COMPRESSION_ENGINE_STANDARD)
+    if status != 0 {
+        return nil, fmt.Errorf("RtlGetCompressionWorkSpaceSize failed with status 0x%x", status)
+    }
+
+    return &rtlCompressor{
+        format:    format,
+        workspace: make([]byte, workspaceSize),
+        output:    make([]byte, chunkSize+chunkSize/8+4096),
+    }, nil
+}
+
+// compressedSize returns the size chunk compresses to, 0 for all-zero data
+// (which NTFS stores sparse) and len(chunk) when it doesn't shrink.
+func (c *rtlCompressor) compressedSize(chunk []byte) int64 {
+    if len(chunk) == 0 {
+        return 0
+    }
+    status, finalSize := rtlCompressBuffer(c.format|COMPRESSION_ENGINE_STANDARD, chunk, c.output, CLUSTER_SIZE, c.workspace)
+    switch {
+    case status == STATUS_BUFFER_ALL_ZEROS:
+        return 0
+    case status != 0 || int(finalSize) >= len(chunk):
+        return int64(len(chunk))
+    }
+    return int64(finalSize)
+}
+
+// allocationSavings returns the percentage of a forecast's size saved by
+// backend.
+func allocationSavings(f backendForecast, backend int) float64 {
+    return float64(roundToCluster(f.size)-f.alloc[backend]) / float64(f.size) * 100
+}
+
+func roundToCluster(n int64) int64 {
+    return (n + CLUSTER_SIZE - 1) / CLUSTER_SIZE * CLUSTER_SIZE
+}
+
+// forecastFile reads a file once and projects its allocation under LZNT1
+// (NTFS compression), XPRESS8K and LZX (WOF). LZX has no system compressor
+// outside WOF itself, so it is approximated with maximum-level deflate over
+// the same 32 KiB chunks; it is marked with ~ in reports.
+func forecastFile(path string, times *ioTimings) (backendForecast, error) {
+    waitForQuietDisk(path)
+    readSlots.acquire()
+    defer readSlots.release()
+
+    var forecast backendForecast
+
+    file, err := openForRead(path, times)
+    if err != nil {
+        return forecast, err
+    }
+    defer file.Close()
+
+    lznt1, err := newRtlCompressor(COMPRESSION_FORMAT_LZNT1, LZNT1_UNIT_SIZE)
+    if err != nil {
+        return forecast, err
+    }
+    xpress, err := newRtlCompressor(COMPRESSION_FORMAT_XPRESS_HUFF, XPRESS8K_CHUNK_SIZE)
+    if err != nil {
+        return forecast, err
+    }
+
+    var lzxBuffer bytes.Buffer
+    lzx, err := flate.NewWriter(&lzxBuffer, flate.BestCompression)
+    if err != nil {
+        return forecast, err
+    }
+
+    var xpressTotal, lzxTotal, chunks8k, chunks32k int64
+    unit := make([]byte, LZNT1_UNIT_SIZE)
+    for {
+        n, err := io.ReadFull(file, unit)
+        if n == 0 {
+            break
+        }
+        if err != nil && err != io.ErrUnexpectedEOF {
+            return forecast, err
+        }
+        data := unit[:n]
+
+        // NTFS keeps a unit compressed only if it saves at least a cluster
+        forecast.size += int64(n)
+        forecast.alloc[BACKEND_LZNT1] += min(roundToCluster(lznt1.compressedSize(data)), roundToCluster(int64(n)))
+
+        for offset := 0; offset < n; offset += XPRESS8K_CHUNK_SIZE {
+            xpressTotal += xpress.compressedSize(data[offset:min(offset+XPRESS8K_CHUNK_SIZE, n)])
+            chunks8k++
+        }
+
+        for offset := 0; offset < n; offset += LZX_CHUNK_SIZE {
+            chunk := data[offset:min(offset+LZX_CHUNK_SIZE, n)]
+            lzxBuffer.Reset()
+            lzx.Reset(&lzxBuffer)
+            lzx.Write(chunk)
+            lzx.Close()
+            lzxTotal += min(int64(lzxBuffer.Len()), int64(len(chunk)))
+            chunks32k++
+        }
+
+        if n < LZNT1_UNIT_SIZE {
+            break
+        }
+    }
+
+    // WOF stores the chunks back to back after a table of chunk offsets
+    forecast.alloc[BACKEND_XPRESS8K] = roundToCluster(xpressTotal + chunks8k*WOF_CHUNK_TABLE_ENTRY)
+    forecast.alloc[BACKEND_LZX] = roundToCluster(lzxTotal + chunks32k*WOF_CHUNK_TABLE_ENTRY)
+
+    return forecast, nil
+}
+
+// recordDirForecast adds a file's forecast to its directory in the worker's
+// shard.
+func recordDirForecast(shard *statsShard, dir string, forecast backendForecast) {
+    if shard.dirForecasts == nil {
+        shard.dirForecasts = map[string]*backendForecast{}
+    }
+    totals, ok := shard.dirForecasts[dir]
+    if !ok {
+        totals = &backendForecast{}
+        shard.dirForecasts[dir] = totals
+    }
+    totals.add(forecast)
+}
+
+// printForecast prints the projected savings of each backend for the
+// largest directories and the whole run.
+func printForecast(roots []string, n int) {
+    merged := mergedDirStats(roots)
+
+    total := &dirTotals{}
+    for _, root := range roots {
+        if rootTotals, ok := merged[filepath.Clean(root)]; ok {
+            total.forecast.add(rootTotals.forecast)
+        }
+    }
+    if total.forecast.size == 0 {
+        return
+    }
+
+    fmt.Printf("\nProjected savings by backend (~ approximated):\n")
+    fmt.Printf("  %-15s", "")
+    for _, name := range backendNames {
+        fmt.Printf("  %15s", name)
+    }
+    fmt.Printf("\n")
+
+    printRow := func(label string, t *dirTotals) {
+        fmt.Printf("  %-15s", label)
+        for backend := range t.forecast.alloc {
+            fmt.Printf("  %15d", t.forecast.size-t.forecast.alloc[backend])
+        }
+        fmt.Printf("\n")
+    }
+
+    printRow("Total", total)
+    for _, dir := range topDirsBySize(merged, n) {
+        printRow("", merged[dir])
+        fmt.Printf("    %s\n", displayPath(dir))
+    }
+}
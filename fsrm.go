@@ -0,0 +1,98 @@
+package main
+
+import (
+    "encoding/csv"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "time"
+)
+
+// FSRM names storage report files after the report and the time it ran;
+// -fsrm-report files follow the same scheme so they sort in with them.
+const FSRM_TIME_LAYOUT = "2006-01-02_15-04-05"
+
+// writeCSV writes rows below a header to path.
+func writeCSV(path string, header []string, rows [][]string) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+
+    w := csv.NewWriter(f)
+    w.Write(header)
+    w.WriteAll(rows)
+    if err := w.Error(); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// writeFsrmReports writes the savings by folder and, when owners were
+// collected, by owner to dir as CSV files. Folders are keyed by full path
+// and owners by DOMAIN\user and volume like the FSRM Files by Owner and
+// Quota Usage reports, so both can be joined on the same columns.
+func writeFsrmReports(dir string, roots []string, endTime time.Time) ([]string, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    suffix := "_" + endTime.Format(FSRM_TIME_LAYOUT) + ".csv"
+
+    merged := mergedDirStats(roots)
+    folders := make([]string, 0, len(merged))
+    for folder, t := range merged {
+        if t.files > 0 {
+            folders = append(folders, folder)
+        }
+    }
+    sort.Strings(folders)
+
+    var rows [][]string
+    for _, folder := range folders {
+        t := merged[folder]
+        rows = append(rows, []string{
+            redactPath(folder, false),
+            strconv.FormatInt(t.files, 10),
+            strconv.FormatInt(t.size, 10),
+            strconv.FormatInt(t.size-t.saved, 10),
+            strconv.FormatInt(t.saved, 10),
+        })
+    }
+
+    folderReport := filepath.Join(dir, "CompressionByFolder"+suffix)
+    header := []string{"Folder", "Number of Files", "Total Size", "Size after Compression", "Compression Savings"}
+    if err := writeCSV(folderReport, header, rows); err != nil {
+        return nil, err
+    }
+    written := []string{folderReport}
+
+    if !collectOwners() {
+        return written, nil
+    }
+
+    savings := mergedOwnerSavings()
+    keys := make([]ownerKey, 0, len(savings))
+    for key := range savings {
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        if keys[i].volume != keys[j].volume {
+            return keys[i].volume < keys[j].volume
+        }
+        return savings[keys[i]] > savings[keys[j]]
+    })
+
+    rows = nil
+    for _, key := range keys {
+        rows = append(rows, []string{accountName(key.sid), key.sid, key.volume, strconv.FormatInt(savings[key], 10)})
+    }
+
+    ownerReport := filepath.Join(dir, "CompressionByOwner"+suffix)
+    header = []string{"Owner", "SID", "Volume", "Compression Savings"}
+    if err := writeCSV(ownerReport, header, rows); err != nil {
+        return written, err
+    }
+    return append(written, ownerReport), nil
+}
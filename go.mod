@@ -2,4 +2,4 @@ module ntfs_pancake
 
 go 1.22.5
 
-require golang.org/x/sys v0.23.0 // indirect
+require golang.org/x/sys v0.23.0
@@ -0,0 +1,214 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+const (
+    HOOK_PRE_RUN   = "pre-run"
+    HOOK_POST_RUN  = "post-run"
+    HOOK_DIRECTORY = "directory"
+
+    DEFAULT_HOOK_TIMEOUT = 5 * time.Minute
+)
+
+// hookContext is passed as JSON on the standard input of hook commands.
+type hookContext struct {
+    Event     string         `json:"event"`
+    RunName   string         `json:"run_name,omitempty"`
+    Mode      string         `json:"mode,omitempty"`
+    Roots     []string       `json:"roots"`
+    Applying  bool           `json:"applying"`
+    StartTime time.Time      `json:"start_time"`
+    EndTime   *time.Time     `json:"end_time,omitempty"`
+    Totals    *statsSnapshot `json:"totals,omitempty"`
+    Aborted   bool           `json:"aborted,omitempty"`
+
+    // Set for directory hooks: the files directly in the directory
+    Directory string `json:"directory,omitempty"`
+    Files     int64  `json:"files,omitempty"`
+    Saved     int64  `json:"saved,omitempty"`
+}
+
+func newHookContext(event string, startTime time.Time) hookContext {
+    return hookContext{
+        Event:     event,
+        RunName:   opts.RunName,
+        Mode:      opts.mode,
+        Roots:     opts.Roots,
+        Applying:  opts.applying(),
+        StartTime: startTime.UTC(),
+    }
+}
+
+// runHook runs command through cmd.exe with the context on its standard
+// input and its output going to ours, waiting up to -hook-timeout.
+func runHook(command string, hc hookContext) error {
+    data, err := json.Marshal(hc)
+    if err != nil {
+        return err
+    }
+
+    ctx := context.Background()
+    if opts.HookTimeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, opts.HookTimeout)
+        defer cancel()
+    }
+
+    // The command line is passed as given, cmd.exe quoting included
+    cmd := exec.CommandContext(ctx, "cmd.exe")
+    cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: "cmd.exe /c " + command}
+    cmd.Stdin = bytes.NewReader(data)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    return cmd.Run()
+}
+
+// dirProgress counts the files of a directory queued and still in flight.
+type dirProgress struct {
+    files   int64
+    pending int64
+    saved   int64
+    listed  bool // The walk has left the directory
+}
+
+// dirTracker tells when every file directly in a walked directory has been
+// processed and runs the directory hook for it. Hooks run one at a time on
+// their own goroutine, draining a queue with no bound so workers never wait
+// for them.
+type dirTracker struct {
+    mu      sync.Mutex
+    dirs    map[string]*dirProgress
+    base    hookContext
+    events  []hookContext
+    wake    *sync.Cond // Signaled when events are queued or the run stops
+    stopped bool
+    done    chan struct{}
+}
+
+// directories is nil unless -directory-hook is set.
+var directories *dirTracker
+
+func startDirectoryHooks(command string, startTime time.Time) *dirTracker {
+    t := &dirTracker{
+        dirs: map[string]*dirProgress{},
+        base: newHookContext(HOOK_DIRECTORY, startTime),
+        done: make(chan struct{}),
+    }
+    t.wake = sync.NewCond(&t.mu)
+    go func() {
+        defer close(t.done)
+        for {
+            t.mu.Lock()
+            for len(t.events) == 0 && !t.stopped {
+                t.wake.Wait()
+            }
+            if len(t.events) == 0 {
+                t.mu.Unlock()
+                return
+            }
+            hc := t.events[0]
+            t.events = t.events[1:]
+            t.mu.Unlock()
+
+            if err := runHook(command, hc); err != nil {
+                noticef("Error running directory hook for %s: %v\n", hc.Directory, err)
+            }
+        }
+    }()
+    return t
+}
+
+func (t *dirTracker) get(dir string) *dirProgress {
+    p, ok := t.dirs[dir]
+    if !ok {
+        p = &dirProgress{}
+        t.dirs[dir] = p
+    }
+    return p
+}
+
+// complete queues the hook for dir once it is listed and nothing in it is
+// in flight. Directories without files are left out. Called with the lock
+// held.
+func (t *dirTracker) complete(dir string, p *dirProgress) {
+    if !p.listed || p.pending > 0 {
+        return
+    }
+    delete(t.dirs, dir)
+    if p.files == 0 {
+        return
+    }
+    hc := t.base
+    hc.Directory, hc.Files, hc.Saved = dir, p.files, p.saved
+    t.events = append(t.events, hc)
+    t.wake.Signal()
+}
+
+// queued records that the walker queued the file at path.
+func (t *dirTracker) queued(path string) {
+    if t == nil {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    p := t.get(filepath.Dir(path))
+    p.files++
+    p.pending++
+}
+
+// listed records that the walker has left dir.
+func (t *dirTracker) listed(dir string) {
+    if t == nil {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    p := t.get(dir)
+    p.listed = true
+    t.complete(dir, p)
+}
+
+// finished records that a worker is done with the file at path.
+func (t *dirTracker) finished(path string, saved int64) {
+    if t == nil {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    dir := filepath.Dir(path)
+    p := t.get(dir)
+    p.pending--
+    p.saved += saved
+    t.complete(dir, p)
+}
+
+// stop waits for the queued directory hooks to finish.
+func (t *dirTracker) stop() {
+    if t == nil {
+        return
+    }
+    t.mu.Lock()
+    t.stopped = true
+    t.wake.Signal()
+    t.mu.Unlock()
+    <-t.done
+}
+
+// within reports whether path is below dir.
+func within(dir string, path string) bool {
+    if !strings.HasSuffix(dir, `\`) {
+        dir += `\`
+    }
+    return strings.HasPrefix(path, dir)
+}
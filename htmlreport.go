@@ -0,0 +1,171 @@
+package main
+
+import (
+    "fmt"
+    "html/template"
+    "os"
+    "time"
+)
+
+const HTML_REPORT_ERRORS = 1000 // Errors listed in the HTML report; the rest are only counted
+
+// htmlReport is what the -html-report template is rendered from.
+type htmlReport struct {
+    RunName     string
+    Roots       []string
+    StartTime   time.Time
+    EndTime     time.Time
+    Applying    bool
+    Totals      statsSnapshot
+    Saved       int64 // Space saved, or projected when nothing was applied
+    TopDirs     []htmlDir
+    Extensions  []htmlExtension
+    Errors      []fileError
+    ErrorsTotal int
+}
+
+type htmlDir struct {
+    Path  string
+    Files int64
+    Size  int64
+    Saved int64
+}
+
+type htmlExtension struct {
+    Extension  string
+    Files      int64
+    Candidates int64
+    Size       int64
+    Projected  int64
+}
+
+// humanBytes formats a size for readers who don't count in bytes.
+func humanBytes(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%d B", n)
+    }
+    div, exp := int64(unit), 0
+    for m := n / unit; m >= unit; m /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// percent returns part as a percentage of whole.
+func percent(part int64, whole int64) string {
+    if whole <= 0 {
+        return "-"
+    }
+    return fmt.Sprintf("%.1f%%", float64(part)/float64(whole)*100)
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+    "bytes":   humanBytes,
+    "percent": percent,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ntfs_pancake report{{if .RunName}}: {{.RunName}}{{end}}</title>
+<style>
+body { font-family: Segoe UI, sans-serif; margin: 2em; color: #222; }
+.cards { display: flex; flex-wrap: wrap; gap: 1em; margin: 1em 0 2em; }
+.card { border: 1px solid #ddd; border-radius: 6px; padding: 1em 1.5em; min-width: 10em; }
+.card .value { font-size: 1.6em; font-weight: 600; }
+.card .label { color: #666; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border-bottom: 1px solid #eee; padding: 0.3em 0.8em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #f5f5f5; }
+</style>
+</head>
+<body>
+<h1>ntfs_pancake report{{if .RunName}}: {{.RunName}}{{end}}</h1>
+<p>{{range $i, $root := .Roots}}{{if $i}}, {{end}}{{$root}}{{end}}<br>
+{{.StartTime.Format "2006-01-02 15:04:05"}} to {{.EndTime.Format "2006-01-02 15:04:05"}}{{if not .Applying}}, nothing was modified{{end}}</p>
+
+<div class="cards">
+<div class="card"><div class="value">{{.Totals.FilesProcessed}}</div><div class="label">files processed</div></div>
+{{if .Applying}}<div class="card"><div class="value">{{.Totals.FilesCompressed}}</div><div class="label">files compressed</div></div>
+<div class="card"><div class="value">{{.Totals.FilesDecompressed}}</div><div class="label">files decompressed</div></div>
+<div class="card"><div class="value">{{bytes .Saved}}</div><div class="label">space saved</div></div>
+{{else}}<div class="card"><div class="value">{{.Totals.FilesPlannedCompress}}</div><div class="label">files worth compressing</div></div>
+<div class="card"><div class="value">{{bytes .Saved}}</div><div class="label">projected savings</div></div>
+{{end}}<div class="card"><div class="value">{{.ErrorsTotal}}</div><div class="label">errors</div></div>
+</div>
+
+{{if .TopDirs}}<h2>Top directories by savings</h2>
+<table>
+<tr><th>Directory</th><th>Files</th><th>Size</th><th>Saved</th><th>Ratio</th></tr>
+{{range .TopDirs}}<tr><td>{{.Path}}</td><td>{{.Files}}</td><td>{{bytes .Size}}</td><td>{{bytes .Saved}}</td><td>{{percent .Saved .Size}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Extensions}}<h2>Projected savings by extension</h2>
+<table>
+<tr><th>Extension</th><th>Files</th><th>Candidates</th><th>Size</th><th>Savings</th><th>Ratio</th></tr>
+{{range .Extensions}}<tr><td>{{.Extension}}</td><td>{{.Files}}</td><td>{{.Candidates}}</td><td>{{bytes .Size}}</td><td>{{bytes .Projected}}</td><td>{{percent .Projected .Size}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Errors}}<h2>Errors</h2>
+<table>
+<tr><th>File</th><th>Result</th></tr>
+{{range .Errors}}<tr><td>{{.Path}}</td><td>{{.Result}}</td></tr>
+{{end}}</table>
+{{if gt .ErrorsTotal (len .Errors)}}<p>{{len .Errors}} of {{.ErrorsTotal}} errors listed</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// writeHTMLReport writes a self-contained HTML report of the run, with the
+// top n directories and extensions, to hand to people who won't read logs.
+func writeHTMLReport(path string, summary statsSnapshot, startTime time.Time, endTime time.Time, n int) error {
+    r := htmlReport{
+        RunName:   opts.RunName,
+        Roots:     redactPaths(opts.Roots),
+        StartTime: startTime,
+        EndTime:   endTime,
+        Applying:  opts.applying(),
+        Totals:    summary,
+        Saved:     summary.SpaceSaved,
+    }
+    if !r.Applying {
+        r.Saved = summary.SpaceProjected
+    }
+
+    merged := mergedDirStats(opts.Roots)
+    for _, dir := range topDirsBySavings(merged, n) {
+        t := merged[dir]
+        r.TopDirs = append(r.TopDirs, htmlDir{Path: reportPath(dir, false), Files: t.files, Size: t.size, Saved: t.saved})
+    }
+
+    totals := mergedExtensionTotals()
+    exts := sortedExtensions(totals)
+    for _, ext := range exts[:min(n, len(exts))] {
+        t := totals[ext]
+        r.Extensions = append(r.Extensions, htmlExtension{Extension: ext, Files: t.files, Candidates: t.candidates, Size: t.size, Projected: t.projected})
+    }
+
+    stats.mu.Lock()
+    for _, shard := range stats.shards {
+        for _, e := range shard.errors {
+            if len(r.Errors) < HTML_REPORT_ERRORS {
+                r.Errors = append(r.Errors, fileError{Path: reportPath(e.Path, true), Result: e.Result})
+            }
+            r.ErrorsTotal++
+        }
+    }
+    stats.mu.Unlock()
+
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if err := htmlReportTemplate.Execute(f, r); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
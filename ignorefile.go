@@ -0,0 +1,197 @@
+package main
+
+import (
+    "bufio"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+)
+
+const DEFAULT_IGNORE_FILE = ".pancakeignore"
+
+// ignoreRule is one line of an ignore file, in the gitignore syntax: ! re-
+// includes, a trailing / only matches folders, and a pattern with a / other
+// than at its end is relative to the folder of the file rather than matched
+// at any depth below it.
+type ignoreRule struct {
+    negate  bool
+    dirOnly bool
+    pattern []string
+}
+
+// ignoreFile is the rules found in one folder.
+type ignoreFile struct {
+    dir   string // State key of the folder
+    path  string
+    rules []ignoreRule
+}
+
+// parseIgnoreRule parses a line, returning false for blank lines, comments
+// and invalid patterns.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+    line = strings.TrimRight(line, " \t\r")
+    if line == "" || strings.HasPrefix(line, "#") {
+        return ignoreRule{}, false
+    }
+
+    var rule ignoreRule
+    if strings.HasPrefix(line, "!") {
+        rule.negate = true
+        line = line[1:]
+    } else if strings.HasPrefix(line, `\`) && len(line) > 1 && (line[1] == '!' || line[1] == '#') {
+        line = line[1:]
+    }
+    line = strings.ToLower(filepath.FromSlash(line))
+    if strings.HasSuffix(line, `\`) {
+        rule.dirOnly = true
+        line = strings.TrimRight(line, `\`)
+    }
+    anchored := strings.Contains(line, `\`)
+    line = strings.TrimLeft(line, `\`)
+    if line == "" {
+        return ignoreRule{}, false
+    }
+
+    rule.pattern = strings.Split(line, `\`)
+    for _, part := range rule.pattern {
+        if _, err := filepath.Match(part, ""); err != nil {
+            return ignoreRule{}, false
+        }
+    }
+    if !anchored {
+        rule.pattern = append([]string{"**"}, rule.pattern...)
+    }
+    return rule, true
+}
+
+// loadIgnoreFile reads the ignore file in dir, returning nil when there is
+// none.
+func loadIgnoreFile(dir string) *ignoreFile {
+    path := filepath.Join(dir, opts.IgnoreFile)
+    f, err := os.Open(path)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            noticef("Error reading %s: %v\n", path, err)
+        }
+        return nil
+    }
+    defer f.Close()
+
+    ignore := &ignoreFile{dir: stateKey(dir), path: path}
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+            ignore.rules = append(ignore.rules, rule)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        noticef("Error reading %s: %v\n", path, err)
+    }
+    if len(ignore.rules) == 0 {
+        return nil
+    }
+    debugf("Honoring %d rules of %s\n", len(ignore.rules), path)
+    return ignore
+}
+
+// Ignore files of the folders above walk roots, file arguments and plan
+// entries, by state key of the folder; nil for folders without one
+var (
+    ancestorIgnoresMu sync.Mutex
+    ancestorIgnores   = map[string]*ignoreFile{}
+)
+
+func cachedIgnoreFile(dir string) *ignoreFile {
+    key := stateKey(dir)
+    ancestorIgnoresMu.Lock()
+    defer ancestorIgnoresMu.Unlock()
+    ignore, ok := ancestorIgnores[key]
+    if !ok {
+        ignore = loadIgnoreFile(dir)
+        ancestorIgnores[key] = ignore
+    }
+    return ignore
+}
+
+// ignoresAbove returns the ignore files of the folders above path,
+// outermost first, for paths not reached by walking down to them. It also
+// reports whether one of those folders is itself ignored, which leaves out
+// everything below it, and by which file.
+func ignoresAbove(path string) (ignoreStack, bool, string) {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return nil, false, ""
+    }
+    var dirs []string
+    for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+        dirs = append(dirs, dir)
+        if parent := filepath.Dir(dir); parent == dir {
+            break
+        }
+    }
+
+    var stack ignoreStack
+    for i := len(dirs) - 1; i >= 0; i-- {
+        if ignored, by := stack.ignored(dirs[i], true); ignored {
+            return stack, true, by
+        }
+        if ignore := cachedIgnoreFile(dirs[i]); ignore != nil {
+            stack = append(stack, ignore)
+        }
+    }
+    return stack, false, ""
+}
+
+// ignoredByFolders reports whether the ignore files of the folders above a
+// file exclude it, returning the one deciding it. Without -ignore-file
+// nothing is.
+func ignoredByFolders(path string) (bool, string) {
+    if opts.IgnoreFile == "" {
+        return false, ""
+    }
+    stack, ignored, by := ignoresAbove(path)
+    if ignored {
+        return true, by
+    }
+    return stack.ignored(path, false)
+}
+
+// ignoreStack holds the ignore files of the folders the walk is inside of,
+// outermost first.
+type ignoreStack []*ignoreFile
+
+// enter drops the ignore files of the folders the walk has left for path.
+func (s *ignoreStack) enter(path string) {
+    key := stateKey(path)
+    for len(*s) > 0 {
+        top := (*s)[len(*s)-1]
+        if key == top.dir || within(top.dir, key) {
+            return
+        }
+        *s = (*s)[:len(*s)-1]
+    }
+}
+
+// ignored reports whether the ignore files exclude path, returning the one
+// deciding it. As with gitignore the last matching rule wins, and rules of
+// deeper files come after those of the folders above them.
+func (s ignoreStack) ignored(path string, dir bool) (bool, string) {
+    key := stateKey(path)
+    ignored, by := false, ""
+    for _, ignore := range s {
+        if key == ignore.dir {
+            continue
+        }
+        parts := strings.Split(strings.TrimPrefix(key, strings.TrimSuffix(ignore.dir, `\`)+`\`), `\`)
+        for _, rule := range ignore.rules {
+            if rule.dirOnly && !dir {
+                continue
+            }
+            if globMatch(rule.pattern, parts) {
+                ignored, by = !rule.negate, ignore.path
+            }
+        }
+    }
+    return ignored, by
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+
+    "golang.org/x/sys/windows"
+)
+
+// inventoryEntry is one file of the -inventory export.
+type inventoryEntry struct {
+    Path       string `json:"path"`
+    Attributes string `json:"attributes"`
+    Size       int64  `json:"size"`
+    Allocated  int64  `json:"allocated"`
+    Format     string `json:"format"`
+}
+
+// attributeLetters lists attributes the way attrib and Explorer show them,
+// e.g. "AC" for an archived compressed file.
+var attributeLetters = []struct {
+    attr   uint32
+    letter string
+}{
+    {windows.FILE_ATTRIBUTE_READONLY, "R"},
+    {windows.FILE_ATTRIBUTE_HIDDEN, "H"},
+    {windows.FILE_ATTRIBUTE_SYSTEM, "S"},
+    {windows.FILE_ATTRIBUTE_ARCHIVE, "A"},
+    {windows.FILE_ATTRIBUTE_TEMPORARY, "T"},
+    {windows.FILE_ATTRIBUTE_SPARSE_FILE, "P"},
+    {windows.FILE_ATTRIBUTE_REPARSE_POINT, "L"},
+    {windows.FILE_ATTRIBUTE_COMPRESSED, "C"},
+    {windows.FILE_ATTRIBUTE_OFFLINE, "O"},
+    {windows.FILE_ATTRIBUTE_NOT_CONTENT_INDEXED, "I"},
+    {windows.FILE_ATTRIBUTE_ENCRYPTED, "E"},
+}
+
+func formatAttributes(attrs uint32) string {
+    var b strings.Builder
+    for _, a := range attributeLetters {
+        if attrs&a.attr != 0 {
+            b.WriteString(a.letter)
+        }
+    }
+    return b.String()
+}
+
+// writeInventory writes what the inventory subcommand found, as a JSON
+// array for a .json path and as CSV otherwise.
+func writeInventory(path string, records []fileRecord) error {
+    sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+
+    entries := make([]inventoryEntry, 0, len(records))
+    for _, rec := range records {
+        if rec.Result != RESULT_EXAMINED {
+            continue
+        }
+        entries = append(entries, inventoryEntry{
+            Path:       redactPath(rec.Path, true),
+            Attributes: formatAttributes(rec.Attributes),
+            Size:       rec.Size,
+            Allocated:  rec.Stored,
+            Format:     rec.Format,
+        })
+    }
+
+    if strings.EqualFold(filepath.Ext(path), ".json") {
+        data, err := json.MarshalIndent(entries, "", "  ")
+        if err != nil {
+            return err
+        }
+        return os.WriteFile(path, append(data, '\n'), 0644)
+    }
+
+    header := []string{"path", "attributes", "size", "allocated", "format"}
+    rows := make([][]string, len(entries))
+    for i, e := range entries {
+        rows[i] = []string{e.Path, e.Attributes, strconv.FormatInt(e.Size, 10), strconv.FormatInt(e.Allocated, 10), e.Format}
+    }
+    return writeCSV(path, header, rows)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+)
+
+const (
+    JOURNAL_BEGIN = "begin"
+    JOURNAL_END   = "end"
+)
+
+// journalEntry is one line of the change journal kept next to the -state
+// file. A directory is begun, and the record synced, before the first file
+// in it is changed, and ended once the walk has left it and every file
+// queued from it is done. A directory begun but never ended was being
+// converted when the run died.
+type journalEntry struct {
+    Op  string `json:"op"`
+    Dir string `json:"dir"`
+}
+
+// journalDir is what the journal knows of one directory. Files not queued
+// by a walk, given on their own or from a plan, have no walk to wait for.
+type journalDir struct {
+    begun    bool
+    walking  bool  // The walk queued files from it and hasn't left it yet
+    queued   int64 // Files queued by the walk and not done yet
+    inFlight int   // Changes begun and not ended yet
+}
+
+// changeJournal groups the changes by directory, so the journal costs one
+// sync per directory rather than one per file.
+type changeJournal struct {
+    mu   sync.Mutex
+    file *os.File
+    dirs map[string]*journalDir
+}
+
+var journal *changeJournal
+
+func journalPath(statePath string) string {
+    return statePath + ".journal"
+}
+
+func openChangeJournal(path string) (*changeJournal, error) {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &changeJournal{file: f, dirs: map[string]*journalDir{}}, nil
+}
+
+func (j *changeJournal) get(dir string) *journalDir {
+    d, ok := j.dirs[dir]
+    if !ok {
+        d = &journalDir{}
+        j.dirs[dir] = d
+    }
+    return d
+}
+
+// settle ends dir once nothing more can change in it. A lost end record
+// only costs a needless re-verification, so it isn't synced.
+func (j *changeJournal) settle(dir string, d *journalDir) {
+    if d.walking || d.queued > 0 || d.inFlight > 0 {
+        return
+    }
+    delete(j.dirs, dir)
+    if d.begun {
+        j.write(JOURNAL_END, dir)
+    }
+}
+
+func (j *changeJournal) write(op string, dir string) error {
+    line, err := json.Marshal(journalEntry{Op: op, Dir: dir})
+    if err != nil {
+        return err
+    }
+    _, err = j.file.Write(append(line, '\n'))
+    return err
+}
+
+// begin records the intent to change the file at path. Without a journal
+// it does nothing.
+func (j *changeJournal) begin(path string) error {
+    if j == nil {
+        return nil
+    }
+    dir := stateKey(filepath.Dir(path))
+
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    d := j.get(dir)
+    if !d.begun {
+        if err := j.write(JOURNAL_BEGIN, dir); err != nil {
+            return err
+        }
+        if err := j.file.Sync(); err != nil {
+            return err
+        }
+        d.begun = true
+    }
+    d.inFlight++
+    return nil
+}
+
+// end records that the change begun for path is over.
+func (j *changeJournal) end(path string) {
+    if j == nil {
+        return
+    }
+    dir := stateKey(filepath.Dir(path))
+
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    d := j.get(dir)
+    d.inFlight--
+    j.settle(dir, d)
+}
+
+// queued records that the walk queued the file at path.
+func (j *changeJournal) queued(path string) {
+    if j == nil {
+        return
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    d := j.get(stateKey(filepath.Dir(path)))
+    d.walking = true
+    d.queued++
+}
+
+// listed records that the walk has left dir.
+func (j *changeJournal) listed(dir string) {
+    if j == nil {
+        return
+    }
+    dir = stateKey(dir)
+
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if d, ok := j.dirs[dir]; ok {
+        d.walking = false
+        j.settle(dir, d)
+    }
+}
+
+// finished records that a worker is done with the file at path, which was
+// queued by the walk.
+func (j *changeJournal) finished(path string) {
+    if j == nil {
+        return
+    }
+    dir := stateKey(filepath.Dir(path))
+
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if d, ok := j.dirs[dir]; ok && d.queued > 0 {
+        d.queued--
+        j.settle(dir, d)
+    }
+}
+
+// finish closes the journal and removes it once the state it protects has
+// been saved.
+func (j *changeJournal) finish(path string) {
+    if j == nil {
+        return
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    j.file.Close()
+    os.Remove(path)
+}
+
+// interruptedDirs returns the directories begun in the journal at path but
+// never ended.
+func interruptedDirs(path string) ([]string, error) {
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    open := map[string]bool{}
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        var entry journalEntry
+        // A line torn by the crash can't have been followed by a change
+        if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+            continue
+        }
+        switch entry.Op {
+        case JOURNAL_BEGIN:
+            open[entry.Dir] = true
+        case JOURNAL_END:
+            delete(open, entry.Dir)
+        }
+    }
+
+    dirs := make([]string, 0, len(open))
+    for dir := range open {
+        dirs = append(dirs, dir)
+    }
+    sort.Strings(dirs)
+    return dirs, scanner.Err()
+}
+
+// reconcileInterrupted makes the files directly in the interrupted
+// directories lose their recorded evaluations, so this run re-verifies
+// them instead of trusting decisions that may have been half applied.
+func reconcileInterrupted(s *runState, dirs []string) {
+    interrupted := map[string]bool{}
+    for _, dir := range dirs {
+        interrupted[dir] = true
+        noticef("Changes in %s were interrupted by the last run ending early, re-verifying its files\n", displayPath(dir))
+    }
+
+    for key := range s.Files {
+        if i := strings.LastIndex(key, `\`); i >= 0 && interrupted[key[:i]] {
+            delete(s.Files, key)
+        }
+    }
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/sys/windows"
+)
+
+const LOCK_POLL_INTERVAL = time.Second
+
+// rootLock keeps other instances from processing the same root, or one
+// nested with it, at the same time, which would double-count and fight over
+// files. The lock is an open handle to the lock file, deleted when it is
+// closed, so it goes away with the process however that ends. A root's own
+// lock file is held so that nobody else can open it; the lock files of the
+// folders above it are held shared, which other shared holders allow but
+// the root lock of any of those folders doesn't.
+type rootLock struct {
+    root   string // Root of the run the lock is for
+    path   string
+    shared bool
+    handle windows.Handle
+}
+
+// lockDir returns where lock files are kept, shared by all users so
+// scheduled tasks running under different accounts see each other.
+func lockDir() string {
+    base := os.Getenv("ProgramData")
+    if base == "" {
+        base = os.TempDir()
+    }
+    return filepath.Join(base, "ntfs_pancake", "locks")
+}
+
+// lockPath names the lock file of a root after a hash of its normalized path.
+func lockPath(root string) string {
+    sum := sha256.Sum256([]byte(stateKey(root)))
+    return filepath.Join(lockDir(), hex.EncodeToString(sum[:8])+".lock")
+}
+
+// lockOwner returns the process ID recorded in a held lock file, or 0 when
+// it can't be read.
+func lockOwner(path string) uint32 {
+    name, err := windows.UTF16PtrFromString(path)
+    if err != nil {
+        return 0
+    }
+    // The holder only shares reading, and the file is marked for deletion
+    h, err := windows.CreateFile(name, windows.GENERIC_READ, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil, windows.OPEN_EXISTING, 0, 0)
+    if err != nil {
+        return 0
+    }
+    f := os.NewFile(uintptr(h), path)
+    defer f.Close()
+
+    buf := make([]byte, 16)
+    n, _ := f.Read(buf)
+    pid, err := strconv.ParseUint(strings.TrimSpace(string(buf[:n])), 10, 32)
+    if err != nil {
+        return 0
+    }
+    return uint32(pid)
+}
+
+// tryLock opens the lock file of dir, shared for a folder above a root,
+// returning a nil lock and the process holding it, when known, if another
+// instance has it open in a way that conflicts.
+func tryLock(root string, dir string, shared bool) (*rootLock, uint32, error) {
+    lock := &rootLock{root: root, path: lockPath(dir), shared: shared}
+    name, err := windows.UTF16PtrFromString(lock.path)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    access, share := uint32(windows.GENERIC_WRITE|windows.DELETE), uint32(windows.FILE_SHARE_READ)
+    if shared {
+        // Never writing, and not letting anyone but other shared holders in
+        access, share = windows.GENERIC_READ|windows.DELETE, windows.FILE_SHARE_READ|windows.FILE_SHARE_DELETE
+    }
+    h, err := windows.CreateFile(name, access, share, nil, windows.OPEN_ALWAYS, windows.FILE_ATTRIBUTE_NORMAL|windows.FILE_FLAG_DELETE_ON_CLOSE, 0)
+    if err == windows.ERROR_SHARING_VIOLATION {
+        return nil, lockOwner(lock.path), nil
+    }
+    if err == windows.ERROR_ACCESS_DENIED {
+        return nil, 0, fmt.Errorf("no permission to open lock file %s: %v", lock.path, err)
+    }
+    if err != nil {
+        return nil, 0, err
+    }
+    lock.handle = h
+    if shared {
+        return lock, 0, nil
+    }
+
+    // OPEN_ALWAYS may find a lock file left by an older version
+    windows.SetEndOfFile(h)
+    pid := []byte(fmt.Sprintf("%d\n", os.Getpid()))
+    var written uint32
+    if err := windows.WriteFile(h, pid, &written, nil); err != nil {
+        windows.CloseHandle(h)
+        return nil, 0, err
+    }
+    return lock, 0, nil
+}
+
+// lockRequest is a lock file acquireLocks takes for a root.
+type lockRequest struct {
+    root   string
+    dir    string
+    shared bool
+}
+
+// lockRequests lists the lock files the roots need: their own, and shared
+// ones for every folder above them that isn't a root itself.
+func lockRequests(roots []string) []lockRequest {
+    own := map[string]bool{}
+    for _, root := range roots {
+        own[stateKey(root)] = true
+    }
+
+    var requests []lockRequest
+    above := map[string]bool{}
+    for _, root := range roots {
+        requests = append(requests, lockRequest{root: root, dir: root})
+        for dir := filepath.Dir(filepath.Clean(root)); ; dir = filepath.Dir(dir) {
+            if key := stateKey(dir); !own[key] && !above[key] {
+                above[key] = true
+                requests = append(requests, lockRequest{root: root, dir: dir, shared: true})
+            }
+            if filepath.Dir(dir) == dir {
+                break
+            }
+        }
+    }
+    return requests
+}
+
+func holder(owner uint32) string {
+    if owner == 0 {
+        return "another instance"
+    }
+    return fmt.Sprintf("process %d", owner)
+}
+
+// acquireLocks locks every root, waiting up to wait for other instances
+// processing it or a folder nested with it to finish. A lock can't be taken
+// from a running instance, so with steal a root still locked then is
+// processed without its lock. On failure the locks already taken are
+// released.
+func acquireLocks(roots []string, wait time.Duration, steal bool) ([]*rootLock, error) {
+    if err := os.MkdirAll(lockDir(), 0755); err != nil {
+        return nil, err
+    }
+
+    deadline := time.Now().Add(wait)
+    var locks []*rootLock
+    unlocked := map[string]bool{} // Roots let go without their locks
+    for _, request := range lockRequests(roots) {
+        for !unlocked[request.root] {
+            lock, owner, err := tryLock(request.root, request.dir, request.shared)
+            if err != nil {
+                releaseLocks(locks)
+                return nil, fmt.Errorf("locking %s: %v", request.root, err)
+            }
+            if lock != nil {
+                locks = append(locks, lock)
+                break
+            }
+            if !time.Now().Before(deadline) {
+                if steal {
+                    fmt.Printf("Processing %s without its lock, held by %s\n", request.root, holder(owner))
+                    unlocked[request.root] = true
+                    break
+                }
+                releaseLocks(locks)
+                return nil, fmt.Errorf("%s or a folder nested with it is being processed by %s (use -wait or -steal-lock)", request.root, holder(owner))
+            }
+            time.Sleep(LOCK_POLL_INTERVAL)
+        }
+    }
+    return locks, nil
+}
+
+// releaseLocks closes the lock files, which deletes them.
+func releaseLocks(locks []*rootLock) {
+    for _, lock := range locks {
+        if lock.handle != 0 {
+            windows.CloseHandle(lock.handle)
+            lock.handle = 0
+        }
+    }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    DEFAULT_LOG_MAX_SIZE = 10 << 20 // Bytes a -log-file grows to before it is rotated
+    DEFAULT_LOG_KEEP     = 5        // Rotated log files kept next to it
+)
+
+// Levels of the lines in the -log-file, matching the console output they
+// come from.
+const (
+    LOG_NOTICE = "notice"
+    LOG_FILE   = "file"
+    LOG_DEBUG  = "debug"
+    LOG_RUN    = "run" // Start and end of the run
+)
+
+// logEntry is one JSON line of the -log-file.
+type logEntry struct {
+    Time    time.Time `json:"time"`
+    Level   string    `json:"level"`
+    RunName string    `json:"run_name,omitempty"`
+    Message string    `json:"message"`
+}
+
+// rotatingLog appends lines to a file whatever the console verbosity,
+// moving it to path.1 once it would grow past maxSize; path.1 moves to
+// path.2 and so on, and files past keep are removed. When the files can't
+// be moved, say because a viewer holds one, it goes on appending to path.
+type rotatingLog struct {
+    mu       sync.Mutex
+    path     string
+    maxSize  int64
+    keep     int
+    file     *os.File
+    size     int64
+    stuck    bool // Rotating failed, so the file grows past maxSize
+    reported bool // An error of the log was printed already
+    closed   bool
+}
+
+var runLog *rotatingLog
+
+func openRotatingLog(path string, maxSize int64, keep int) (*rotatingLog, error) {
+    l := &rotatingLog{path: path, maxSize: maxSize, keep: keep}
+    if err := l.open(); err != nil {
+        return nil, err
+    }
+    return l, nil
+}
+
+func (l *rotatingLog) open() error {
+    f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    l.file, l.size = f, info.Size()
+    return nil
+}
+
+// rotate shifts the rotated files up by one and starts an empty log. When
+// a file can't be moved it reopens the log as it is and stops rotating.
+func (l *rotatingLog) rotate() error {
+    l.file.Close()
+    l.file = nil
+
+    var err error
+    if l.keep > 0 {
+        if e := os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep)); e != nil && !os.IsNotExist(e) {
+            err = e
+        }
+    }
+    for i := l.keep - 1; i >= 1 && err == nil; i-- {
+        if e := os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1)); e != nil && !os.IsNotExist(e) {
+            err = e
+        }
+    }
+    if err == nil {
+        if l.keep > 0 {
+            err = os.Rename(l.path, l.path+".1")
+        } else {
+            err = os.Remove(l.path)
+        }
+    }
+    if err != nil {
+        l.stuck = true
+    }
+
+    if openErr := l.open(); openErr != nil {
+        return openErr
+    }
+    return err
+}
+
+// report prints the first error of the log. It can't go through noticef,
+// which writes to the log.
+func (l *rotatingLog) report(err error) {
+    if !l.reported {
+        l.reported = true
+        fmt.Printf("Error writing log file %s: %v\n", l.path, err)
+    }
+}
+
+// logf writes a line at level. Without -log-file it does nothing.
+func (l *rotatingLog) logf(level string, format string, args ...any) {
+    if l == nil {
+        return
+    }
+
+    message := strings.TrimSpace(fmt.Sprintf(format, args...))
+    if message == "" {
+        return
+    }
+    line, err := json.Marshal(logEntry{Time: time.Now().UTC(), Level: level, RunName: opts.RunName, Message: message})
+    if err != nil {
+        return
+    }
+    line = append(line, '\n')
+
+    // Keep the console output going whatever happens to the log
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        return
+    }
+    if l.file == nil {
+        if err := l.open(); err != nil {
+            return
+        }
+    }
+    if !l.stuck && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+        if err := l.rotate(); err != nil {
+            l.report(fmt.Errorf("rotating: %v", err))
+            if l.file == nil {
+                return
+            }
+        }
+    }
+    n, err := l.file.Write(line)
+    l.size += int64(n)
+    if err != nil {
+        l.report(err)
+    }
+}
+
+func (l *rotatingLog) close() {
+    if l == nil {
+        return
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.closed = true
+    if l.file != nil {
+        l.file.Close()
+        l.file = nil
+    }
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "time"
+)
+
+const DEFAULT_MAINTAIN_REEVALUATE = "30d"
+
+// defaultStatePath is where maintain keeps the state of a volume unless
+// -state says otherwise, named like the lock files.
+func defaultStatePath(root string) string {
+    base := os.Getenv("ProgramData")
+    if base == "" {
+        base = os.TempDir()
+    }
+    sum := sha256.Sum256([]byte(stateKey(root)))
+    return filepath.Join(base, "ntfs_pancake", "state", hex.EncodeToString(sum[:8])+".json")
+}
+
+// runStage runs this binary with args and decodes its -output json summary.
+// The summary is returned as well when the stage exits with an error, e.g.
+// because it was aborted, as long as it printed one.
+func runStage(args []string) (*jsonSummary, error) {
+    exe, err := os.Executable()
+    if err != nil {
+        return nil, err
+    }
+
+    var out bytes.Buffer
+    cmd := exec.Command(exe, args...)
+    cmd.Stdout = &out
+    cmd.Stderr = os.Stderr
+    runErr := cmd.Run()
+
+    var s jsonSummary
+    if err := json.Unmarshal(out.Bytes(), &s); err != nil {
+        if runErr != nil {
+            return nil, runErr
+        }
+        return nil, fmt.Errorf("reading summary: %v", err)
+    }
+    return &s, runErr
+}
+
+// runMaintain chains the usual scheduled work on a volume: a status
+// snapshot, an incremental compress pass that also fixes drift and checks
+// borderline decisions, and a second snapshot, with one summary at the end.
+// Options after the volume are passed on to the compress pass.
+func runMaintain(args []string) error {
+    fs := flag.NewFlagSet(os.Args[0]+" maintain", flag.ContinueOnError)
+    statePath := fs.String("state", "", "state file of the volume (default: one per volume under %ProgramData%\\ntfs_pancake\\state)")
+    reevaluate := fs.String("reevaluate-after", DEFAULT_MAINTAIN_REEVALUATE, "re-estimate unchanged files evaluated longer ago than this")
+    htmlReport := fs.String("html-report", "", "write the HTML report of the compress pass to this file")
+    runName := fs.String("run-name", "maintain", "job name of the compress pass, for report diff")
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "Usage: %s maintain [options] <volume> [compress options]\n\nOptions:\n", os.Args[0])
+        fs.PrintDefaults()
+    }
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() == 0 {
+        fs.Usage()
+        return fmt.Errorf("no volume given")
+    }
+    root := volumeRoot(fs.Arg(0))
+    extra := fs.Args()[1:]
+
+    if *statePath == "" {
+        *statePath = defaultStatePath(root)
+        if err := os.MkdirAll(filepath.Dir(*statePath), 0755); err != nil {
+            return err
+        }
+    }
+
+    startTime := time.Now()
+    snapshot := []string{MODE_STATUS, "-output", OUTPUT_JSON, "-runs-dir=", root}
+
+    fmt.Printf("Taking a status snapshot of %s...\n", root)
+    before, err := runStage(snapshot)
+    if err != nil {
+        return fmt.Errorf("status snapshot: %v", err)
+    }
+
+    fmt.Printf("Compressing %s...\n", root)
+    pass := []string{MODE_COMPRESS, "-output", OUTPUT_JSON,
+        "-state", *statePath, "-reevaluate-after", *reevaluate, "-fix-drift", "-verify-borderline",
+        "-run-name", *runName}
+    if *htmlReport != "" {
+        pass = append(pass, "-html-report", *htmlReport)
+    }
+    pass = append(append(pass, extra...), root)
+    compressed, passErr := runStage(pass)
+    if compressed == nil {
+        return fmt.Errorf("compress pass: %v", passErr)
+    }
+
+    fmt.Printf("Taking a second status snapshot...\n")
+    after, err := runStage(snapshot)
+    if err != nil {
+        return fmt.Errorf("status snapshot: %v", err)
+    }
+
+    printMaintainSummary(root, time.Since(startTime), before, compressed, after)
+    if *htmlReport != "" {
+        fmt.Printf("HTML report written to %s\n", *htmlReport)
+    }
+    if passErr != nil {
+        return fmt.Errorf("compress pass: %v", passErr)
+    }
+    return nil
+}
+
+// printMaintainSummary prints the stages of a maintain run as one summary.
+func printMaintainSummary(root string, took time.Duration, before *jsonSummary, pass *jsonSummary, after *jsonSummary) {
+    snapshot := func(s statsSnapshot) string {
+        return fmt.Sprintf("%d of %d files stored in less than their size, %d of %d bytes on disk",
+            s.FilesFoundCompressed, s.FilesProcessed, s.StoredExamined, s.SizeExamined)
+    }
+    t := pass.Totals
+
+    fmt.Printf("\nMaintenance of %s finished in %v:\n", root, took.Round(time.Second))
+    fmt.Printf("Before: %s\n", snapshot(before.Totals))
+    fmt.Printf("Scanned: %d files processed, %d unchanged since their last evaluation, %d drifted from their last decision\n",
+        t.FilesProcessed, t.FilesUnchanged, t.FilesDrifted)
+    fmt.Printf("Verified: %d borderline decisions checked with LZNT1, %d changed\n", t.FilesVerified, t.FilesVerifyChanged)
+    fmt.Printf("Changed: %d files compressed, %d decompressed, %d bytes saved\n", t.FilesCompressed, t.FilesDecompressed, t.SpaceSaved)
+    if t.FilesReverted > 0 {
+        fmt.Printf("Decompressed again for saving too little: %d files\n", t.FilesReverted)
+    }
+    fmt.Printf("Errors: %d, skipped unexpectedly: %d\n", len(pass.Errors), len(pass.Skipped))
+    if pass.Aborted {
+        fmt.Printf("The compress pass was aborted after too many errors\n")
+    }
+    fmt.Printf("After: %s\n", snapshot(after.Totals))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "runtime/debug"
+    "strings"
+    "time"
+)
+
+const MAX_MANIFEST_ERRORS = 1000 // Errors listed in a manifest; the rest are only counted
+
+// runManifest is written to the runs directory after every run so each
+// execution can be audited and compared later.
+type runManifest struct {
+    Version      string            `json:"version"`
+    RunName      string            `json:"run_name,omitempty"`
+    Roots        []string          `json:"roots"`
+    Config       map[string]string `json:"config"`
+    StartTime    time.Time         `json:"start_time"`
+    EndTime      time.Time         `json:"end_time"`
+    Totals       statsSnapshot     `json:"totals"`
+    Errors       []fileError       `json:"errors"`
+    ErrorsTotal  int               `json:"errors_total"`
+    Skipped      []fileError       `json:"skipped"`
+    SkippedTotal int               `json:"skipped_total"`
+    Owners       map[string]int64  `json:"owner_savings,omitempty"`
+    Resources    resourceUsage     `json:"resources"`
+}
+
+// fileError is a file whose processing failed, or for the skipped files
+// of the manifest, that was skipped for a reason other than the policy.
+type fileError struct {
+    Path   string     `json:"path"`
+    Result resultCode `json:"result"`
+}
+
+func (r resultCode) isError() bool {
+    return strings.HasPrefix(string(r), "ERROR_")
+}
+
+// isUnexpectedSkip reports whether a file was skipped because of its
+// circumstances rather than the policy, so it will be missing from reports.
+func (r resultCode) isUnexpectedSkip() bool {
+    switch r {
+    case RESULT_SKIPPED_ACTIVE, RESULT_SKIPPED_IN_USE, RESULT_SKIPPED_OFFLINE, RESULT_SKIPPED_QUARANTINED:
+        return true
+    }
+    return false
+}
+
+// buildVersion describes the running binary from its build information.
+func buildVersion() string {
+    info, ok := debug.ReadBuildInfo()
+    if !ok {
+        return "unknown"
+    }
+    version := info.Main.Version
+    for _, setting := range info.Settings {
+        if setting.Key == "vcs.revision" {
+            version += " " + setting.Value
+        }
+    }
+    return version
+}
+
+// defaultRunsDir is where manifests are kept unless -runs-dir says otherwise.
+func defaultRunsDir() string {
+    base := os.Getenv("ProgramData")
+    if base == "" {
+        base = os.TempDir()
+    }
+    return filepath.Join(base, "ntfs_pancake", "runs")
+}
+
+// writeManifest saves the manifest of the finished run in dir and returns
+// its path.
+func writeManifest(dir string, startTime time.Time, endTime time.Time, summary statsSnapshot, usage resourceUsage) (string, error) {
+    m := runManifest{
+        Version:   buildVersion(),
+        RunName:   opts.RunName,
+        Roots:     redactPaths(opts.Roots),
+        Config:    opts.config,
+        StartTime: startTime.UTC(),
+        EndTime:   endTime.UTC(),
+        Totals:    summary,
+        Errors:    []fileError{},
+        Skipped:   []fileError{},
+        Resources: usage,
+    }
+    if collectOwners() {
+        m.Owners = savingsByOwner()
+    }
+
+    stats.mu.Lock()
+    for _, shard := range stats.shards {
+        for _, e := range shard.errors {
+            if len(m.Errors) < MAX_MANIFEST_ERRORS {
+                m.Errors = append(m.Errors, fileError{Path: redactPath(e.Path, true), Result: e.Result})
+            }
+            m.ErrorsTotal++
+        }
+        for _, e := range shard.skipped {
+            if len(m.Skipped) < MAX_MANIFEST_ERRORS {
+                m.Skipped = append(m.Skipped, fileError{Path: redactPath(e.Path, true), Result: e.Result})
+            }
+            m.SkippedTotal++
+        }
+    }
+    stats.mu.Unlock()
+
+    data, err := json.MarshalIndent(m, "", "  ")
+    if err != nil {
+        return "", err
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", err
+    }
+
+    name := startTime.Format("20060102-150405")
+    if opts.RunName != "" {
+        name += "-" + opts.RunName
+    }
+    path := filepath.Join(dir, fmt.Sprintf("%s-%d.json", name, os.Getpid()))
+    return path, os.WriteFile(path, data, 0644)
+}
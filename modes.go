@@ -0,0 +1,143 @@
+package main
+
+import (
+    "fmt"
+    "sync/atomic"
+
+    "golang.org/x/sys/windows"
+)
+
+// Subcommands selecting what the walk does with each file; the bare folder
+// form compresses or decompresses each file as estimated.
+const (
+    MODE_AUTO       = ""
+    MODE_COMPRESS   = "compress"   // Compress files worth it, leave the others alone
+    MODE_DECOMPRESS = "decompress" // Decompress every compressed file, without estimating
+    MODE_ANALYZE    = "analyze"    // Estimate and recommend, never modify
+    MODE_STATUS     = "status"     // Report the current compression state, without reading data
+    MODE_INVENTORY  = "inventory"  // Export that state file by file, as a baseline
+)
+
+var modes = []completionFlag{
+    {name: MODE_COMPRESS, usage: "compress the files worth it, leaving the others alone"},
+    {name: MODE_DECOMPRESS, usage: "decompress every compressed file"},
+    {name: MODE_ANALYZE, usage: "estimate savings without modifying anything"},
+    {name: MODE_STATUS, usage: "report how much is compressed now"},
+    {name: MODE_INVENTORY, usage: "export the current compression state of every file to CSV or JSON"},
+}
+
+func isMode(name string) bool {
+    for _, mode := range modes {
+        if mode.name == name {
+            return true
+        }
+    }
+    return false
+}
+
+// examiningOnly reports whether the run only looks at the current state,
+// as the status and inventory subcommands do.
+func examiningOnly() bool {
+    return opts.mode == MODE_STATUS || opts.mode == MODE_INVENTORY
+}
+
+// leaveAlone reports whether the compress subcommand keeps a file as it is
+// rather than decompressing it.
+func leaveAlone(action string) bool {
+    return opts.mode == MODE_COMPRESS && action == ACTION_DECOMPRESS
+}
+
+// compressedAttrs reports whether attributes show a compressed file. WOF
+// files only show as reparse points, which are checked when a WOF backend
+// is selected.
+func compressedAttrs(attrs uint32) bool {
+    return attrs&windows.FILE_ATTRIBUTE_COMPRESSED != 0 ||
+        (usingWof() && attrs&windows.FILE_ATTRIBUTE_REPARSE_POINT != 0)
+}
+
+// compressionState describes how a file is stored, for the status listing.
+func compressionState(attrs uint32, size int64, stored int64) string {
+    switch {
+    case attrs&windows.FILE_ATTRIBUTE_COMPRESSED != 0:
+        return "compressed"
+    case attrs&windows.FILE_ATTRIBUTE_SPARSE_FILE != 0:
+        return "sparse"
+    case attrs&windows.FILE_ATTRIBUTE_REPARSE_POINT != 0 && stored < size:
+        return "WOF compressed"
+    }
+    return "not compressed"
+}
+
+// recordCompressionStatus lists and counts a file for the status subcommand.
+func recordCompressionStatus(rec fileRecord, attrs uint32, shard *statsShard) fileRecord {
+    stored, err := getCompressedFileSize(rec.Path)
+    if err != nil {
+        noticef("Error reading allocation of %s: %v\n", rec.Path, err)
+        rec.Result = errorResult(err, RESULT_ERROR_READ)
+        return rec
+    }
+    // The inventory is the per-file listing, on the console only with -v
+    if opts.mode == MODE_INVENTORY {
+        verbosef("%s: %s, %d bytes, %d bytes on disk\n", rec.Path, compressionState(attrs, rec.Size, stored), rec.Size, stored)
+        rec.Attributes, rec.Stored, rec.Format = attrs, stored, storedAs(rec.Path, attrs, &shard.io)
+    } else {
+        noticef("%s: %s, %d bytes, %d bytes on disk\n", rec.Path, compressionState(attrs, rec.Size, stored), rec.Size, stored)
+    }
+
+    shard.filesProcessed.Add(1)
+    shard.sizeExamined.Add(rec.Size)
+    shard.storedExamined.Add(stored)
+    if attrs&windows.FILE_ATTRIBUTE_COMPRESSED != 0 {
+        shard.filesAttrCompressed.Add(1)
+    }
+    if stored < rec.Size {
+        shard.filesFoundCompressed.Add(1)
+        shard.sizeFoundCompressed.Add(rec.Size)
+        shard.storedFoundCompressed.Add(stored)
+        rec.Saved = rec.Size - stored
+        recordDirSaving(shard, rec.Path, rec.Saved)
+    }
+    rec.Result = RESULT_EXAMINED
+    return rec
+}
+
+// Folders whose compression attribute the decompress subcommand cleared
+var dirsDecompressed atomic.Int64
+
+// decompressDirectory clears the compression attribute of a folder for
+// -decompress-directories, so files created in it later stay uncompressed.
+// The files already in it are decompressed one by one by the workers.
+func decompressDirectory(path string, attrs uint32) {
+    if attrs&windows.FILE_ATTRIBUTE_COMPRESSED == 0 {
+        return
+    }
+    if !opts.applying() {
+        verbosef("Would clear the compression attribute of folder %s\n", path)
+        dirsDecompressed.Add(1)
+        return
+    }
+    if err := setCompression(path, COMPRESSION_FORMAT_NONE, nil); err != nil {
+        noticef("Error clearing the compression attribute of folder %s: %v\n", path, err)
+        return
+    }
+    verbosef("Cleared the compression attribute of folder %s\n", path)
+    dirsDecompressed.Add(1)
+    audit.record(path, ACTION_DECOMPRESS, BACKEND_NAME_NTFS, STORED_UNCOMPRESSED, 0)
+}
+
+// printDecompressed prints the totals of the decompress subcommand.
+func printDecompressed(s statsSnapshot) {
+    fmt.Printf("Total space re-expanded: %d bytes\n", s.SpaceReexpanded)
+    if opts.DecompressDirectories {
+        fmt.Printf("Total folders no longer compressing new files: %d\n", dirsDecompressed.Load())
+    }
+}
+
+// printCompressionStatus prints the summary of the status subcommand.
+func printCompressionStatus(s statsSnapshot) {
+    fmt.Printf("Total files examined: %d (%d bytes, %d bytes on disk)\n", s.FilesProcessed, s.SizeExamined, s.StoredExamined)
+    fmt.Printf("Files with NTFS compression enabled: %d\n", s.FilesAttrCompressed)
+    fmt.Printf("Files stored in less than their size (compressed, WOF or sparse): %d\n", s.FilesFoundCompressed)
+    fmt.Printf("Their size: %d bytes, stored in %d bytes (%d bytes saved)\n",
+        s.SizeFoundCompressed, s.StoredFoundCompressed, s.SizeFoundCompressed-s.StoredFoundCompressed)
+}
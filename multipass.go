@@ -0,0 +1,71 @@
+package main
+
+import (
+    "math"
+    "sort"
+)
+
+const (
+    QUICK_FULL_SIZE    = 4 << 20 // Files up to this size are estimated fully even in the quick pass
+    QUICK_SAMPLE_COUNT = 4
+    QUICK_SAMPLE_SIZE  = 256 << 10
+)
+
+// With -two-pass a quick pass over the whole tree decides the obvious cases
+// from a few samples per file, so most of the savings accrue early in long
+// runs, and a deep pass then estimates the uncertain remainder in full.
+
+// quickEstimate samples a file and reports whether the ratio is clear of
+// the threshold by more than -quick-margin.
+func quickEstimate(path string, times *ioTimings) (int64, int64, bool, error) {
+    // Held to the -memory-limit budget like other samples; as the smallest
+    // ones, they are taken whatever the budget so the pass never stalls
+    cost := FLATE_WRITER_MEMORY + 2*int64(QUICK_SAMPLE_SIZE)
+    reserveMemory(cost, true)
+    defer releaseMemory(cost)
+
+    originalSize, compressedSize, err := sampleFile(path, QUICK_SAMPLE_COUNT, QUICK_SAMPLE_SIZE, times)
+    if err != nil || originalSize == 0 {
+        return originalSize, compressedSize, true, err
+    }
+    savingRatio := float64(originalSize-compressedSize) / float64(originalSize) * 100
+    return originalSize, compressedSize, math.Abs(savingRatio-thresholdFor(path)) > opts.QuickMargin, nil
+}
+
+// collectDeferred gathers the files the quick pass left for the deep pass,
+// once all its workers are done, in path order so the deep pass doesn't
+// depend on which worker got which file.
+func collectDeferred() []fileTask {
+    stats.mu.Lock()
+    defer stats.mu.Unlock()
+
+    var tasks []fileTask
+    for _, shard := range stats.shards {
+        tasks = append(tasks, shard.deferred...)
+        shard.deferred = nil
+    }
+    sort.Slice(tasks, func(i, j int) bool { return tasks[i].path < tasks[j].path })
+    return tasks
+}
+
+// deepPass processes the files deferred by the quick pass with full
+// estimates. They were counted against -limit when the quick pass queued
+// them, so a walk stopped by the limit still gets all of them; only the
+// breaker stops the deep pass.
+func deepPass() {
+    tasks := collectDeferred()
+    if len(tasks) == 0 || breaker.aborted() {
+        return
+    }
+
+    noticef("Quick pass done, estimating %d uncertain files in full\n", len(tasks))
+    runWorkers(func(paths chan<- fileTask) {
+        for _, task := range tasks {
+            if breaker.aborted() {
+                return
+            }
+            task.quick = false
+            paths <- task
+        }
+    })
+}
@@ -3,14 +3,17 @@ package main
 import (
     "bytes"
     "compress/flate"
+    "flag"
     "fmt"
     "io"
+    "math"
     "os"
     "path/filepath"
-    "runtime"
+    "runtime/debug"
+    "strings"
     "sync"
     "syscall"
-    "unsafe"
+    "time"
 
     "golang.org/x/sys/windows"
 )
@@ -19,68 +22,112 @@ const (
     FSCTL_SET_COMPRESSION          = 0x9C040
     COMPRESSION_FORMAT_DEFAULT     = 1
     COMPRESSION_FORMAT_NONE        = 0
-    COMPRESSION_EFFICIENCY_THRESHOLD = 10 // 10% minimum space saving threshold
-    WORKER_COUNT = 200 // Number of concurrent workers
-)
+    COMPRESSION_EFFICIENCY_THRESHOLD = 10 // Default -threshold, 10% minimum space saving
+    WORKERS_PER_CPU = 4 // Default -workers per logical CPU; workers mostly wait for I/O
+    MAX_DEFAULT_WORKERS = 200
+    ESTIMATE_CHUNK_SIZE = 1 << 20 // Bytes read between early-stop confidence checks
+
+    ACTION_COMPRESS   = "compress"
+    ACTION_DECOMPRESS = "decompress"
 
-var (
-    totalFilesProcessed int
-    totalFilesCompressed int
-    totalFilesDecompressed int
-    totalSpaceSaved int64
-    mu sync.Mutex
+    UNKNOWN_SAVINGS = -1 // Space saved by a file compressed without an estimate, measured afterwards
 )
 
-func enableCompression(path string) error {
-    return setCompression(path, COMPRESSION_FORMAT_DEFAULT)
+// fileTask is a file queued for processing along with the modification
+// time it had when the walker found it. Tasks read from a plan also carry
+// the action decided when the plan was written.
+type fileTask struct {
+    path       string
+    modTime    time.Time
+    size       int64
+    attrs      uint32
+    action     string
+    spaceSaved int64
+    quick      bool // Queued by the quick pass of -two-pass
+    deferred   bool // Left by the quick pass for the deep pass
+}
+
+func enableCompression(path string, backend string, times *ioTimings) error {
+    if backend != BACKEND_NAME_NTFS {
+        return setWofCompression(path, wofAlgorithms[backend], times)
+    }
+    return setCompression(path, COMPRESSION_FORMAT_DEFAULT, times)
+}
+
+func disableCompression(path string, times *ioTimings) error {
+    if usingWof() {
+        return removeWofCompression(path, times)
+    }
+    return setCompression(path, COMPRESSION_FORMAT_NONE, times)
 }
 
-func disableCompression(path string) error {
-    return setCompression(path, COMPRESSION_FORMAT_NONE)
+// revertIfLowBenefit checks the space a just compressed file actually saves
+// and decompresses it again when that is below -min-actual-savings or a
+// cluster, since reading it would cost CPU for nothing. It reports whether
+// the file was decompressed.
+func revertIfLowBenefit(path string, times *ioTimings) (bool, error) {
+    if opts.MinActualSavings <= 0 {
+        return false, nil
+    }
+    size, saved, err := diskSavings(path)
+    if err != nil || size == 0 {
+        return false, nil
+    }
+    if saved >= CLUSTER_SIZE && float64(saved)/float64(size)*100 >= opts.MinActualSavings {
+        return false, nil
+    }
+    verbosef("Compressing %s saved only %d bytes, decompressing it again\n", path, max(saved, 0))
+    return true, disableCompression(path, times)
 }
 
-func setCompression(path string, compressionFormat uint16) error {
-    // Open the file or directory
-    file, err := syscall.CreateFile(
-        syscall.StringToUTF16Ptr(path),
-        syscall.GENERIC_READ | syscall.GENERIC_WRITE,
-        syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE,
-        nil,
-        syscall.OPEN_EXISTING,
-        syscall.FILE_FLAG_BACKUP_SEMANTICS,
-        0,
-    )
+// diskSavings returns the size of a file and the allocation its compression
+// saves.
+func diskSavings(path string) (int64, int64, error) {
+    size, err := getFileSize(path)
     if err != nil {
-        return err
-    }
-    defer syscall.CloseHandle(file)
-
-    // Set the compression state
-    var bytesReturned uint32
-    err = windows.DeviceIoControl(
-        windows.Handle(file),
-        FSCTL_SET_COMPRESSION,
-        (*byte)(unsafe.Pointer(&compressionFormat)),
-        uint32(unsafe.Sizeof(compressionFormat)),
-        nil,
-        0,
-        &bytesReturned,
-        nil,
-    )
+        return 0, 0, err
+    }
+    stored, err := getCompressedFileSize(path)
+    if err != nil {
+        return 0, 0, err
+    }
+    return size, roundToCluster(size) - stored, nil
+}
+
+// measuredSavings returns the space a compressed file saves, for files
+// compressed without an estimate.
+func measuredSavings(path string) int64 {
+    _, saved, err := diskSavings(path)
     if err != nil {
-        return err
+        return 0
     }
+    return max(saved, 0)
+}
 
-    return nil
+func setCompression(path string, compressionFormat uint16, times *ioTimings) error {
+    return withFileHandle(path, syscall.GENERIC_READ|syscall.GENERIC_WRITE, times, func(handle windows.Handle) error {
+        return ioctlIn(handle, FSCTL_SET_COMPRESSION, &compressionFormat)
+    })
 }
 
-func compressFileInMemory(path string) (int64, int64, error) {
-    originalFile, err := os.Open(path)
+// compressFileInMemory returns the original and compressed size of a file,
+// and whether the estimate was cut short once the outcome was clear.
+func compressFileInMemory(path string, times *ioTimings) (int64, int64, bool, error) {
+    waitForQuietDisk(path)
+    readSlots.acquire()
+    defer readSlots.release()
+
+    originalFile, err := openForRead(path, times)
     if err != nil {
-        return 0, 0, err
+        return 0, 0, false, err
     }
     defer originalFile.Close()
 
+    fileInfo, err := originalFile.Stat()
+    if err != nil {
+        return 0, 0, false, err
+    }
+
     var originalSize int64
     var compressedSize int64
 
@@ -90,86 +137,451 @@ func compressFileInMemory(path string) (int64, int64, error) {
     // Create a flate writer with default compression level
     writer, err := flate.NewWriter(&compressedBuffer, flate.DefaultCompression)
     if err != nil {
-        return 0, 0, err
+        return 0, 0, false, err
     }
     defer writer.Close()
 
     // Copy the original file data to the flate writer
     buf := make([]byte, 4096)
+    var chunkBytes int64
+    chunksRead := 0
     for {
         n, err := originalFile.Read(buf)
         if err != nil && err != io.EOF {
-            return 0, 0, err
+            return 0, 0, false, err
         }
         if n == 0 {
             break
         }
         originalSize += int64(n)
         if _, err := writer.Write(buf[:n]); err != nil {
-            return 0, 0, err
+            return 0, 0, false, err
+        }
+
+        // Stop reading once the ratio is clearly on one side of the threshold
+        chunkBytes += int64(n)
+        if opts.EarlyStopChunks > 0 && chunkBytes >= ESTIMATE_CHUNK_SIZE {
+            chunkBytes = 0
+            chunksRead++
+            if chunksRead >= opts.EarlyStopChunks {
+                if estimate, ok := earlyEstimate(writer, &compressedBuffer, originalSize, fileInfo.Size(), thresholdFor(path)); ok {
+                    return fileInfo.Size(), estimate, true, nil
+                }
+            }
         }
     }
 
     // Close the writer to flush any remaining data
     if err := writer.Close(); err != nil {
-        return 0, 0, err
+        return 0, 0, false, err
     }
 
     // Get the compressed size
     compressedSize = int64(compressedBuffer.Len())
 
-    return originalSize, compressedSize, nil
+    return originalSize, compressedSize, false, nil
 }
 
-func processFile(path string) {
-    // Get the system memory info
-    var memStat runtime.MemStats
-    runtime.ReadMemStats(&memStat)
+// earlyEstimate checks whether the data compressed so far is clearly above or
+// below the threshold and, if so, extrapolates the compressed size of the
+// whole file from it.
+func earlyEstimate(writer *flate.Writer, compressedBuffer *bytes.Buffer, bytesRead int64, fileSize int64, threshold float64) (int64, bool) {
+    if err := writer.Flush(); err != nil {
+        return 0, false
+    }
 
-    // Check if the file can fit into the available memory
-    originalSize, err := getFileSize(path)
+    compressedSize := int64(compressedBuffer.Len())
+    savingRatio := float64(bytesRead-compressedSize) / float64(bytesRead) * 100
+    if math.Abs(savingRatio-threshold) < opts.EarlyStopMargin {
+        return 0, false
+    }
+
+    return int64(float64(fileSize) * float64(compressedSize) / float64(bytesRead)), true
+}
+
+// processFile estimates, decides and applies the compression state of one
+// file and returns what happened to it.
+func processFile(task fileTask, shard *statsShard) fileRecord {
+    path := task.path
+    rec := fileRecord{Path: path, Size: task.size}
+
+    // Skip files that an application rewrote after they were queued
+    if skipIfActive(task, shard) {
+        rec.Result = RESULT_SKIPPED_ACTIVE
+        return rec
+    }
+
+    // Subcommands that don't estimate
+    var reexpanded int64
+    switch opts.mode {
+    case MODE_STATUS, MODE_INVENTORY:
+        return recordCompressionStatus(rec, task.attrs, shard)
+    case MODE_DECOMPRESS:
+        if !compressedAttrs(task.attrs) {
+            rec.Result = RESULT_SKIPPED_NOT_COMPRESSED
+            return rec
+        }
+        task.action = ACTION_DECOMPRESS
+        if stored, err := getCompressedFileSize(path); err == nil && stored < task.size {
+            reexpanded = task.size - stored
+        }
+    }
+
+    // Files other clients hold are left for a later run, and so are those
+    // they come back for while being processed
+    guard, err := takeOplock(path)
+    if isOplockConflict(err) {
+        skipInUse(path, shard)
+        rec.Result = RESULT_SKIPPED_IN_USE
+        return rec
+    }
+    shard.oplock = guard
+    defer func() {
+        shard.oplock = nil
+        guard.release()
+    }()
+
+    // Files whose compression state no longer matches the last decision
+    drifted := ""
+    if task.action == "" && !task.deferred {
+        drifted = checkDrift(task)
+    }
+    if drifted != "" {
+        noticef("Drift detected for %s, last decision was %s\n", path, drifted)
+        shard.filesDrifted.Add(1)
+    }
+
+    // Stable files evaluated recently under the same policy are left alone,
+    // unless their drift is to be fixed by re-applying the decision
+    if task.action == "" && recentlyEvaluated(task, shard) {
+        if drifted == "" || !opts.FixDrift || !opts.applying() {
+            debugf("Skipping %s, unchanged since its last evaluation\n", path)
+            shard.filesUnchanged.Add(1)
+            rec.Result = RESULT_SKIPPED_UNCHANGED
+            return rec
+        }
+        task.action = drifted
+    }
+
+    // Remember the attributes so the archive bit can be restored afterwards
+    originalAttrs, err := getFileAttributes(path)
     if err != nil {
-        fmt.Printf("Error getting file size for %s: %v\n", path, err)
-        return
+        noticef("Error reading attributes for %s: %v\n", path, err)
+        rec.Result = errorResult(err, RESULT_ERROR_READ)
+        return rec
     }
-    if originalSize > int64(memStat.Frees) {
-        fmt.Printf("File %s is too large to fit into available memory. Skipping...\n", path)
-        return
+
+    // Files queued from a plan may have been moved to another tier since
+    if isStub(originalAttrs) {
+        verbosef("File %s is an offline stub, skipped\n", path)
+        shard.stubFiles.Add(1)
+        shard.stubBytes.Add(task.size)
+        rec.Result = RESULT_SKIPPED_OFFLINE
+        return rec
     }
 
-    // Compress the file in memory
-    originalSize, compressedSize, err := compressFileInMemory(path)
+    // Extensions always worth it are compressed without reading them
+    if task.action == "" && opts.Extensions.always(path) {
+        shard.filesProcessed.Add(1)
+        if !opts.applying() {
+            verbosef("Recommended compress for %s by its extension\n", path)
+            if opts.WritePlan != "" {
+                shard.plan = append(shard.plan, planEntry{Path: path, Action: ACTION_COMPRESS, Size: task.size, EstimatedSize: task.size, ModTime: task.modTime})
+            }
+            return recordPlanned(rec, ACTION_COMPRESS, 0, shard)
+        }
+        verbosef("Compressing %s by its extension, without an estimate...\n", path)
+        var saved int64
+        rec.Result, saved = applyAction(path, ACTION_COMPRESS, compressionBackend(path, task.size, 0), UNKNOWN_SAVINGS, originalAttrs, shard)
+        if rec.Result == RESULT_REVERTED {
+            rec.Action = ACTION_DECOMPRESS
+        }
+        if rec.Result == RESULT_COMPRESSED {
+            rec.Action = ACTION_COMPRESS
+            rec.Saved = saved
+        }
+        return rec
+    }
+
+    // Actions read from a plan (or recorded for drifted files) are already decided
+    if task.action != "" {
+        if leaveAlone(task.action) {
+            rec.Result = RESULT_SKIPPED_BELOW_THRESHOLD
+            return rec
+        }
+        shard.filesProcessed.Add(1)
+        rec.EstimatedSize = task.size - task.spaceSaved
+        if !opts.applying() {
+            verbosef("Would apply %s for %s, estimated savings: %d bytes\n", task.action, path, task.spaceSaved)
+            if opts.WritePlan != "" {
+                shard.plan = append(shard.plan, planEntry{Path: path, Action: task.action, Size: task.size, EstimatedSize: rec.EstimatedSize, ModTime: task.modTime})
+            }
+            return recordPlanned(rec, task.action, task.spaceSaved, shard)
+        }
+        verbosef("Applying %s for %s...\n", task.action, path)
+        var planRatio float64
+        if task.size > 0 {
+            planRatio = float64(task.spaceSaved) / float64(task.size) * 100
+        }
+        backend := compressionBackend(path, task.size, planRatio)
+        var saved int64
+        rec.Result, saved = applyAction(path, task.action, backend, task.spaceSaved, originalAttrs, shard)
+        if rec.Result == RESULT_REVERTED {
+            rec.Action = ACTION_DECOMPRESS
+        }
+        if rec.Result == actionResult(task.action) {
+            rec.Action = task.action
+            rec.Saved = saved
+            shard.spaceReexpanded.Add(reexpanded)
+        }
+        return rec
+    }
+
+    originalSize, err := getFileSize(path)
     if err != nil {
-        fmt.Printf("Error compressing file in memory %s: %v\n", path, err)
-        return
+        noticef("Error getting file size for %s: %v\n", path, err)
+        rec.Result = errorResult(err, RESULT_ERROR_READ)
+        return rec
+    }
+
+    // Compress the file in memory, or samples of it when it is large
+    var compressedSize int64
+    var stoppedEarly, sampled bool
+    if task.quick && originalSize > QUICK_FULL_SIZE {
+        var decided bool
+        originalSize, compressedSize, decided, err = quickEstimate(path, &shard.io)
+        if err == nil && !decided {
+            task.deferred = true
+            shard.deferred = append(shard.deferred, task)
+            rec.Result = RESULT_DEFERRED
+            return rec
+        }
+        sampled = true
+    } else {
+        originalSize, compressedSize, stoppedEarly, sampled, err = estimateFile(path, originalSize, shard)
+    }
+    if isOplockConflict(err) {
+        skipInUse(path, shard)
+        rec.Result = RESULT_SKIPPED_IN_USE
+        return rec
+    }
+    if err != nil {
+        noticef("Error compressing file in memory %s: %v\n", path, err)
+        rec.Result = errorResult(err, RESULT_ERROR_READ)
+        return rec
+    }
+    if stoppedEarly {
+        shard.earlyStops.Add(1)
+    }
+    if sampled {
+        shard.filesSampled.Add(1)
+    }
+
+    // The estimate is stale if the file was rewritten while it was being read
+    if skipIfActive(task, shard) {
+        rec.Result = RESULT_SKIPPED_ACTIVE
+        return rec
+    }
+
+    var forecast *backendForecast
+    if opts.Forecast {
+        f, err := forecastFile(path, &shard.io)
+        if err != nil {
+            noticef("Error forecasting backends for %s: %v\n", path, err)
+        } else {
+            recordDirForecast(shard, filepath.Dir(path), f)
+            forecast = &f
+        }
     }
 
     // Calculate space savings
+    rec.Size = originalSize
     spaceSaved := originalSize - compressedSize
     savingRatio := float64(spaceSaved) / float64(originalSize) * 100
 
-    mu.Lock()
-    totalFilesProcessed++
-    // Check if compression is worth it
-    if savingRatio < COMPRESSION_EFFICIENCY_THRESHOLD {
-        fmt.Printf("Compression not worth it for %s, saving ratio: %.2f%%. Disabling compression...\n", path, savingRatio)
-        err = disableCompression(path)
-        if err != nil {
-            fmt.Printf("Error disabling compression for %s: %v\n", path, err)
+    // Decisions close to the threshold are the ones the estimate may get
+    // wrong; they can be checked against NTFS's own compressor
+    threshold := thresholdFor(path)
+    debugf("Estimate for %s: %d bytes to %d bytes (sampled: %v, stopped early: %v), %.2f%% saving against a threshold of %g%%\n",
+        path, originalSize, compressedSize, sampled, stoppedEarly, savingRatio, threshold)
+    if margin := savingRatio - threshold; math.Abs(margin) <= opts.BorderlineMargin {
+        shard.filesBorderline.Add(1)
+        if opts.VerifyBorderline {
+            if forecast == nil {
+                if f, err := forecastFile(path, &shard.io); err == nil {
+                    forecast = &f
+                }
+            }
+            if forecast != nil && forecast.size > 0 {
+                verified := allocationSavings(*forecast, BACKEND_LZNT1)
+                verbosef("Borderline estimate for %s: %.2f%% (%+.2f points), LZNT1 gives %.2f%%\n", path, savingRatio, margin, verified)
+                shard.filesVerified.Add(1)
+                if (verified < threshold) != (savingRatio < threshold) {
+                    shard.filesVerifyChanged.Add(1)
+                }
+                savingRatio = verified
+                spaceSaved = int64(verified / 100 * float64(originalSize))
+            }
         } else {
-            totalFilesDecompressed++
+            verbosef("Borderline estimate for %s: %.2f%% (%+.2f points from the threshold)\n", path, savingRatio, margin)
         }
+    }
+
+    rec.EstimatedSize = originalSize - spaceSaved
+    shard.filesProcessed.Add(1)
+    // Check if compression is worth it
+    action := ACTION_COMPRESS
+    if savingRatio < threshold {
+        action = ACTION_DECOMPRESS
+    }
+    // Reading a compressed file costs CPU every time, which has to buy enough space
+    backend := compressionBackend(path, originalSize, savingRatio)
+    cost := accessCost(backend, originalSize)
+    if action == ACTION_COMPRESS && tooCostly(cost, spaceSaved) {
+        verbosef("Compressing %s with %s would cost %v of CPU per read to save %d bytes, above -max-access-cost\n", path, backend, cost, spaceSaved)
+        shard.filesTooCostly.Add(1)
+        action = ACTION_DECOMPRESS
+    }
+    recordExtension(shard, path, originalSize, spaceSaved, action == ACTION_COMPRESS)
+    if leaveAlone(action) {
+        rec.Result = RESULT_SKIPPED_BELOW_THRESHOLD
+        return rec
+    }
+
+    // When writing a plan or only recommending, the decision is recorded
+    // instead of applied
+    if !opts.applying() {
+        verbosef("Recommended %s for %s, saving ratio: %.2f%%, estimated savings: %d bytes, CPU per read once compressed: %v\n", action, path, savingRatio, max(spaceSaved, 0), cost)
+        rec = recordPlanned(rec, action, spaceSaved, shard)
+        if opts.WritePlan != "" {
+            shard.plan = append(shard.plan, planEntry{
+                Path:          path,
+                Action:        action,
+                Size:          originalSize,
+                EstimatedSize: compressedSize,
+                ModTime:       task.modTime,
+            })
+        }
+        return rec
+    }
+
+    if action == ACTION_DECOMPRESS {
+        verbosef("Compression not worth it for %s, saving ratio: %.2f%%. Disabling compression...\n", path, savingRatio)
     } else {
-        fmt.Printf("Compression beneficial for %s, saving ratio: %.2f%%. Enabling compression...\n", path, savingRatio)
-        err = enableCompression(path)
-        if err != nil {
-            fmt.Printf("Error enabling compression for %s: %v\n", path, err)
+        verbosef("Compression beneficial for %s, saving ratio: %.2f%%, CPU per read: %v. Enabling compression...\n", path, savingRatio, cost)
+    }
+    var saved int64
+    rec.Result, saved = applyAction(path, action, backend, spaceSaved, originalAttrs, shard)
+    if rec.Result == RESULT_REVERTED {
+        rec.Action = ACTION_DECOMPRESS
+    }
+    if rec.Result == actionResult(action) {
+        rec.Action = action
+        rec.Saved = saved
+    }
+    return rec
+}
+
+// recordPlanned counts an action that is recommended rather than applied.
+func recordPlanned(rec fileRecord, action string, spaceSaved int64, shard *statsShard) fileRecord {
+    if action == ACTION_COMPRESS {
+        shard.filesPlannedCompress.Add(1)
+        shard.spaceProjected.Add(spaceSaved)
+        recordDirSaving(shard, rec.Path, spaceSaved)
+        recordOwnerSaving(shard, rec.Path, spaceSaved)
+        rec.Saved = spaceSaved
+    } else {
+        shard.filesPlannedDecompress.Add(1)
+    }
+    rec.Action = action
+    rec.Result = plannedResult(action)
+    return rec
+}
+
+// applyAction sets the compression state of a file, compressing with
+// backend, and updates the archive attribute and statistics accordingly.
+// It returns the result code of the action, or of why it failed, and the
+// space saved. UNKNOWN_SAVINGS is measured once the file is compressed.
+func applyAction(path string, action string, backend string, spaceSaved int64, originalAttrs uint32, shard *statsShard) (resultCode, int64) {
+    result := actionResult(action)
+    if shard.oplock.broken() {
+        skipInUse(path, shard)
+        return RESULT_SKIPPED_IN_USE, 0
+    }
+
+    // The intent has to be on disk before the change
+    if err := journal.begin(path); err != nil {
+        noticef("Error journaling change for %s: %v\n", path, err)
+        return RESULT_ERROR_INTERNAL, 0
+    }
+    defer journal.end(path)
+
+    // Only looked up for the audit log, which the undo subcommand reads
+    previous := ""
+    if audit != nil {
+        previous = storedAs(path, originalAttrs, &shard.io)
+    }
+
+    if action == ACTION_DECOMPRESS {
+        if err := disableCompression(path, &shard.io); isOplockConflict(err) {
+            skipInUse(path, shard)
+            return RESULT_SKIPPED_IN_USE, 0
+        } else if err != nil {
+            noticef("Error disabling compression for %s: %v\n", path, err)
+            return errorResult(err, RESULT_ERROR_COMPRESSION), 0
+        }
+        shard.filesDecompressed.Add(1)
+        audit.record(path, action, previous, STORED_UNCOMPRESSED, 0)
+        spaceSaved = 0
+    } else {
+        if err := enableCompression(path, backend, &shard.io); isOplockConflict(err) {
+            skipInUse(path, shard)
+            return RESULT_SKIPPED_IN_USE, 0
+        } else if err != nil {
+            noticef("Error enabling compression for %s: %v\n", path, err)
+            return errorResult(err, RESULT_ERROR_COMPRESSION), 0
+        }
+        if reverted, err := revertIfLowBenefit(path, &shard.io); err != nil {
+            noticef("Error decompressing %s again: %v\n", path, err)
+            return errorResult(err, RESULT_ERROR_COMPRESSION), 0
+        } else if reverted {
+            shard.filesReverted.Add(1)
+            audit.record(path, ACTION_DECOMPRESS, previous, STORED_UNCOMPRESSED, 0)
+            result = RESULT_REVERTED
+            spaceSaved = 0
         } else {
-            totalFilesCompressed++
-            totalSpaceSaved += spaceSaved
+            if spaceSaved == UNKNOWN_SAVINGS {
+                spaceSaved = measuredSavings(path)
+            }
+            if opts.Backend == BACKEND_NAME_AUTO {
+                shard.wofChosen[wofAlgorithms[backend]].Add(1)
+            }
+            shard.filesCompressed.Add(1)
+            shard.spaceSaved.Add(spaceSaved)
+            recordDirSaving(shard, path, spaceSaved)
+            recordOwnerSaving(shard, path, spaceSaved)
+            audit.record(path, action, previous, backend, spaceSaved)
         }
     }
-    mu.Unlock()
+
+    if err := applyArchiveBitPolicy(path, originalAttrs); err != nil {
+        noticef("Error updating archive attribute for %s: %v\n", path, err)
+    }
+    return result, spaceSaved
+}
+
+// skipIfActive reports whether the file was modified since it was queued,
+// recording it as active and skipped if so.
+func skipIfActive(task fileTask, shard *statsShard) bool {
+    fileInfo, err := os.Stat(task.path)
+    if err != nil || fileInfo.ModTime().Equal(task.modTime) {
+        // Errors are reported by the regular processing path
+        return false
+    }
+
+    verbosef("File %s was modified during the run, active — skipped\n", task.path)
+    shard.filesActiveSkipped.Add(1)
+    return true
 }
 
 func getFileSize(path string) (int64, error) {
@@ -180,62 +592,628 @@ func getFileSize(path string) (int64, error) {
 	return fileInfo.Size(), nil
 }
 
-func worker(paths <-chan string, wg *sync.WaitGroup) {
+// safeProcessFile runs processFile, turning a panic into an error for that
+// file so one pathological file can't take down its worker or the run.
+func safeProcessFile(task fileTask, shard *statsShard) (rec fileRecord) {
+    defer func() {
+        if r := recover(); r != nil {
+            noticef("Internal error processing %s: %v\n%s", task.path, r, debug.Stack())
+            shard.filesPanicked.Add(1)
+            rec = fileRecord{Path: task.path, Size: task.size, Result: RESULT_ERROR_INTERNAL}
+        }
+    }()
+    return processFile(task, shard)
+}
+
+func worker(index int, paths <-chan fileTask, wg *sync.WaitGroup) {
     defer wg.Done()
-    for path := range paths {
-        processFile(path)
+    shard := stats.newShard()
+    for {
+        // Workers not let in by the ramp-up yet don't take files
+        ramp.wait(index)
+        task, ok := <-paths
+        if !ok {
+            return
+        }
+        gate.wait()
+
+        if resumed(task) {
+            shard.filesResumed.Add(1)
+            directories.finished(task.path, 0)
+            journal.finished(task.path)
+            shard.countFinished(task)
+            continue
+        }
+
+        // Files still queued when the breaker tripped are drained unprocessed
+        if breaker.aborted() {
+            directories.finished(task.path, 0)
+            journal.finished(task.path)
+            shard.countFinished(task)
+            continue
+        }
+        if quarantined(task) {
+            shard.filesQuarantined.Add(1)
+            shard.quarantined = append(shard.quarantined, task.path)
+            shard.skipped = append(shard.skipped, fileError{Path: task.path, Result: RESULT_SKIPPED_QUARANTINED})
+            directories.finished(task.path, 0)
+            journal.finished(task.path)
+            shard.countFinished(task)
+            continue
+        }
+
+        shard.startFile(task.path)
+        started := time.Now()
+        rec := safeProcessFile(task, shard)
+        ramp.record(rec.Result, time.Since(started))
+        shard.finishFile()
+        if rec.Result == RESULT_DEFERRED {
+            continue
+        }
+        shard.countFinished(task)
+        checkpoint.done(task.path)
+        directories.finished(task.path, rec.Saved)
+        journal.finished(task.path)
+        if rec.Result.isError() {
+            shard.errors = append(shard.errors, fileError{Path: rec.Path, Result: rec.Result})
+        } else if rec.Result.isUnexpectedSkip() {
+            shard.skipped = append(shard.skipped, fileError{Path: rec.Path, Result: rec.Result})
+        }
+        breaker.record(rec.Result)
+        if state != nil && opts.QuarantineAfter > 0 {
+            recordOutcome(shard, task, rec.Result)
+        }
+        if state != nil && rec.Action != "" && opts.applying() {
+            recordState(shard, task, rec.Action)
+        }
+        recordReadAdvice(shard, rec)
+        sink.file(rec)
+        if collectFileRecords() {
+            shard.files = append(shard.files, rec)
+        }
     }
 }
 
-func scanAndCompressFolder(root string) {
-    paths := make(chan string)
+// runWorkers starts the worker pool, lets feed queue tasks and waits until
+// every queued task has been processed.
+func runWorkers(feed func(paths chan<- fileTask)) {
+    paths := make(chan fileTask)
     var wg sync.WaitGroup
 
-    // Start workers
-    for i := 0; i < WORKER_COUNT; i++ {
+    // Start workers, only ramping up at the start of the run
+    if opts.RampUp > 0 {
+        rampOnce.Do(func() { ramp.start(opts.Workers, opts.RampUp) })
+    }
+    for i := 0; i < opts.Workers; i++ {
         wg.Add(1)
-        go worker(paths, &wg)
+        go worker(i, paths, &wg)
     }
 
-    // Walk through the folder and send file paths to the channel
     go func() {
-        defer close(paths)
-        err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-            if err != nil {
-                fmt.Printf("Error accessing path %s: %v\n", path, err)
-                return err
+        feed(paths)
+        progress.listed.Store(true)
+        close(paths)
+        // Workers still held back have to see the end of the queue
+        ramp.finish()
+    }()
+
+    // Wait for all workers to finish
+    wg.Wait()
+}
+
+func main() {
+    removeReplacedExecutable()
+    defer keepConsoleOpen()
+
+    // Subcommands
+    if len(os.Args) > 1 {
+        var run func(args []string) error
+        switch os.Args[1] {
+        case "self-update":
+            run = selfUpdate
+        case "completion":
+            run = printCompletion
+        case "report":
+            run = runReport
+        case "maintain":
+            run = runMaintain
+        case "undo":
+            run = runUndo
+        }
+        if run != nil {
+            if err := run(os.Args[2:]); err != nil {
+                if err != flag.ErrHelp {
+                    fmt.Printf("Error: %v\n", err)
+                }
+                exit(1)
             }
+            return
+        }
+    }
+
+    args := os.Args[1:]
+    if len(args) > 0 && isMode(args[0]) {
+        opts.mode = args[0]
+        args = args[1:]
+    }
+    if err := parseOptions(args); err != nil {
+        if err != flag.ErrHelp {
+            fmt.Printf("Error: %v\n", err)
+        }
+        exit(2)
+    }
+    // Keep the standard output for the JSON summary alone; with a JSON
+    // summary the text one goes to the standard error wherever the JSON goes
+    if opts.JSONSummary != "" || opts.Output == OUTPUT_JSON {
+        jsonStdout = os.Stdout
+        os.Stdout = os.Stderr
+    }
+    if opts.LogFile != "" {
+        l, err := openRotatingLog(opts.LogFile, int64(opts.LogMaxSize), opts.LogKeep)
+        if err != nil {
+            fmt.Printf("Error opening log file: %v\n", err)
+            exit(1)
+        }
+        runLog = l
+        runLog.logf(LOG_RUN, "Started: %s", strings.Join(os.Args, " "))
+        defer func() {
+            runLog.logf(LOG_RUN, "Finished")
+            runLog.close()
+        }()
+    }
+
+    readSlots = newLimiter(opts.ReadConcurrency)
+    fsctlSlots = newLimiter(opts.FsctlConcurrency)
 
-            // Only process normal files
-            if !info.IsDir() && info.Mode().IsRegular() {
-                paths <- path
+    var planKey *signingKey
+    if opts.PlanKey != "" {
+        key, err := readSigningKey(opts.PlanKey)
+        if err != nil {
+            fmt.Printf("Error reading plan key: %v\n", err)
+            exit(1)
+        }
+        if opts.WritePlan != "" && key.private == nil {
+            fmt.Printf("Error: -write-plan signs with the private key, %s is the public one\n", opts.PlanKey)
+            exit(1)
+        }
+        planKey = key
+    }
+
+    var plannedRun *plan
+    if opts.ApplyPlan != "" {
+        p, err := readPlan(opts.ApplyPlan, planKey)
+        if err != nil {
+            fmt.Printf("Error reading plan: %v\n", err)
+            exit(1)
+        }
+        plannedRun = p
+        if len(opts.Roots) == 0 {
+            opts.Roots = p.Roots
+        }
+        if err := resolvePlanRoots(p, opts.Roots); err != nil {
+            fmt.Printf("Error applying plan %s: %v\n", opts.ApplyPlan, err)
+            exit(1)
+        }
+    }
+
+    // Refuse unusable volumes once instead of failing on every file
+    var usableRoots []string
+    for _, root := range opts.Roots {
+        if err := checkVolume(root, opts.applying() && !opts.Safe); err != nil {
+            noticef("Skipping %s: %v\n", root, err)
+            recordProblem(PROBLEM_VOLUME, root, err.Error())
+            continue
+        }
+        usableRoots = append(usableRoots, root)
+    }
+    opts.Files = usableFiles(opts.Files, opts.applying() && !opts.Safe)
+    if len(usableRoots) == 0 && len(opts.Files) == 0 {
+        exit(1)
+    }
+    // Relative plan entries refer to their folder by position
+    if plannedRun != nil && plannedRun.RelativePaths && len(usableRoots) != len(opts.Roots) {
+        exit(1)
+    }
+    opts.Roots = usableRoots
+
+    // Only one instance may work on a folder at a time
+    locks, err := acquireLocks(coveredRoots(opts.Roots, opts.Files), opts.Wait, opts.StealLock)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        exit(1)
+    }
+    defer releaseLocks(locks)
+
+    if opts.State != "" {
+        s, err := loadState(opts.State)
+        if err != nil {
+            fmt.Printf("Error loading state: %v\n", err)
+            releaseLocks(locks)
+            exit(1)
+        }
+        state = s
+
+        // Directories a crashed run was changing are verified again
+        dirs, err := interruptedDirs(journalPath(opts.State))
+        if err != nil {
+            fmt.Printf("Error reading change journal: %v\n", err)
+            releaseLocks(locks)
+            exit(1)
+        }
+        if len(dirs) > 0 {
+            reconcileInterrupted(state, dirs)
+            // Saved right away so the journal can start over
+            if err := saveState(opts.State, state); err != nil {
+                fmt.Printf("Error saving state: %v\n", err)
+                releaseLocks(locks)
+                exit(1)
             }
+        }
+        os.Remove(journalPath(opts.State))
+    }
+
+    if opts.Safe {
+        checkSafeMode()
+    }
+    checkContainer()
+    recordConfig()
+    if opts.Chaos > 0 {
+        noticef("Chaos mode: failing %g%% of opens and FSCTLs on purpose\n", opts.Chaos*100)
+    }
+    if opts.CompactOS && opts.applying() {
+        if err := confirmCompactOS(); err != nil {
+            fmt.Printf("Error: %v\n", err)
+            releaseLocks(locks)
+            exit(1)
+        }
+    }
+    if opts.DryRun || opts.mode == MODE_ANALYZE {
+        noticef("Dry run: nothing will be modified\n")
+    }
+    if state != nil && opts.applying() {
+        j, err := openChangeJournal(journalPath(opts.State))
+        if err != nil {
+            fmt.Printf("Error opening change journal: %v\n", err)
+            releaseLocks(locks)
+            exit(1)
+        }
+        journal = j
+    }
+
+    done := make(chan struct{})
+    if opts.StatusInterval > 0 {
+        go reportStatus(opts.StatusInterval, done)
+    }
+
+    startTime := time.Now()
+    if opts.PublishStatus {
+        if err := publishRunStarted(startTime); err != nil {
+            noticef("Error publishing run status: %v\n", err)
+        }
+    }
 
-            return nil
-        })
+    // A failing pre-run hook vetoes the run
+    if opts.PreRunHook != "" {
+        if err := runHook(opts.PreRunHook, newHookContext(HOOK_PRE_RUN, startTime)); err != nil {
+            fmt.Printf("Error: pre-run hook failed: %v\n", err)
+            releaseLocks(locks)
+            exit(1)
+        }
+    }
+    if opts.DirectoryHook != "" && plannedRun == nil {
+        directories = startDirectoryHooks(opts.DirectoryHook, startTime)
+    }
 
+    // Keep what has been changed so far on disk in case the run is killed
+    if opts.AuditLog != "" {
+        a, err := openAuditLog(opts.AuditLog)
         if err != nil {
-            fmt.Printf("Error scanning folder %s: %v\n", root, err)
+            fmt.Printf("Error opening audit log: %v\n", err)
+            releaseLocks(locks)
+            exit(1)
         }
-    }()
+        audit = a
+    }
+    if opts.LogSink != "" {
+        s, err := openLogSink(opts.LogSink)
+        if err != nil {
+            fmt.Printf("Error opening log sink: %v\n", err)
+            releaseLocks(locks)
+            exit(1)
+        }
+        sink = s
+    }
+    if opts.MaxDiskBusy > 0 {
+        startDiskMonitors(append(append([]string{}, opts.Roots...), opts.Files...), done)
+    }
+    if opts.StallTimeout > 0 {
+        go watchStalls(opts.StallTimeout, done)
+    }
+    if opts.Checkpoint != "" {
+        c, err := openCheckpoint(opts.Checkpoint, opts.Resume, append(append([]string{}, opts.Roots...), opts.Files...), startTime)
+        if err != nil {
+            fmt.Printf("Error opening checkpoint: %v\n", err)
+            releaseLocks(locks)
+            exit(1)
+        }
+        checkpoint = c
+    }
+    if opts.SummaryFile != "" || audit != nil || checkpoint != nil {
+        go flushProgress(opts.FlushInterval, startTime, done)
+    }
 
-    // Wait for all workers to finish
-    wg.Wait()
-}
+    // Plain output leaves the console as it is, in line mode
+    var restoreConsole func()
+    if !opts.Plain {
+        restoreConsole = startHotkeys()
+    }
+    var stopProgress func()
+    if opts.Progress && opts.Verbosity > VERBOSITY_QUIET {
+        stopProgress = startProgress(startTime)
+    }
+    if restoreConsole == nil && opts.MaxErrorRate > 0 && opts.OnErrorStorm == ERROR_STORM_PAUSE {
+        // Nobody could resume the run
+        noticef("No console to resume from, error storms will abort the run\n")
+        opts.OnErrorStorm = ERROR_STORM_ABORT
+    }
+    if plannedRun != nil {
+        applyPlan(plannedRun, opts.Roots)
+    } else {
+        scanAndCompressFolders(opts.Roots)
+        if opts.TwoPass {
+            deepPass()
+        }
+    }
+    directories.stop()
+    close(done)
+    if stopProgress != nil {
+        stopProgress()
+    }
+    if restoreConsole != nil {
+        restoreConsole()
+    }
 
-func main() {
-    if len(os.Args) != 2 {
-        fmt.Printf("Usage: %s <folder path>\n", os.Args[0])
+    if state != nil {
+        mergeState(state)
+        recordKnownRoots(state, coveredRoots(opts.Roots, opts.Files), startTime)
+        if opts.applying() {
+            recordRunStart(state, opts.Roots, startTime)
+            recordDirHistory(state, mergedDirStats(opts.Roots), startTime)
+        }
+        if err := saveState(opts.State, state); err != nil {
+            fmt.Printf("Error saving state: %v\n", err)
+        } else {
+            journal.finish(journalPath(opts.State))
+        }
+    }
+
+    audit.close()
+    // A run stopped early, by -limit or after too many errors, can still be
+    // resumed, once the cause is dealt with
+    if walkStopped() {
+        totals := stats.snapshot()
+        checkpoint.sync(&totals)
+    } else {
+        checkpoint.finish(opts.Checkpoint)
+    }
+    if opts.SummaryFile != "" {
+        if err := writeSummaryFile(opts.SummaryFile, RUN_STATE_COMPLETED, startTime); err != nil {
+            noticef("Error writing summary file: %v\n", err)
+        }
+    }
+
+    summary := stats.snapshot()
+    endTime := time.Now()
+    usage := measureResources()
+    if opts.PublishStatus {
+        if err := publishRunCompleted(endTime, summary); err != nil {
+            noticef("Error publishing run status: %v\n", err)
+        }
+    }
+    if opts.RunsDir != "" {
+        if path, err := writeManifest(opts.RunsDir, startTime, endTime, summary, usage); err != nil {
+            noticef("Error writing run manifest: %v\n", err)
+        } else {
+            noticef("Run manifest written to %s\n", path)
+        }
+    }
+
+    sink.summary(summary, usage, startTime, endTime)
+    sink.close()
+    runLog.logf(LOG_RUN, "Summary: %d processed, %d compressed, %d decompressed, %d bytes saved, took %v",
+        summary.FilesProcessed, summary.FilesCompressed, summary.FilesDecompressed, summary.SpaceSaved, endTime.Sub(startTime).Round(time.Second))
+
+    if opts.PostRunHook != "" {
+        hc := newHookContext(HOOK_POST_RUN, startTime)
+        hc.EndTime = &endTime
+        hc.Totals = &summary
+        hc.Aborted = breaker.aborted()
+        if err := runHook(opts.PostRunHook, hc); err != nil {
+            noticef("Error running post-run hook: %v\n", err)
+        }
+    }
+
+    if opts.JSONSummary != "" {
+        if err := writeJSONSummary(opts.JSONSummary, summary, usage, startTime, endTime); err != nil {
+            fmt.Printf("Error writing JSON summary %s: %v\n", opts.JSONSummary, err)
+        }
+    }
+
+    if opts.Inventory != "" {
+        if err := writeInventory(opts.Inventory, collectRecords()); err != nil {
+            fmt.Printf("Error writing inventory %s: %v\n", opts.Inventory, err)
+            releaseLocks(locks)
+            exit(1)
+        }
+        noticef("Inventory of %d files written to %s\n", stats.snapshot().FilesProcessed, opts.Inventory)
+    }
+
+    if examiningOnly() && opts.Output != OUTPUT_JSON {
+        fmt.Printf("\nCompression status:\n")
+        printCompressionStatus(summary)
+        if len(opts.Roots) > 1 {
+            printRootSummaries(opts.Roots)
+        }
+        printTopDirectories(opts.Roots, opts.TopDirs)
+        if opts.Strict && reportStrict() {
+            releaseLocks(locks)
+            exit(1)
+        }
         return
     }
 
-    folderPath := os.Args[1]
-    scanAndCompressFolder(folderPath)
+    if opts.Output == OUTPUT_JSON {
+        if err := printJSONSummary(jsonStdout, summary, usage, startTime, endTime); err != nil {
+            fmt.Fprintf(os.Stderr, "Error writing JSON summary: %v\n", err)
+        }
+    }
+    printSummary(summary, usage)
+
+    if opts.Treemap != "" {
+        if err := writeTreemap(opts.Treemap, opts.Roots, collectRecords()); err != nil {
+            noticef("Error writing treemap %s: %v\n", opts.Treemap, err)
+        }
+    }
+
+    if opts.CSV != "" {
+        if err := writeRecordsCSV(opts.CSV, collectRecords()); err != nil {
+            noticef("Error writing CSV %s: %v\n", opts.CSV, err)
+        }
+    }
+
+    if opts.FsrmReport != "" {
+        reports, err := writeFsrmReports(opts.FsrmReport, opts.Roots, time.Now())
+        for _, report := range reports {
+            noticef("FSRM report written to %s\n", report)
+        }
+        if err != nil {
+            noticef("Error writing FSRM reports to %s: %v\n", opts.FsrmReport, err)
+        }
+    }
+
+    if opts.HTMLReport != "" {
+        if err := writeHTMLReport(opts.HTMLReport, summary, startTime, endTime, opts.TopDirs); err != nil {
+            noticef("Error writing HTML report %s: %v\n", opts.HTMLReport, err)
+        } else {
+            noticef("HTML report written to %s\n", opts.HTMLReport)
+        }
+    }
+
+    if opts.WritePlan != "" {
+        p := collectPlan(opts.Roots)
+        if err := writePlan(opts.WritePlan, p, planKey); err != nil {
+            fmt.Printf("Error writing plan %s: %v\n", opts.WritePlan, err)
+            releaseLocks(locks)
+            exit(1)
+        }
+        noticef("Plan with %d entries written to %s\n", len(p.Entries), opts.WritePlan)
+    }
+
+    if breaker.aborted() {
+        if opts.Output != OUTPUT_JSON {
+            fmt.Printf("Run aborted after too many errors\n")
+        }
+        releaseLocks(locks)
+        exit(1)
+    }
+    if opts.Strict && reportStrict() {
+        releaseLocks(locks)
+        exit(1)
+    }
+}
 
-    // Print summary
-    fmt.Printf("\nSummary:\n")
-    fmt.Printf("Total files processed: %d\n", totalFilesProcessed)
-    fmt.Printf("Total files compressed: %d\n", totalFilesCompressed)
-    fmt.Printf("Total files decompressed: %d\n", totalFilesDecompressed)
-    fmt.Printf("Total space saved: %d bytes\n", totalSpaceSaved)
+// printSummary prints the totals of the run and the reports asked for.
+func printSummary(summary statsSnapshot, usage resourceUsage) {
+    if opts.RunName != "" {
+        fmt.Printf("\nSummary for run %s:\n", opts.RunName)
+    } else {
+        fmt.Printf("\nSummary:\n")
+    }
+    fmt.Printf("Total files processed: %d\n", summary.FilesProcessed)
+    fmt.Printf("Total files compressed: %d\n", summary.FilesCompressed)
+    fmt.Printf("Total files decompressed: %d\n", summary.FilesDecompressed)
+    fmt.Printf("Total files skipped as active: %d\n", summary.FilesActiveSkipped)
+    if len(opts.ReevaluateAfter) > 0 {
+        fmt.Printf("Total files unchanged since last evaluation: %d\n", summary.FilesUnchanged)
+    }
+    if state != nil {
+        fmt.Printf("Total files drifted from last decision: %d\n", summary.FilesDrifted)
+    }
+    if opts.EarlyStopChunks > 0 {
+        fmt.Printf("Total estimates stopped early: %d\n", summary.EarlyStops)
+    }
+    fmt.Printf("Total large files estimated from samples: %d\n", summary.FilesSampled)
+    fmt.Printf("Total borderline decisions (within %g points of the threshold): %d\n", opts.BorderlineMargin, summary.FilesBorderline)
+    if opts.VerifyBorderline {
+        fmt.Printf("Total borderline decisions checked with LZNT1: %d, of which changed: %d\n", summary.FilesVerified, summary.FilesVerifyChanged)
+    }
+    if resumedTotals != nil || summary.FilesResumed > 0 {
+        fmt.Printf("Total files done by the interrupted run and skipped: %d\n", summary.FilesResumed)
+        if resumedTotals != nil {
+            fmt.Printf("Space saved by the interrupted run: %d bytes\n", resumedTotals.SpaceSaved)
+        }
+    }
+    if opts.MaxAccessCost > 0 {
+        fmt.Printf("Total files not compressed as too costly to read (over %g ms of CPU per MiB saved): %d\n", opts.MaxAccessCost, summary.FilesTooCostly)
+    }
+    if opts.MinActualSavings > 0 {
+        fmt.Printf("Total files decompressed again for saving less than %g%% or a cluster: %d\n", opts.MinActualSavings, summary.FilesReverted)
+    }
+    if summary.FilesQuarantined > 0 {
+        fmt.Printf("Total files skipped as quarantined: %d\n", summary.FilesQuarantined)
+    }
+    if summary.FilesPanicked > 0 {
+        fmt.Printf("Total files that failed with an internal error: %d\n", summary.FilesPanicked)
+    }
+    fmt.Printf("Total space saved: %d bytes\n", summary.SpaceSaved)
+    if opts.mode == MODE_DECOMPRESS {
+        printDecompressed(summary)
+    }
+    if opts.Backend == BACKEND_NAME_AUTO && opts.applying() {
+        printWofChoices(summary)
+    }
+    if summary.degradedEstimates > 0 {
+        fmt.Printf("Estimates degraded to smaller samples by -memory-limit: %d\n", summary.degradedEstimates)
+    }
+    if opts.Chaos > 0 {
+        fmt.Printf("Failures injected by -chaos: %d\n", chaosInjected.Load())
+    }
+    if opts.MaxDiskBusy > 0 {
+        fmt.Printf("Time reads waited for a quiet disk: %v\n", time.Duration(diskBusyNanos.Load()).Round(time.Second))
+    }
+    if defaultExcludedFiles.Load() > 0 {
+        fmt.Printf("Already compressed formats skipped without reading: %d files, %d bytes (see -no-default-excludes)\n", defaultExcludedFiles.Load(), defaultExcludedBytes.Load())
+    }
+    if summary.stubFiles > 0 {
+        fmt.Printf("Offline and HSM stubs skipped: %d files, %d bytes not recalled\n", summary.stubFiles, summary.stubBytes)
+    }
+    printResources(usage)
+    if !opts.applying() {
+        fmt.Printf("Total files recommended for compression: %d\n", summary.FilesPlannedCompress)
+        fmt.Printf("Total files recommended for decompression: %d\n", summary.FilesPlannedDecompress)
+        fmt.Printf("Projected space savings: %d bytes\n", summary.SpaceProjected)
+    }
+    if len(opts.Roots) > 1 {
+        printRootSummaries(opts.Roots)
+    }
+    printTopDirectories(opts.Roots, opts.TopDirs)
+    if opts.mode == MODE_ANALYZE {
+        printExtensionBreakdown(opts.TopDirs)
+    }
+    printReadAdvice()
+    if state != nil {
+        printQuarantine()
+    }
+    if opts.Forecast {
+        printForecast(opts.Roots, opts.TopDirs)
+    }
+    if opts.OwnerReport {
+        printOwnerSavings(opts.TopDirs)
+    }
+    if opts.QuotaReport {
+        printQuotaReport(opts.Roots, opts.TopDirs)
+    }
+    if opts.MeasureFilters {
+        printFilterCost(summary.io)
+    }
 }
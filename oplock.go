@@ -0,0 +1,207 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+    "unsafe"
+
+    "golang.org/x/sys/windows"
+)
+
+const (
+    FILE_FLAG_OPEN_REQUIRING_OPLOCK = 0x00040000
+    FSCTL_REQUEST_OPLOCK            = 0x00090240
+    ERROR_OPLOCK_NOT_GRANTED        = syscall.Errno(300)
+    ERROR_CANNOT_BREAK_OPLOCK       = syscall.Errno(802)
+
+    OPLOCK_LEVEL_CACHE_READ           = 1
+    OPLOCK_LEVEL_CACHE_HANDLE         = 2
+    REQUEST_OPLOCK_INPUT_FLAG_REQUEST = 1
+    REQUEST_OPLOCK_CURRENT_VERSION    = 1
+
+    SHARE_ALL = windows.FILE_SHARE_READ | windows.FILE_SHARE_WRITE | windows.FILE_SHARE_DELETE
+)
+
+// Files on shares are often held under oplocks by SMB clients caching
+// them. Opening such a file normally breaks the oplock, stalling the client
+// until it has flushed its cache. Instead, each file is first opened
+// requiring an oplock of our own, which fails while another client holds a
+// conflicting one, and the file is left for a later run. Our oplock is given
+// up as soon as someone else needs the file, and the file then left alone.
+
+// requestOplockInput is REQUEST_OPLOCK_INPUT_BUFFER.
+type requestOplockInput struct {
+    structureVersion     uint16
+    structureLength      uint16
+    requestedOplockLevel uint32
+    flags                uint32
+}
+
+// requestOplockOutput is REQUEST_OPLOCK_OUTPUT_BUFFER.
+type requestOplockOutput struct {
+    structureVersion    uint16
+    structureLength     uint16
+    originalOplockLevel uint32
+    newOplockLevel      uint32
+    flags               uint32
+    accessMode          uint32
+    shareMode           uint16
+}
+
+// oplockGuard holds a read-handle oplock on a file while it is processed.
+// The request stays pending until another opener breaks the oplock; the
+// guard then closes its handle at once, acknowledging the break, and
+// reports the file as taken.
+type oplockGuard struct {
+    handle     windows.Handle
+    overlapped windows.Overlapped
+    in         requestOplockInput
+    out        requestOplockOutput
+
+    broke   atomic.Bool
+    mu      sync.Mutex // Guards closing and closed, so the handle is closed once and never used after
+    closing bool       // release has begun; the watcher leaves the handle to it
+    closed  bool       // The watcher closed the handle on a break
+    done    chan struct{}
+    once    sync.Once
+}
+
+// takeOplock requests the oplock on path. It fails with an oplock conflict
+// when another client holds the file; where oplocks aren't supported it
+// returns a nil guard, which never breaks.
+func takeOplock(path string) (*oplockGuard, error) {
+    p, err := windows.UTF16PtrFromString(path)
+    if err != nil {
+        return nil, err
+    }
+    h, err := windows.CreateFile(p, windows.GENERIC_READ, SHARE_ALL, nil,
+        windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED|FILE_FLAG_OPEN_REQUIRING_OPLOCK, 0)
+    if err != nil {
+        return nil, &os.PathError{Op: "open", Path: path, Err: err}
+    }
+    event, err := windows.CreateEvent(nil, 1, 0, nil)
+    if err != nil {
+        windows.CloseHandle(h)
+        return nil, err
+    }
+
+    g := &oplockGuard{handle: h, done: make(chan struct{})}
+    g.overlapped.HEvent = event
+    g.in = requestOplockInput{
+        structureVersion:     REQUEST_OPLOCK_CURRENT_VERSION,
+        structureLength:      uint16(unsafe.Sizeof(g.in)),
+        requestedOplockLevel: OPLOCK_LEVEL_CACHE_READ | OPLOCK_LEVEL_CACHE_HANDLE,
+        flags:                REQUEST_OPLOCK_INPUT_FLAG_REQUEST,
+    }
+    g.out = requestOplockOutput{structureVersion: REQUEST_OPLOCK_CURRENT_VERSION, structureLength: uint16(unsafe.Sizeof(g.out))}
+    var bytesReturned uint32
+    err = windows.DeviceIoControl(h, FSCTL_REQUEST_OPLOCK,
+        (*byte)(unsafe.Pointer(&g.in)), uint32(unsafe.Sizeof(g.in)),
+        (*byte)(unsafe.Pointer(&g.out)), uint32(unsafe.Sizeof(g.out)),
+        &bytesReturned, &g.overlapped)
+    switch {
+    case err == windows.ERROR_IO_PENDING:
+        // Granted; pending until broken
+    case err == ERROR_OPLOCK_NOT_GRANTED:
+        windows.CloseHandle(h)
+        windows.CloseHandle(event)
+        return nil, &os.PathError{Op: "oplock", Path: path, Err: ERROR_CANNOT_BREAK_OPLOCK}
+    default:
+        // Completed at once (broken already) or not supported here
+        windows.CloseHandle(h)
+        windows.CloseHandle(event)
+        if err == nil {
+            return nil, &os.PathError{Op: "oplock", Path: path, Err: ERROR_CANNOT_BREAK_OPLOCK}
+        }
+        return nil, nil
+    }
+
+    go g.watch()
+    return g, nil
+}
+
+// watch waits for the request to complete: when the oplock breaks, or when
+// release cancels it.
+func (g *oplockGuard) watch() {
+    defer close(g.done)
+    windows.WaitForSingleObject(g.overlapped.HEvent, windows.INFINITE)
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if g.closing {
+        return
+    }
+    // Closing the handle at once acknowledges the break, rather than
+    // making the other opener wait until the file is done
+    g.broke.Store(true)
+    windows.CloseHandle(g.handle)
+    g.closed = true
+}
+
+// broken reports whether another opener needed the file since the oplock
+// was granted.
+func (g *oplockGuard) broken() bool {
+    return g != nil && g.broke.Load()
+}
+
+// release gives the oplock up once the file is processed.
+func (g *oplockGuard) release() {
+    if g == nil {
+        return
+    }
+    g.once.Do(func() {
+        // The request is cancelled while the handle is certainly open, and
+        // the handle closed only once the watcher is done with it
+        g.mu.Lock()
+        g.closing = true
+        if !g.closed {
+            windows.CancelIoEx(g.handle, &g.overlapped)
+        }
+        g.mu.Unlock()
+        <-g.done
+
+        if !g.closed {
+            windows.CloseHandle(g.handle)
+        }
+        windows.CloseHandle(g.overlapped.HEvent)
+    })
+}
+
+// openForRead opens a file for estimation without conflicting with other
+// openers; the oplock held by takeOplock covers it.
+func openForRead(path string, times *ioTimings) (timedFile, error) {
+    p, err := windows.UTF16PtrFromString(path)
+    if err != nil {
+        return timedFile{}, err
+    }
+
+    if err := chaosFailure("open", path); err != nil {
+        return timedFile{}, err
+    }
+
+    start := time.Now()
+    h, err := windows.CreateFile(p, windows.GENERIC_READ, SHARE_ALL, nil,
+        windows.OPEN_EXISTING, 0, 0)
+    times.measure(IO_OPEN, start)
+    times.opened()
+    if err != nil {
+        return timedFile{}, &os.PathError{Op: "open", Path: path, Err: err}
+    }
+    return timedFile{os.NewFile(uintptr(h), path), times}, nil
+}
+
+// isOplockConflict reports whether another client holds an oplock on the
+// file, or broke ours.
+func isOplockConflict(err error) bool {
+    return errors.Is(err, ERROR_CANNOT_BREAK_OPLOCK)
+}
+
+// skipInUse records a file left alone because another client holds it.
+func skipInUse(path string, shard *statsShard) {
+    verbosef("File %s is in use by another client, active — skipped\n", path)
+    shard.filesActiveSkipped.Add(1)
+}
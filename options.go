@@ -0,0 +1,814 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "math/big"
+    "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Options holds the settings for a single run, filled in from the command line
+// and any Group Policy managed settings.
+type Options struct {
+    Roots      []string
+    Files      []string // Given on their own rather than found by a walk
+    FilesFrom  string
+    ConfigFile string
+    ArchiveBit string
+    Threshold  float64
+    Extensions extensionRules
+    Limit      int
+    Safe       bool
+    DryRun     bool
+    Strict     bool
+    AllVolumes bool
+
+    FollowLinks bool
+
+    // Output
+    Quiet     bool
+    Verbose   bool
+    Debug     bool
+    Verbosity int // Resolved from the three above
+
+    Output      string
+    OutputFiles bool
+    JSONSummary string
+    Inventory   string
+    Backend    string
+    CompactOS  bool
+    Yes        bool
+
+    DecompressDirectories bool
+
+    AllowContainer bool
+
+    Chaos float64 // Rate of injected failures, see chaos.go
+
+    // Concurrency within the run
+    Workers          int
+    RampUp           time.Duration
+    ReadConcurrency  int
+    FsctlConcurrency int
+    MaxDiskBusy      float64
+
+    // Error handling
+    MaxErrorRate float64
+    ErrorWindow  int
+    OnErrorStorm string
+
+    // Concurrent runs
+    Wait      time.Duration
+    StealLock bool
+
+    // Estimation
+    EarlyStopChunks int
+    EarlyStopMargin float64
+    MaxEstimateSize int64
+    MemoryLimit     int64
+
+    BorderlineMargin float64
+    VerifyBorderline bool
+    MinActualSavings float64
+    MaxAccessCost    float64
+
+    TwoPass     bool
+    QuickMargin float64
+
+    // Walk
+    MinDepth     int
+    MaxDepth     int
+    Owners       ownerFilter
+    Exclude      globList
+    Include      globList
+    MinSize      sizeValue
+    MaxSize      sizeValue
+
+    SkipRandomAccess  bool
+    NoDefaultExcludes bool
+    IgnoreFile        string
+    Since        time.Time
+    SinceLastRun bool
+
+    // History
+    State           string
+    ReevaluateAfter reevaluateRules
+    VerifyHash      hashDirs
+    HashAlgorithm   string
+    FixDrift        bool
+    QuarantineAfter int
+    QuarantineTTL   ageValue
+    OrderBySavings  bool
+
+    // Reporting
+    StatusInterval time.Duration
+    Progress       bool
+    Plain          bool
+    Pause          bool
+    RunName        string
+    PublishStatus  bool
+    TopDirs        int
+    Treemap        string
+    CSV            string
+    Forecast       bool
+    MeasureFilters bool
+    QuotaReport    bool
+    OwnerReport    bool
+    FsrmReport     string
+    HTMLReport     string
+    Redact         string
+    RedactKey      string
+    SummaryFile    string
+    AuditLog       string
+    LogSink        string
+    LogFile        string
+    LogMaxSize     sizeValue
+    LogKeep        int
+    FlushInterval  time.Duration
+    Checkpoint     string
+    Resume         bool
+    StallTimeout   time.Duration
+    RunsDir        string
+
+    // Hooks
+    PreRunHook    string
+    PostRunHook   string
+    DirectoryHook string
+    HookTimeout   time.Duration
+
+    // Plans
+    WritePlan string
+    ApplyPlan string
+    PlanKey   string
+
+    RelativePaths bool
+
+    // Set for runs that only recommend, such as safe first runs
+    recommendOnly bool
+
+    // Subcommand given before the options, MODE_AUTO for the bare form
+    mode string
+
+    // Effective value of every option, recorded in the run manifest
+    config map[string]string
+
+    // Read from -redact-key
+    redactKey []byte
+}
+
+var opts Options
+
+// optionFlags are the flags parseOptions parsed, whose final values
+// recordConfig takes.
+var optionFlags *flag.FlagSet
+
+// recordConfig records the effective value of every option for the run
+// manifest, once defaults derived from other options and the overrides of
+// safe mode have been applied. Paths are redacted with -redact.
+func recordConfig() {
+    opts.config = map[string]string{}
+    if optionFlags == nil {
+        return
+    }
+    optionFlags.VisitAll(func(f *flag.Flag) {
+        opts.config[f.Name] = redactOption(f)
+    })
+}
+
+// defineFlags registers the command-line options on fs. The -since value is
+// returned as given; it is parsed once managed settings have been applied.
+func defineFlags(fs *flag.FlagSet) *string {
+    fs.StringVar(&opts.ArchiveBit, "archive-bit", ARCHIVE_BIT_LEAVE,
+        "archive attribute handling after processing: leave, clear or restore")
+
+    fs.StringVar(&opts.ConfigFile, "config", "",
+        "read settings from this TOML file; options on the command line override it")
+
+    fs.Float64Var(&opts.Threshold, "threshold", COMPRESSION_EFFICIENCY_THRESHOLD,
+        "minimum estimated space saving, in percent, for a file to be compressed; files below it are decompressed")
+    fs.Var(&opts.Extensions, "extension",
+        "threshold for extensions, e.g. .log=5, .mp4,.jpg,.7z=skip to never process them, or .log,.txt,.xml=always to compress them without reading them for an estimate (repeatable)")
+
+    fs.StringVar(&opts.Backend, "backend", BACKEND_NAME_NTFS,
+        "how files are compressed: ntfs (LZNT1), or xpress4k, xpress8k, xpress16k or lzx through WOF (Windows 10 and later), or auto to choose the WOF algorithm per file from its type, size and ratio")
+    fs.BoolVar(&opts.CompactOS, "compact-os", false,
+        "compress system files like compact /compactos:always, with WOF XPRESS4K unless -backend says otherwise; defaults to the Windows folder and asks for confirmation")
+    fs.BoolVar(&opts.Yes, "yes", false,
+        "answer confirmations with yes, for unattended runs")
+    fs.BoolVar(&opts.DecompressDirectories, "decompress-directories", false,
+        "with decompress, also clear the compression attribute of folders so new files in them aren't compressed")
+
+    fs.IntVar(&opts.Limit, "limit", 0,
+        "stop after this many files have been queued (0 for no limit)")
+    fs.BoolVar(&opts.Safe, "safe", false,
+        "conservative first-run mode: higher threshold, default excludes, capped -limit, and recommendations only for folders not seen before")
+
+    fs.BoolVar(&opts.FollowLinks, "follow-links", false,
+        "walk into symbolic links and junctions, processing each target once and never one inside a folder being walked anyway")
+    fs.BoolVar(&opts.AllVolumes, "all-volumes", false,
+        "process every fixed NTFS volume with a drive letter instead of the folders given")
+    fs.BoolVar(&opts.Strict, "strict", false,
+        "fail the run, listing why, if any file can't be processed, any path can't be read or any folder is on an unusable volume")
+    fs.BoolVar(&opts.DryRun, "dry-run", false,
+        "list the files that would be compressed or decompressed with their estimated savings, without changing anything")
+
+    fs.BoolVar(&opts.AllowContainer, "allow-container", false,
+        "apply decisions even when running in a Windows container or Windows Sandbox, e.g. to folders mapped from the host")
+
+    fs.IntVar(&opts.Workers, "workers", defaultWorkers(),
+        "files processed at once; lower it for spinning disks, raise it for NVMe")
+    fs.DurationVar(&opts.RampUp, "ramp-up", 0,
+        "start with an eighth of the workers and add the rest over this time, e.g. 1m, holding while errors or latency climb (0 starts all at once)")
+    fs.IntVar(&opts.ReadConcurrency, "read-concurrency", 0,
+        "files read for estimation at once (0 for one per worker)")
+    fs.IntVar(&opts.FsctlConcurrency, "fsctl-concurrency", 0,
+        "compression changes issued at once; lower it where filter drivers serialize FSCTLs (0 for one per worker)")
+    fs.Float64Var(&opts.MaxDiskBusy, "max-disk-busy", 0,
+        "pause reading while other processes keep the disk busy more than this percentage of the time, resuming once it is quiet for a few seconds (0 disables)")
+
+    fs.Float64Var(&opts.MaxErrorRate, "max-error-rate", 0,
+        "stop the run when more than this percentage of files in an -error-window fail (0 disables)")
+    fs.IntVar(&opts.ErrorWindow, "error-window", DEFAULT_ERROR_WINDOW,
+        "number of files the error rate is measured over")
+    fs.StringVar(&opts.OnErrorStorm, "on-error-storm", ERROR_STORM_ABORT,
+        "what to do when -max-error-rate is exceeded: abort, or pause until resumed with r")
+
+    fs.DurationVar(&opts.Wait, "wait", 0,
+        "wait up to this long for another instance processing the same folder to finish, e.g. 10m")
+    fs.BoolVar(&opts.StealLock, "steal-lock", false,
+        "go ahead without the lock when another instance is still processing the same folder after -wait")
+
+    fs.IntVar(&opts.EarlyStopChunks, "early-stop-chunks", 0,
+        "stop estimating after this many 1 MiB chunks once the ratio is clearly decided (0 reads whole files)")
+    fs.Float64Var(&opts.EarlyStopMargin, "early-stop-margin", 5,
+        "percentage points the ratio must clear the threshold by to stop early")
+
+    fs.Int64Var(&opts.MaxEstimateSize, "max-estimate-size", DEFAULT_MAX_ESTIMATE_SIZE,
+        "bytes up to which files are read in full for an estimate; larger files are estimated from samples (0 reads every file in full)")
+
+    fs.Int64Var(&opts.MemoryLimit, "memory-limit", 0,
+        "bytes all estimates in progress may hold at once; beyond it files are estimated from fewer, smaller samples instead of waiting (0 for no limit)")
+
+    fs.Float64Var(&opts.BorderlineMargin, "borderline-margin", 3,
+        "percentage points around the threshold within which estimates are reported as borderline")
+    fs.BoolVar(&opts.VerifyBorderline, "verify-borderline", false,
+        "re-estimate borderline files with the LZNT1 compressor NTFS uses and decide on that")
+    fs.Float64Var(&opts.MinActualSavings, "min-actual-savings", 0,
+        "after compressing a file, check the space it actually saves and decompress it again below this percentage or one cluster (0 disables)")
+    fs.Float64Var(&opts.MaxAccessCost, "max-access-cost", 0,
+        "milliseconds of decompression CPU per full read the chosen algorithm may cost for each MiB saved; costlier files are left uncompressed (0 disables)")
+
+    fs.BoolVar(&opts.TwoPass, "two-pass", false,
+        "decide clear cases from a few samples per file first, then estimate the uncertain rest in full")
+    fs.Float64Var(&opts.QuickMargin, "quick-margin", 15,
+        "percentage points a sampled ratio must clear the threshold by to be decided in the quick pass")
+
+    fs.IntVar(&opts.MinDepth, "min-depth", 0,
+        "only process files at least this many levels below the folder (files in the folder are level 1)")
+    fs.IntVar(&opts.MaxDepth, "max-depth", 0,
+        "only process files at most this many levels below the folder (0 for no limit)")
+
+    fs.StringVar(&opts.FilesFrom, "files-from", "",
+        "also process the files listed one per line in this file, or - for the standard input; listed files skip the walk and its filters")
+    fs.Var(&opts.Exclude, "exclude",
+        "skip files and folders matching this glob, e.g. *.mp4, node_modules\\** or C:\\Data\\Temp\\* (repeatable)")
+    fs.BoolVar(&opts.NoDefaultExcludes, "no-default-excludes", false,
+        "also read archives, images, audio, video and Office documents, which are already compressed and skipped by default")
+    fs.StringVar(&opts.IgnoreFile, "ignore-file", DEFAULT_IGNORE_FILE,
+        "name of the per-folder files whose gitignore-style patterns exclude files and folders below them (empty ignores them)")
+    fs.Var(&opts.MinSize, "min-size",
+        "skip files smaller than this, e.g. 64K")
+    fs.Var(&opts.MaxSize, "max-size",
+        "skip files larger than this, e.g. 2G (0 for no limit)")
+    fs.BoolVar(&opts.SkipRandomAccess, "skip-random-access", false,
+        "skip databases, mailboxes and virtual disks, which are read at random offsets and can get slower when compressed")
+    fs.Var(&opts.Include, "include",
+        "only process files matching this glob, e.g. *.log; -exclude takes precedence (repeatable)")
+    fs.Var(&opts.Owners, "owner",
+        "only process files owned by this account, group or SID, e.g. CONTOSO\\jdoe (repeatable)")
+
+    since := fs.String("since", "",
+        "only process files modified on or after this date (2024-01-01) or within this age (30d)")
+    fs.BoolVar(&opts.SinceLastRun, "since-last-run", false,
+        "only process files modified since the previous run over the same folder (needs -state)")
+
+    fs.StringVar(&opts.State, "state", "",
+        "file remembering evaluations between runs")
+    fs.BoolVar(&opts.OrderBySavings, "order-by-savings", false,
+        "walk first the folders that saved the most in previous runs, so an interrupted run still saves most (needs -state)")
+    fs.Var(&opts.ReevaluateAfter, "reevaluate-after",
+        "skip unchanged files evaluated within this age, e.g. 180d; dir=age sets it below a directory (repeatable, needs -state)")
+
+    fs.Var(&opts.VerifyHash, "verify-hash",
+        "below this folder, also compare a quick hash of the content of files that look unchanged before skipping them (repeatable, with -reevaluate-after)")
+    fs.StringVar(&opts.HashAlgorithm, "hash-algorithm", HASH_SHA256,
+        "algorithm of the -verify-hash quick hash: sha256, crc32c (fastest, hardware accelerated) or fnv; switching re-verifies files once")
+
+    fs.BoolVar(&opts.FixDrift, "fix-drift", false,
+        "re-apply the recorded decision to files whose compression state drifted from it (needs -state)")
+
+    fs.IntVar(&opts.QuarantineAfter, "quarantine-after", DEFAULT_QUARANTINE_AFTER,
+        "stop retrying files that failed in this many consecutive runs (with -state; 0 disables)")
+    opts.QuarantineTTL = ageValue(DEFAULT_QUARANTINE_TTL)
+    fs.Var(&opts.QuarantineTTL, "quarantine-ttl",
+        "how long quarantined files are left alone before being retried, e.g. 30d")
+
+    fs.DurationVar(&opts.StatusInterval, "status-interval", 0,
+        "print a merged progress snapshot at this interval, e.g. 30s (0 disables)")
+    fs.BoolVar(&opts.Progress, "progress", false,
+        "show files and bytes done out of those found, the throughput and the time left, in place on a console and as a line every 30s otherwise")
+
+    fs.BoolVar(&opts.Quiet, "q", false,
+        "print the summary only")
+    fs.BoolVar(&opts.Verbose, "v", false,
+        "print a line for every file")
+    fs.BoolVar(&opts.Debug, "vv", false,
+        "print a line for every file and how each decision was reached")
+
+    fs.StringVar(&opts.Output, "output", OUTPUT_TEXT,
+        "summary format: text, or json to print it as a JSON document alone on the standard output, with the text summary and other output, limited as with -q, on the standard error")
+    fs.StringVar(&opts.JSONSummary, "json-summary", "",
+        "also write the JSON summary of -output json to this file, or to the standard output for -; either way the text summary and all other output go to the standard error")
+    fs.StringVar(&opts.Inventory, "inventory", "",
+        "with the inventory subcommand, the file to list every file's attributes, size, allocation and compression in: JSON for a .json name, else CSV")
+    fs.BoolVar(&opts.OutputFiles, "output-files", false,
+        "with -output json or -json-summary, include a record of every file")
+
+    fs.BoolVar(&opts.Plain, "plain", false,
+        "line-oriented output only, for screen readers and log capture: no hotkeys and no changes to the console mode")
+    fs.BoolVar(&opts.Pause, "pause", false,
+        "keep the console window open at the end until Enter is pressed; on by default when started from Explorer")
+
+    fs.StringVar(&opts.RunName, "run-name", "",
+        "logical job name recorded with the results, e.g. nightly-d-drive")
+
+    fs.BoolVar(&opts.PublishStatus, "publish-status", false,
+        "record run status and the last-run summary under HKLM\\"+STATUS_REGISTRY_KEY)
+
+    fs.IntVar(&opts.TopDirs, "top-dirs", 10,
+        "number of directories listed by size and by savings in the summary (0 disables)")
+
+    fs.StringVar(&opts.Treemap, "treemap", "",
+        "write sizes and savings as ncdu-compatible JSON to this file for treemap tools")
+    fs.StringVar(&opts.CSV, "csv", "",
+        "write one row per file with its size, estimated size, ratio, action and error to this CSV file")
+
+    fs.BoolVar(&opts.Forecast, "forecast", false,
+        "project savings for LZNT1, XPRESS8K and LZX per directory (reads every file a second time)")
+
+    fs.BoolVar(&opts.OwnerReport, "owner-report", false,
+        "attribute savings to file owners and list the owners whose data gained the most space")
+    fs.BoolVar(&opts.QuotaReport, "quota-report", false,
+        "report disk quota usage per owner on volumes with quotas next to the savings of each owner")
+
+    fs.StringVar(&opts.FsrmReport, "fsrm-report", "",
+        "write savings by folder and by owner as CSV files to this directory, keyed like File Server Resource Manager storage reports")
+    fs.StringVar(&opts.HTMLReport, "html-report", "",
+        "write a self-contained HTML report with the totals, top directories and extensions by savings, and errors to this file")
+    fs.StringVar(&opts.Redact, "redact", REDACT_NONE,
+        "hide names in the manifest, JSON output, CSV, HTML, treemap and FSRM reports: hash replaces each with a short keyed hash (needs -redact-key), mask with *; sizes, extensions and depth are kept")
+    fs.StringVar(&opts.RedactKey, "redact-key", "",
+        "file holding this site's secret key for -redact hash, at least 16 bytes; without it hashed names could be guessed")
+
+    fs.BoolVar(&opts.MeasureFilters, "measure-filters", false,
+        "measure time spent opening, reading, changing and closing files to tell whether a filter driver (antivirus) dominates")
+
+    fs.StringVar(&opts.SummaryFile, "summary-file", "",
+        "keep the run totals in this JSON file, updated every -flush-interval while running")
+    fs.StringVar(&opts.AuditLog, "audit-log", "",
+        "append a JSON line to this file for every file whose compression is changed, with how it was stored before, for the undo subcommand")
+    opts.LogMaxSize = DEFAULT_LOG_MAX_SIZE
+    fs.StringVar(&opts.LogFile, "log-file", "",
+        "append every notice, per-file and debug line as JSON to this file, whatever -q or -v say")
+    fs.Var(&opts.LogMaxSize, "log-max-size",
+        "rotate the -log-file once it reaches this size, e.g. 10M (0 never rotates)")
+    fs.IntVar(&opts.LogKeep, "log-keep", DEFAULT_LOG_KEEP,
+        "rotated -log-file copies kept, as <file>.1 (newest) to <file>.N")
+    fs.StringVar(&opts.LogSink, "log-sink", "",
+        "also send per-file and summary events to a syslog or Graylog server, e.g. syslog+udp://loghost:514 or gelf+tcp://graylog:12201")
+    fs.DurationVar(&opts.FlushInterval, "flush-interval", DEFAULT_FLUSH_INTERVAL,
+        "how often the summary file is rewritten and the audit log and checkpoint synced to disk")
+    fs.StringVar(&opts.Checkpoint, "checkpoint", "",
+        "record the files done in this file every -flush-interval, so an interrupted run can be continued with -resume; removed once the run completes")
+    fs.BoolVar(&opts.Resume, "resume", false,
+        "continue the interrupted run of the -checkpoint file, skipping the files it had done")
+
+    fs.StringVar(&opts.RunsDir, "runs-dir", defaultRunsDir(),
+        "directory receiving a JSON manifest of every run (empty disables)")
+
+    fs.DurationVar(&opts.StallTimeout, "stall-timeout", DEFAULT_STALL_TIMEOUT,
+        "report workers stuck on one file for longer than this, with goroutine stacks (0 disables)")
+
+    fs.StringVar(&opts.PreRunHook, "pre-run-hook", "",
+        "command run before the run starts, with the run as JSON on its input; the run is abandoned if it fails")
+    fs.StringVar(&opts.PostRunHook, "post-run-hook", "",
+        "command run after the run, with the run and its totals as JSON on its input")
+    fs.StringVar(&opts.DirectoryHook, "directory-hook", "",
+        "command run whenever all files directly in a folder have been processed, with the folder as JSON on its input")
+    fs.DurationVar(&opts.HookTimeout, "hook-timeout", DEFAULT_HOOK_TIMEOUT,
+        "how long a hook command may run before it is killed (0 for no limit)")
+
+    fs.StringVar(&opts.WritePlan, "write-plan", "",
+        "record the decisions in this plan file instead of applying them")
+    fs.StringVar(&opts.ApplyPlan, "apply-plan", "",
+        "apply the decisions from this plan file instead of scanning a folder; a -relative-paths plan applies to every replica whose folders follow")
+    fs.StringVar(&opts.PlanKey, "plan-key", "",
+        "Ed25519 key in a PEM file: the private key signs written plans; the public key, all applying machines need, makes only plans signed with the private one be applied")
+    fs.BoolVar(&opts.RelativePaths, "relative-paths", false,
+        "write plan and report paths relative to their folder, so a plan can be applied to a replica elsewhere")
+
+    return since
+}
+
+// resolveVerbosity sets the output level from -output, -vv, -v and -q.
+func resolveVerbosity() {
+    switch {
+    case opts.Output == OUTPUT_JSON:
+        opts.Verbosity = VERBOSITY_QUIET
+    case opts.Debug:
+        opts.Verbosity = VERBOSITY_DEBUG
+    case opts.Verbose:
+        opts.Verbosity = VERBOSITY_VERBOSE
+    case opts.Quiet:
+        opts.Verbosity = VERBOSITY_QUIET
+    default:
+        opts.Verbosity = VERBOSITY_NORMAL
+    }
+}
+
+func parseOptions(args []string) error {
+    fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "Usage: %s [options] <folder or file path>...\n       %s compress|decompress|analyze|status [options] <folder path>...\n       %s inventory -inventory <file.csv|file.json> [options] <folder path>...\n       %s [options] -apply-plan <plan file> [folder path...]\n       %s [options] -compact-os [folder path...]\n       %s self-update [options]\n       %s report diff [-runs-dir dir] [-run-name name]\n       %s maintain [options] <volume> [compress options]\n       %s undo [-dry-run] <audit log>\n       %s completion powershell|bash|zsh\n\nOptions:\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+        printVisibleDefaults(fs)
+    }
+    since := defineFlags(fs)
+    defineHiddenFlags(fs)
+    optionFlags = fs
+
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    // Resolved before the config file and policy so their notices show
+    resolveVerbosity()
+
+    if opts.ConfigFile != "" {
+        if err := applyConfigFile(fs, opts.ConfigFile); err != nil {
+            return fmt.Errorf("config file: %v", err)
+        }
+    }
+
+    // Centrally managed settings take precedence over the command line
+    if err := applyPolicy(fs); err != nil {
+        return err
+    }
+
+    switch opts.ArchiveBit {
+    case ARCHIVE_BIT_LEAVE, ARCHIVE_BIT_CLEAR, ARCHIVE_BIT_RESTORE:
+    default:
+        return fmt.Errorf("invalid -archive-bit value %q (want leave, clear or restore)", opts.ArchiveBit)
+    }
+
+    switch opts.Output {
+    case OUTPUT_TEXT, OUTPUT_JSON:
+    default:
+        return fmt.Errorf("invalid -output value %q (want text or json)", opts.Output)
+    }
+    switch opts.Redact {
+    case REDACT_NONE, REDACT_HASH, REDACT_MASK:
+    default:
+        return fmt.Errorf("invalid -redact value %q (want hash or mask)", opts.Redact)
+    }
+    if opts.Redact == REDACT_HASH {
+        if opts.RedactKey == "" {
+            return fmt.Errorf("-redact hash needs a -redact-key")
+        }
+        key, err := readRedactKey(opts.RedactKey)
+        if err != nil {
+            return err
+        }
+        opts.redactKey = key
+    }
+
+    if opts.JSONSummary != "" && opts.Output == OUTPUT_JSON {
+        return fmt.Errorf("-json-summary cannot be combined with -output json")
+    }
+    if opts.OutputFiles && opts.Output != OUTPUT_JSON && opts.JSONSummary == "" {
+        return fmt.Errorf("-output-files needs -output json or -json-summary")
+    }
+
+    // The config file or policy may have changed the output flags
+    resolveVerbosity()
+
+    if opts.Chaos < 0 || opts.Chaos > 1 {
+        return fmt.Errorf("invalid -chaos value %g (want a fraction from 0 to 1)", opts.Chaos)
+    }
+
+    if opts.Threshold < 0 || opts.Threshold > 100 {
+        return fmt.Errorf("invalid -threshold value %g", opts.Threshold)
+    }
+
+    if _, ok := wofAlgorithms[opts.Backend]; !ok && opts.Backend != BACKEND_NAME_NTFS && opts.Backend != BACKEND_NAME_AUTO {
+        return fmt.Errorf("invalid -backend value %q (want ntfs, xpress4k, xpress8k, xpress16k, lzx or auto)", opts.Backend)
+    }
+    if opts.CompactOS && !flagSet(fs, "backend") {
+        opts.Backend = COMPACT_OS_BACKEND
+    }
+
+    if opts.Limit < 0 {
+        return fmt.Errorf("invalid -limit value %d", opts.Limit)
+    }
+
+    if opts.Resume && opts.Checkpoint == "" {
+        return fmt.Errorf("-resume needs the -checkpoint file of the interrupted run")
+    }
+    if opts.FlushInterval <= 0 {
+        return fmt.Errorf("invalid -flush-interval value %v", opts.FlushInterval)
+    }
+
+    if opts.Workers <= 0 {
+        return fmt.Errorf("invalid -workers value %d", opts.Workers)
+    }
+    if opts.ReadConcurrency < 0 {
+        return fmt.Errorf("invalid -read-concurrency value %d", opts.ReadConcurrency)
+    }
+    if opts.MaxDiskBusy < 0 || opts.MaxDiskBusy > 100 {
+        return fmt.Errorf("invalid -max-disk-busy value %g (want 0 to 100)", opts.MaxDiskBusy)
+    }
+    if opts.FsctlConcurrency < 0 {
+        return fmt.Errorf("invalid -fsctl-concurrency value %d", opts.FsctlConcurrency)
+    }
+
+    if opts.RampUp < 0 {
+        return fmt.Errorf("invalid -ramp-up value %v", opts.RampUp)
+    }
+
+    if opts.HookTimeout < 0 {
+        return fmt.Errorf("invalid -hook-timeout value %v", opts.HookTimeout)
+    }
+
+    if opts.StallTimeout < 0 {
+        return fmt.Errorf("invalid -stall-timeout value %v", opts.StallTimeout)
+    }
+
+    if opts.MaxErrorRate < 0 || opts.MaxErrorRate > 100 {
+        return fmt.Errorf("invalid -max-error-rate value %g", opts.MaxErrorRate)
+    }
+    if opts.ErrorWindow <= 0 {
+        return fmt.Errorf("invalid -error-window value %d", opts.ErrorWindow)
+    }
+    switch opts.OnErrorStorm {
+    case ERROR_STORM_ABORT, ERROR_STORM_PAUSE:
+    default:
+        return fmt.Errorf("invalid -on-error-storm value %q (want abort or pause)", opts.OnErrorStorm)
+    }
+
+    if opts.Wait < 0 {
+        return fmt.Errorf("invalid -wait value %v", opts.Wait)
+    }
+
+    if opts.MaxEstimateSize < 0 {
+        return fmt.Errorf("invalid -max-estimate-size value %d", opts.MaxEstimateSize)
+    }
+
+    if opts.MemoryLimit < 0 {
+        return fmt.Errorf("invalid -memory-limit value %d", opts.MemoryLimit)
+    }
+
+    if opts.BorderlineMargin < 0 {
+        return fmt.Errorf("invalid -borderline-margin value %g", opts.BorderlineMargin)
+    }
+
+    if opts.MaxAccessCost < 0 {
+        return fmt.Errorf("invalid -max-access-cost value %g", opts.MaxAccessCost)
+    }
+
+    if opts.MinActualSavings < 0 || opts.MinActualSavings > 100 {
+        return fmt.Errorf("invalid -min-actual-savings value %g", opts.MinActualSavings)
+    }
+
+    if opts.QuickMargin < 0 {
+        return fmt.Errorf("invalid -quick-margin value %g", opts.QuickMargin)
+    }
+
+    if opts.EarlyStopChunks < 0 {
+        return fmt.Errorf("invalid -early-stop-chunks value %d", opts.EarlyStopChunks)
+    }
+
+    if !validRunName(opts.RunName) {
+        return fmt.Errorf("invalid -run-name %q (use letters, digits, '.', '-' and '_')", opts.RunName)
+    }
+
+    if opts.MinDepth < 0 || opts.MaxDepth < 0 || (opts.MaxDepth > 0 && opts.MinDepth > opts.MaxDepth) {
+        return fmt.Errorf("invalid depth range -min-depth %d -max-depth %d", opts.MinDepth, opts.MaxDepth)
+    }
+
+    if *since != "" {
+        t, err := parseSince(*since)
+        if err != nil {
+            return err
+        }
+        opts.Since = t
+    }
+    if opts.OrderBySavings && opts.State == "" {
+        return fmt.Errorf("-order-by-savings needs a -state file")
+    }
+    if opts.SinceLastRun && opts.State == "" {
+        return fmt.Errorf("-since-last-run needs a -state file")
+    }
+
+    if len(opts.ReevaluateAfter) > 0 && opts.State == "" {
+        return fmt.Errorf("-reevaluate-after needs a -state file")
+    }
+    if hashAlgorithms[opts.HashAlgorithm] == nil {
+        return fmt.Errorf("invalid -hash-algorithm value %q (want %s)", opts.HashAlgorithm, hashAlgorithmNames())
+    }
+    if len(opts.VerifyHash) > 0 && len(opts.ReevaluateAfter) == 0 {
+        return fmt.Errorf("-verify-hash needs -reevaluate-after")
+    }
+
+    if opts.QuarantineAfter < 0 {
+        return fmt.Errorf("invalid -quarantine-after value %d", opts.QuarantineAfter)
+    }
+
+    if opts.LogKeep < 0 {
+        return fmt.Errorf("invalid -log-keep value %d", opts.LogKeep)
+    }
+
+    if opts.FixDrift && opts.State == "" {
+        return fmt.Errorf("-fix-drift needs a -state file")
+    }
+
+    if opts.WritePlan != "" && opts.ApplyPlan != "" {
+        return fmt.Errorf("-write-plan and -apply-plan cannot be combined")
+    }
+    if opts.mode != MODE_AUTO && opts.ApplyPlan != "" {
+        return fmt.Errorf("-apply-plan cannot be combined with %s", opts.mode)
+    }
+    if opts.DecompressDirectories && opts.mode != MODE_DECOMPRESS {
+        return fmt.Errorf("-decompress-directories needs the decompress subcommand")
+    }
+    if examiningOnly() && opts.WritePlan != "" {
+        return fmt.Errorf("-write-plan cannot be combined with %s", opts.mode)
+    }
+    if (opts.mode == MODE_INVENTORY) != (opts.Inventory != "") {
+        return fmt.Errorf("the inventory subcommand needs -inventory, which only it takes")
+    }
+    if opts.FilesFrom != "" {
+        if opts.ApplyPlan != "" || opts.AllVolumes {
+            return fmt.Errorf("-files-from cannot be combined with -apply-plan or -all-volumes")
+        }
+        files, err := readFileList(opts.FilesFrom)
+        if err != nil {
+            return fmt.Errorf("reading -files-from %s: %v", opts.FilesFrom, err)
+        }
+        opts.Files = files
+    }
+
+    // The folder comes from the plan when applying one
+    if opts.ApplyPlan != "" && fs.NArg() == 0 {
+        return nil
+    }
+
+    // CompactOS covers the Windows folder unless told otherwise
+    if opts.CompactOS && fs.NArg() == 0 {
+        opts.Roots = []string{os.Getenv("SystemRoot")}
+        return nil
+    }
+
+    if opts.AllVolumes {
+        if fs.NArg() > 0 {
+            return fmt.Errorf("-all-volumes cannot be combined with folders")
+        }
+        roots, err := localNtfsVolumes()
+        if err != nil {
+            return fmt.Errorf("listing volumes: %v", err)
+        }
+        if len(roots) == 0 {
+            return fmt.Errorf("no fixed NTFS volumes found")
+        }
+        opts.Roots = roots
+        return nil
+    }
+
+    if fs.NArg() == 0 && len(opts.Files) == 0 {
+        fs.Usage()
+        return flag.ErrHelp
+    }
+    // Files given on their own are processed without a walk
+    for _, root := range fs.Args() {
+        root = volumeRoot(cleanDroppedPath(root))
+        if isFile(root) {
+            opts.Files = append(opts.Files, root)
+            continue
+        }
+        opts.Roots = append(opts.Roots, root)
+    }
+    if opts.ApplyPlan != "" && len(opts.Files) > 0 {
+        return fmt.Errorf("-apply-plan takes folders, not files")
+    }
+
+    // Started by dropping a folder onto the executable: nobody can press
+    // space for a snapshot before knowing about it
+    if droppedOnto() && !flagSet(fs, "status-interval") && opts.StatusInterval == 0 {
+        opts.StatusInterval = OWN_CONSOLE_STATUS_INTERVAL
+    }
+
+    return nil
+}
+
+// applying reports whether this run changes compression state, as opposed
+// to a dry run, writing a plan, only recommending or reporting the status.
+func (o *Options) applying() bool {
+    return o.WritePlan == "" && !o.DryRun && !o.recommendOnly && o.mode != MODE_ANALYZE && o.mode != MODE_STATUS && o.mode != MODE_INVENTORY
+}
+
+// sizeValue implements flag.Value for byte counts that may be given with a
+// binary unit and an optional B, e.g. 100B, 64K, 10MB or 1.5G.
+type sizeValue int64
+
+func (s *sizeValue) String() string {
+    return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeValue) Set(value string) error {
+    invalid := fmt.Errorf("invalid size %q (want a number of bytes or one such as 100B, 64K, 10M, 2G)", value)
+    number := strings.TrimSuffix(strings.ToUpper(value), "B")
+    multiplier := int64(1)
+    if n := len(number); n > 0 {
+        switch number[n-1] {
+        case 'K':
+            multiplier = 1 << 10
+        case 'M':
+            multiplier = 1 << 20
+        case 'G':
+            multiplier = 1 << 30
+        case 'T':
+            multiplier = 1 << 40
+        }
+        if multiplier > 1 {
+            number = number[:n-1]
+        }
+    }
+
+    // Plain decimals only: no signs, exponents, Inf or NaN
+    whole, fraction, _ := strings.Cut(number, ".")
+    if whole == "" || strings.Trim(whole, "0123456789") != "" || strings.Trim(fraction, "0123456789") != "" {
+        return invalid
+    }
+    r, ok := new(big.Rat).SetString(number)
+    if !ok {
+        return invalid
+    }
+    r.Mul(r, new(big.Rat).SetInt64(multiplier))
+    n := new(big.Int).Quo(r.Num(), r.Denom())
+    if !n.IsInt64() {
+        return fmt.Errorf("size %q is too large", value)
+    }
+    *s = sizeValue(n.Int64())
+    return nil
+}
+
+// repeatableValue is a flag.Value collecting every use of a repeatable
+// option. reset empties it, so that policy can replace the list instead of
+// adding to it.
+type repeatableValue interface {
+    flag.Value
+    reset()
+}
+
+// flagSet reports whether the flag called name was set, on the command line
+// or by policy.
+func flagSet(fs *flag.FlagSet, name string) bool {
+    set := false
+    fs.Visit(func(f *flag.Flag) {
+        if f.Name == name {
+            set = true
+        }
+    })
+    return set
+}
+
+// defaultWorkers scales the worker count with the machine, capped so large
+// servers don't flood a single volume.
+func defaultWorkers() int {
+    return min(WORKERS_PER_CPU*runtime.NumCPU(), MAX_DEFAULT_WORKERS)
+}
+
+// validRunName restricts run names to characters that are safe to use in
+// file names and registry keys.
+func validRunName(name string) bool {
+    for _, r := range name {
+        switch {
+        case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+        case r == '.', r == '-', r == '_':
+        default:
+            return false
+        }
+    }
+    return true
+}
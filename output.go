@@ -0,0 +1,101 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "os"
+    "time"
+)
+
+const (
+    OUTPUT_TEXT = "text"
+    OUTPUT_JSON = "json"
+)
+
+// jsonSummary is what -output json prints at the end of the run instead of
+// the text summary, for PowerShell and monitoring scripts.
+type jsonSummary struct {
+    RunName   string        `json:"run_name,omitempty"`
+    Mode      string        `json:"mode,omitempty"`
+    Roots     []string      `json:"roots"`
+    Applying  bool          `json:"applying"`
+    StartTime time.Time     `json:"start_time"`
+    EndTime   time.Time     `json:"end_time"`
+    Aborted   bool          `json:"aborted"`
+    Totals    statsSnapshot `json:"totals"`
+    PerRoot   []rootSummary `json:"per_root"`
+    Errors    []fileError   `json:"errors"`
+    Skipped   []fileError   `json:"skipped"`
+    Resources resourceUsage `json:"resources"`
+    Files     []jsonFile    `json:"files,omitempty"`
+}
+
+// jsonStdout is where the JSON summary goes for -output json and
+// -json-summary -. Any JSON summary moves all other output, the text
+// summary included, to the standard error.
+var jsonStdout io.Writer = os.Stdout
+
+// jsonFile is the record of one file, with -output-files.
+type jsonFile struct {
+    Path   string     `json:"path"`
+    Size   int64      `json:"size"`
+    Saved  int64      `json:"saved"`
+    Action string     `json:"action,omitempty"`
+    Result resultCode `json:"result"`
+}
+
+func printJSONSummary(w io.Writer, summary statsSnapshot, usage resourceUsage, startTime time.Time, endTime time.Time) error {
+    s := jsonSummary{
+        RunName:   opts.RunName,
+        Mode:      opts.mode,
+        Roots:     redactPaths(opts.Roots),
+        Applying:  opts.applying(),
+        StartTime: startTime.UTC(),
+        EndTime:   endTime.UTC(),
+        Aborted:   breaker.aborted(),
+        Totals:    summary,
+        PerRoot:   rootSummaries(opts.Roots),
+        Errors:    []fileError{},
+        Skipped:   []fileError{},
+        Resources: usage,
+    }
+
+    for i := range s.PerRoot {
+        s.PerRoot[i].Root = redactPath(s.PerRoot[i].Root, false)
+    }
+
+    stats.mu.Lock()
+    for _, shard := range stats.shards {
+        s.Errors = append(s.Errors, redactErrors(shard.errors)...)
+        s.Skipped = append(s.Skipped, redactErrors(shard.skipped)...)
+    }
+    stats.mu.Unlock()
+
+    if opts.OutputFiles {
+        for _, rec := range collectRecords() {
+            s.Files = append(s.Files, jsonFile{Path: redactPath(rec.Path, true), Size: rec.Size, Saved: rec.Saved, Action: rec.Action, Result: rec.Result})
+        }
+    }
+
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(s)
+}
+
+// writeJSONSummary writes the JSON summary for -json-summary, to the
+// standard output for -, else to a file.
+func writeJSONSummary(path string, summary statsSnapshot, usage resourceUsage, startTime time.Time, endTime time.Time) error {
+    if path == "-" {
+        return printJSONSummary(jsonStdout, summary, usage, startTime, endTime)
+    }
+
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if err := printJSONSummary(f, summary, usage, startTime, endTime); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
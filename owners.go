@@ -0,0 +1,156 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+
+    "golang.org/x/sys/windows"
+)
+
+// ownerKey is a file owner on one volume; quotas are kept per volume.
+type ownerKey struct {
+    volume string // e.g. C:
+    sid    string
+}
+
+// collectOwners reports whether savings have to be attributed to owners.
+func collectOwners() bool {
+    return opts.QuotaReport || opts.OwnerReport || opts.FsrmReport != ""
+}
+
+// ownerFilter implements flag.Value for repeatable -owner values, accounts
+// (DOMAIN\user, or a group) or SID strings. They are resolved to SIDs when
+// parsed, so the walk only compares strings.
+type ownerFilter map[string]bool
+
+func (f *ownerFilter) String() string {
+    var sids []string
+    for sid := range *f {
+        sids = append(sids, sid)
+    }
+    sort.Strings(sids)
+    return strings.Join(sids, ",")
+}
+
+func (f *ownerFilter) Set(value string) error {
+    sid, err := windows.StringToSid(value)
+    if err != nil {
+        sid, _, _, err = windows.LookupSID("", value)
+        if err != nil {
+            return fmt.Errorf("unknown account %q: %v", value, err)
+        }
+    }
+    if *f == nil {
+        *f = ownerFilter{}
+    }
+    (*f)[sid.String()] = true
+    return nil
+}
+
+func (f *ownerFilter) reset() {
+    *f = nil
+}
+
+// matches reports whether path is owned by one of the filter's SIDs. Files
+// whose owner can't be read don't match.
+func (f ownerFilter) matches(path string) bool {
+    sid, err := fileOwner(path)
+    return err == nil && f[sid]
+}
+
+// accountNames caches resolved SIDs; lookups may go to a domain controller.
+var accountNames sync.Map
+
+// fileOwner returns the SID of the owner of path.
+func fileOwner(path string) (string, error) {
+    sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION)
+    if err != nil {
+        return "", err
+    }
+    owner, _, err := sd.Owner()
+    if err != nil {
+        return "", err
+    }
+    return owner.String(), nil
+}
+
+// recordOwnerSaving adds the space saved for a file to its owner in the
+// worker's shard. Files whose owner can't be read are left out.
+func recordOwnerSaving(shard *statsShard, path string, saved int64) {
+    if !collectOwners() {
+        return
+    }
+    sid, err := fileOwner(path)
+    if err != nil {
+        return
+    }
+    if shard.ownerSavings == nil {
+        shard.ownerSavings = map[ownerKey]int64{}
+    }
+    shard.ownerSavings[ownerKey{volume: strings.ToUpper(filepath.VolumeName(path)), sid: sid}] += saved
+}
+
+// mergedOwnerSavings sums the savings per owner of all workers.
+func mergedOwnerSavings() map[ownerKey]int64 {
+    stats.mu.Lock()
+    defer stats.mu.Unlock()
+
+    merged := map[ownerKey]int64{}
+    for _, shard := range stats.shards {
+        for key, saved := range shard.ownerSavings {
+            merged[key] += saved
+        }
+    }
+    return merged
+}
+
+// accountName returns DOMAIN\user for a SID string, or the SID itself when
+// it doesn't resolve (deleted accounts, unreachable domain).
+func accountName(sidString string) string {
+    if name, ok := accountNames.Load(sidString); ok {
+        return name.(string)
+    }
+
+    name := sidString
+    if sid, err := windows.StringToSid(sidString); err == nil {
+        if account, domain, _, err := sid.LookupAccount(""); err == nil {
+            name = account
+            if domain != "" {
+                name = domain + `\` + account
+            }
+        }
+    }
+    accountNames.Store(sidString, name)
+    return name
+}
+
+// savingsByOwner sums the savings of each owner over all volumes, keyed by
+// account name.
+func savingsByOwner() map[string]int64 {
+    byOwner := map[string]int64{}
+    for key, saved := range mergedOwnerSavings() {
+        byOwner[accountName(key.sid)] += saved
+    }
+    return byOwner
+}
+
+// printOwnerSavings lists the n owners whose data gained the most space.
+func printOwnerSavings(n int) {
+    byOwner := savingsByOwner()
+    owners := make([]string, 0, len(byOwner))
+    for owner := range byOwner {
+        owners = append(owners, owner)
+    }
+    sort.Slice(owners, func(i, j int) bool { return byOwner[owners[i]] > byOwner[owners[j]] })
+    if len(owners) == 0 {
+        return
+    }
+
+    fmt.Printf("\nTop owners by savings:\n")
+    for _, owner := range owners[:min(n, len(owners))] {
+        fmt.Printf("  %15d bytes saved  %s\n", byOwner[owner], owner)
+    }
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+)
+
+// globList implements flag.Value for repeatable glob patterns such as
+// *.mp4, node_modules\** or C:\Data\Temp\*. Patterns are matched per path
+// component without regard to case, ** matching any number of components.
+// Patterns without a drive or share match at any depth; / and \ are the same.
+type globList struct {
+    raw      []string
+    patterns [][]string
+}
+
+func (g *globList) String() string {
+    return strings.Join(g.raw, ",")
+}
+
+func (g *globList) Set(value string) error {
+    pattern := strings.ToLower(filepath.FromSlash(value))
+    parts := strings.Split(strings.TrimRight(pattern, `\`), `\`)
+    for _, part := range parts {
+        if _, err := filepath.Match(part, ""); err != nil {
+            return fmt.Errorf("invalid pattern %q: %v", value, err)
+        }
+    }
+    if filepath.VolumeName(pattern) == "" {
+        parts = append([]string{"**"}, parts...)
+    }
+
+    g.raw = append(g.raw, value)
+    g.patterns = append(g.patterns, parts)
+    return nil
+}
+
+func (g *globList) redacted() string {
+    parts := make([]string, len(g.raw))
+    for i, pattern := range g.raw {
+        parts[i] = redactPath(pattern, false)
+    }
+    return strings.Join(parts, ",")
+}
+
+func (g *globList) reset() {
+    g.raw, g.patterns = nil, nil
+}
+
+// matches reports whether any of the patterns matches path.
+func (g *globList) matches(path string) bool {
+    if len(g.patterns) == 0 {
+        return false
+    }
+
+    parts := strings.Split(stateKey(path), `\`)
+    for _, pattern := range g.patterns {
+        if globMatch(pattern, parts) {
+            return true
+        }
+    }
+    return false
+}
+
+// globMatch matches path components against pattern components.
+func globMatch(pattern []string, parts []string) bool {
+    if len(pattern) == 0 {
+        return len(parts) == 0
+    }
+    if pattern[0] == "**" {
+        for i := 0; i <= len(parts); i++ {
+            if globMatch(pattern[1:], parts[i:]) {
+                return true
+            }
+        }
+        return false
+    }
+    if len(parts) == 0 {
+        return false
+    }
+    if ok, _ := filepath.Match(pattern[0], parts[0]); !ok {
+        return false
+    }
+    return globMatch(pattern[1:], parts[1:])
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const PLAN_VERSION = 2
+
+// planMigrations upgrade a plan from the version they are keyed by to the
+// next one. Versions are bumped whenever older binaries would misapply a
+// newer plan, so they refuse it instead.
+var planMigrations = map[int]func(p *plan){
+    // Version 2 replaced the single root with a list and added relative paths
+    1: func(p *plan) {
+        if len(p.Roots) == 0 && p.Root != "" {
+            p.Roots = []string{p.Root}
+        }
+        p.Root = ""
+    },
+}
+
+// plan is a set of compression decisions made by one run (-write-plan) and
+// carried out later, possibly on another machine (-apply-plan).
+type plan struct {
+    Version int         `json:"version"`
+    Created time.Time   `json:"created"`
+    Roots   []string    `json:"roots"`
+    Root    string      `json:"root,omitempty"` // Single root of version 1 plans
+    RunName string      `json:"run_name,omitempty"`
+    Entries []planEntry `json:"entries"`
+
+    // Entry paths are relative to Roots[RootIndex], so the plan can be
+    // applied to a replica of the tree at another location
+    RelativePaths bool `json:"relative_paths,omitempty"`
+}
+
+type planEntry struct {
+    Path          string    `json:"path"`
+    RootIndex     int       `json:"root_index,omitempty"`
+    Action        string    `json:"action"`
+    Size          int64     `json:"size"`
+    EstimatedSize int64     `json:"estimated_size"`
+    ModTime       time.Time `json:"mod_time"`
+}
+
+// planEnvelope is the on-disk form of a plan. The signature is an Ed25519
+// signature, base64 encoded, over the exact bytes of the plan field, so any
+// edit to the plan after signing is detected.
+type planEnvelope struct {
+    Plan      json.RawMessage `json:"plan"`
+    Signature string          `json:"signature,omitempty"`
+}
+
+// writePlan saves p to path, signing it when a key is given.
+func writePlan(path string, p *plan, key *signingKey) error {
+    data, err := json.Marshal(p)
+    if err != nil {
+        return err
+    }
+
+    envelope := planEnvelope{Plan: data}
+    if key != nil {
+        signature, err := key.sign(data)
+        if err != nil {
+            return err
+        }
+        envelope.Signature = base64.StdEncoding.EncodeToString(signature)
+    }
+
+    out, err := json.Marshal(envelope)
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(path, out, 0644)
+}
+
+// readPlan loads a plan from path. When a key is configured only plans
+// carrying a valid signature for that key are accepted.
+func readPlan(path string, key *signingKey) (*plan, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var envelope planEnvelope
+    if err := json.Unmarshal(data, &envelope); err != nil {
+        return nil, fmt.Errorf("parsing plan %s: %v", path, err)
+    }
+
+    if key != nil {
+        if envelope.Signature == "" {
+            return nil, fmt.Errorf("plan %s is not signed", path)
+        }
+        signature, err := base64.StdEncoding.DecodeString(envelope.Signature)
+        if err != nil || !key.verify(envelope.Plan, signature) {
+            return nil, fmt.Errorf("plan %s has an invalid signature", path)
+        }
+    }
+
+    var p plan
+    if err := json.Unmarshal(envelope.Plan, &p); err != nil {
+        return nil, fmt.Errorf("parsing plan %s: %v", path, err)
+    }
+    if p.Version > PLAN_VERSION {
+        return nil, fmt.Errorf("plan %s was written by a newer version (%d, this one supports %d)", path, p.Version, PLAN_VERSION)
+    }
+    for p.Version < PLAN_VERSION {
+        migrate, ok := planMigrations[p.Version]
+        if !ok {
+            return nil, fmt.Errorf("plan %s has unsupported version %d", path, p.Version)
+        }
+        migrate(&p)
+        p.Version++
+    }
+    return &p, nil
+}
+
+// collectPlan gathers the entries recorded by every worker.
+func collectPlan(roots []string) *plan {
+    p := &plan{
+        Version: PLAN_VERSION,
+        Created: time.Now().UTC(),
+        Roots:   roots,
+        RunName: opts.RunName,
+
+        RelativePaths: opts.RelativePaths,
+    }
+
+    stats.mu.Lock()
+    for _, shard := range stats.shards {
+        p.Entries = append(p.Entries, shard.plan...)
+    }
+    stats.mu.Unlock()
+
+    if p.RelativePaths {
+        for i := range p.Entries {
+            entry := &p.Entries[i]
+            if index, rel, ok := relativeToRoot(roots, entry.Path); ok {
+                entry.RootIndex = index
+                entry.Path = rel
+            }
+        }
+    }
+
+    return p
+}
+
+// resolvePlanRoots checks that the roots a plan is applied to can stand in
+// for the roots it was written for. A relative plan can be applied to
+// several replicas at once by giving the folders of each in turn.
+func resolvePlanRoots(p *plan, roots []string) error {
+    if !p.RelativePaths {
+        if len(roots) != len(p.Roots) {
+            return fmt.Errorf("plan has absolute paths and can only be applied to its own folders")
+        }
+        // The folders given are the ones checked and locked, so they have
+        // to be the ones the entries are in
+        for i := range roots {
+            if stateKey(roots[i]) != stateKey(p.Roots[i]) {
+                return fmt.Errorf("plan has absolute paths and can only be applied to its own folders, not %s instead of %s", roots[i], p.Roots[i])
+            }
+        }
+        return nil
+    }
+    if len(p.Roots) == 0 || len(roots)%len(p.Roots) != 0 {
+        return fmt.Errorf("plan was written for %d folders but %d were given", len(p.Roots), len(roots))
+    }
+    return nil
+}
+
+// insidePlanRoots reports whether a planned entry stays below the plan's
+// folders, so a hand-edited plan can't reach files elsewhere: a relative
+// path mustn't be absolute or climb out with .., an absolute one has to
+// be below one of the roots.
+func insidePlanRoots(p *plan, entry planEntry) bool {
+    if !p.RelativePaths {
+        key := stateKey(entry.Path)
+        for _, root := range p.Roots {
+            if within(stateKey(root), key) {
+                return true
+            }
+        }
+        return false
+    }
+    if entry.RootIndex < 0 || entry.RootIndex >= len(p.Roots) || filepath.IsAbs(entry.Path) || filepath.VolumeName(entry.Path) != "" {
+        return false
+    }
+    root := stateKey(p.Roots[entry.RootIndex])
+    return within(root, stateKey(filepath.Join(root, entry.Path)))
+}
+
+// applyPlan carries out the actions of a plan below roots, which stand in
+// for the plan's roots (once per replica) when its paths are relative.
+// Entries whose file changed since the plan was written are skipped as
+// active.
+func applyPlan(p *plan, roots []string) {
+    replicas := [][]string{roots}
+    if p.RelativePaths {
+        replicas = replicaRoots(p, roots)
+    }
+
+    runWorkers(func(paths chan<- fileTask) {
+        for _, entry := range p.Entries {
+            if entry.Action != ACTION_COMPRESS && entry.Action != ACTION_DECOMPRESS {
+                noticef("Ignoring unknown planned action %q for %s\n", entry.Action, entry.Path)
+                continue
+            }
+            if !insidePlanRoots(p, entry) {
+                noticef("Ignoring planned entry %s outside the plan's folders\n", entry.Path)
+                continue
+            }
+            if isReplicationOwned(entry.Path) {
+                continue
+            }
+
+            // Each replica's copy of a file is queued in turn
+            for _, replica := range replicas {
+                path := entry.Path
+                if p.RelativePaths {
+                    path = filepath.Join(replica[entry.RootIndex], path)
+                }
+                if ignored, by := ignoredByFolders(path); ignored {
+                    debugf("Skipping %s, ignored by %s\n", path, by)
+                    continue
+                }
+                task := fileTask{
+                    path:       path,
+                    modTime:    entry.ModTime,
+                    size:       entry.Size,
+                    action:     entry.Action,
+                    spaceSaved: entry.Size - entry.EstimatedSize,
+                }
+                select {
+                case paths <- task:
+                    countQueued(task)
+                case <-stopWalk:
+                    return
+                }
+            }
+        }
+    })
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "strconv"
+
+    "golang.org/x/sys/windows/registry"
+)
+
+// Group Policy / Intune managed settings. Each value under the key is named
+// after a command-line option (without the leading dash) and overrides
+// whatever was passed on the command line:
+//
+//   REG_SZ, REG_EXPAND_SZ  string, duration and number options
+//   REG_DWORD, REG_QWORD   number options; 0/1 for on/off options
+//   REG_MULTI_SZ           options that may be repeated, one entry per value,
+//                          replacing the list given elsewhere
+const POLICY_REGISTRY_KEY = `SOFTWARE\Policies\ntfs_pancake`
+
+// applyPolicy applies the managed settings found in the policy key to fs.
+func applyPolicy(fs *flag.FlagSet) error {
+    return applyPolicyKey(fs, POLICY_REGISTRY_KEY)
+}
+
+// applyPolicyKey applies the managed settings under path to fs. Subcommands
+// have their own subkey named after them.
+func applyPolicyKey(fs *flag.FlagSet, path string) error {
+    key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+    if err == registry.ErrNotExist {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("opening policy key: %v", err)
+    }
+    defer key.Close()
+
+    names, err := key.ReadValueNames(0)
+    if err != nil {
+        return fmt.Errorf("reading policy key: %v", err)
+    }
+
+    for _, name := range names {
+        if fs.Lookup(name) == nil {
+            noticef("Ignoring unknown policy setting %s\n", name)
+            continue
+        }
+
+        values, err := readPolicyValue(key, name)
+        if err != nil {
+            return fmt.Errorf("policy setting %s: %v", name, err)
+        }
+        // A repeatable option is emptied first and then set once per
+        // entry, so the policy's list replaces the one from the command
+        // line and config file
+        if r, ok := fs.Lookup(name).Value.(repeatableValue); ok {
+            r.reset()
+        }
+        for _, value := range values {
+            if err := fs.Set(name, value); err != nil {
+                return fmt.Errorf("policy setting %s: %v", name, err)
+            }
+        }
+        noticef("Policy sets -%s\n", name)
+    }
+
+    return nil
+}
+
+func readPolicyValue(key registry.Key, name string) ([]string, error) {
+    _, valtype, err := key.GetValue(name, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    switch valtype {
+    case registry.SZ, registry.EXPAND_SZ:
+        value, _, err := key.GetStringValue(name)
+        if err != nil {
+            return nil, err
+        }
+        if valtype == registry.EXPAND_SZ {
+            if value, err = registry.ExpandString(value); err != nil {
+                return nil, err
+            }
+        }
+        return []string{value}, nil
+    case registry.DWORD, registry.QWORD:
+        value, _, err := key.GetIntegerValue(name)
+        if err != nil {
+            return nil, err
+        }
+        return []string{strconv.FormatUint(value, 10)}, nil
+    case registry.MULTI_SZ:
+        values, _, err := key.GetStringsValue(name)
+        return values, err
+    default:
+        return nil, fmt.Errorf("unsupported registry value type %d", valtype)
+    }
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "golang.org/x/sys/windows"
+)
+
+const (
+    PROGRESS_REFRESH_INTERVAL = time.Second      // Redraws of the progress line on a console
+    PROGRESS_LINE_INTERVAL    = 30 * time.Second // Lines printed instead when redirected
+)
+
+// Files queued for the workers so far, for -progress; listed is set once
+// every file to process has been queued.
+var progress struct {
+    files  atomic.Int64
+    bytes  atomic.Int64
+    listed atomic.Bool
+}
+
+// countQueued counts a file handed to the workers.
+func countQueued(task fileTask) {
+    progress.files.Add(1)
+    progress.bytes.Add(task.size)
+}
+
+// countFinished counts a file the worker is done with, whatever the result.
+func (s *statsShard) countFinished(task fileTask) {
+    s.filesFinished.Add(1)
+    s.bytesFinished.Add(task.size)
+}
+
+// progressLine describes how far the run got and how long the rest should
+// take at the throughput so far.
+func progressLine(s statsSnapshot, elapsed time.Duration) string {
+    files, bytes := progress.files.Load(), progress.bytes.Load()
+    line := fmt.Sprintf("Progress: %d/%d files, %s/%s", s.FilesFinished, files, humanBytes(s.BytesFinished), humanBytes(bytes))
+    if bytes > 0 {
+        line += fmt.Sprintf(" (%s)", percent(s.BytesFinished, bytes))
+    }
+    if elapsed < time.Second || s.BytesFinished == 0 {
+        return line
+    }
+
+    rate := float64(s.BytesFinished) / elapsed.Seconds()
+    line += fmt.Sprintf(", %s/s", humanBytes(int64(rate)))
+    eta := time.Duration(float64(bytes-s.BytesFinished) / rate * float64(time.Second)).Round(time.Second)
+    if progress.listed.Load() {
+        line += fmt.Sprintf(", %v left", eta)
+    } else {
+        line += fmt.Sprintf(", at least %v left, still scanning", eta)
+    }
+    return line
+}
+
+// startProgress shows the progress of the run until the returned function
+// is called: redrawn in place on a console, or as a line every
+// PROGRESS_LINE_INTERVAL when the output is redirected, with -plain or with
+// other lines per file.
+func startProgress(startTime time.Time) func() {
+    var mode uint32
+    inPlace := windows.GetConsoleMode(windows.Stdout, &mode) == nil && !opts.Plain && opts.Verbosity < VERBOSITY_VERBOSE
+    interval := PROGRESS_LINE_INTERVAL
+    if inPlace {
+        interval = PROGRESS_REFRESH_INTERVAL
+    }
+
+    stop := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        width := 0
+        for {
+            select {
+            case <-ticker.C:
+                line := progressLine(stats.snapshot(), time.Since(startTime))
+                if !inPlace {
+                    fmt.Println(line)
+                    continue
+                }
+                // Blank out what is left of a longer previous line
+                fmt.Printf("\r%s%s", line, strings.Repeat(" ", max(width-len(line), 0)))
+                width = len(line)
+            case <-stop:
+                if width > 0 {
+                    fmt.Println()
+                }
+                return
+            }
+        }
+    }()
+
+    return func() {
+        close(stop)
+        <-stopped
+    }
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "time"
+)
+
+const (
+    DEFAULT_QUARANTINE_AFTER = 3
+    DEFAULT_QUARANTINE_TTL   = 30 * 24 * time.Hour
+    MAX_QUARANTINE_LISTED    = 20 // Quarantined files listed in the summary
+)
+
+// fileFailure counts the consecutive runs in which processing a file failed.
+type fileFailure struct {
+    Count  int        `json:"count"`
+    First  time.Time  `json:"first"`
+    Last   time.Time  `json:"last"`
+    Result resultCode `json:"result"`
+}
+
+// ageValue implements flag.Value for durations that may be given in days.
+type ageValue time.Duration
+
+func (a *ageValue) String() string {
+    return time.Duration(*a).String()
+}
+
+func (a *ageValue) Set(value string) error {
+    d, err := parseAge(value)
+    if err != nil {
+        return err
+    }
+    *a = ageValue(d)
+    return nil
+}
+
+// quarantined reports whether a file failed in enough consecutive runs to
+// be left alone until its quarantine expires.
+func quarantined(task fileTask) bool {
+    if state == nil || opts.QuarantineAfter <= 0 {
+        return false
+    }
+    failure, ok := state.Failures[stateKey(task.path)]
+    return ok && failure.Count >= opts.QuarantineAfter &&
+        time.Since(failure.Last) < time.Duration(opts.QuarantineTTL)
+}
+
+// recordOutcome updates the failure history of a file in the worker's
+// shard; a nil entry clears the history when the state is merged.
+func recordOutcome(shard *statsShard, task fileTask, result resultCode) {
+    key := stateKey(task.path)
+    last, failedBefore := state.Failures[key]
+    if !result.isError() {
+        if failedBefore {
+            if shard.failureUpdates == nil {
+                shard.failureUpdates = map[string]*fileFailure{}
+            }
+            shard.failureUpdates[key] = nil
+        }
+        return
+    }
+
+    now := time.Now().UTC()
+    failure := &fileFailure{Count: 1, First: now, Last: now, Result: result}
+
+    // A failure after the quarantine expired starts counting afresh
+    if failedBefore && last.Count < opts.QuarantineAfter {
+        failure.Count = last.Count + 1
+        failure.First = last.First
+    }
+    if shard.failureUpdates == nil {
+        shard.failureUpdates = map[string]*fileFailure{}
+    }
+    shard.failureUpdates[key] = failure
+}
+
+// printQuarantine lists the files skipped as quarantined in this run.
+func printQuarantine() {
+    stats.mu.Lock()
+    var paths []string
+    for _, shard := range stats.shards {
+        paths = append(paths, shard.quarantined...)
+    }
+    stats.mu.Unlock()
+    if len(paths) == 0 {
+        return
+    }
+
+    sort.Strings(paths)
+    fmt.Printf("\nQuarantined after failing in %d runs (retried after %v):\n", opts.QuarantineAfter, time.Duration(opts.QuarantineTTL))
+    for _, path := range paths[:min(len(paths), MAX_QUARANTINE_LISTED)] {
+        failure := state.Failures[stateKey(path)]
+        fmt.Printf("  %-20s since %s  %s\n", failure.Result, failure.First.Local().Format("2006-01-02"), displayPath(path))
+    }
+    if len(paths) > MAX_QUARANTINE_LISTED {
+        fmt.Printf("  ... and %d more\n", len(paths)-MAX_QUARANTINE_LISTED)
+    }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "hash"
+    "hash/crc32"
+    "hash/fnv"
+    "io"
+    "sort"
+    "strings"
+)
+
+const (
+    QUICK_HASH_CHUNK = 64 * 1024 // Bytes hashed at the start, middle and end
+    QUICK_HASH_BYTES = 16        // Of the sum kept in the state
+
+    HASH_SHA256 = "sha256" // Uses the SHA extensions of the CPU where present
+    HASH_CRC32C = "crc32c" // Uses the CRC32 instructions of SSE 4.2 and ARMv8, the fastest
+    HASH_FNV    = "fnv"    // FNV-1a 128, plain Go but far cheaper than SHA-256 without SHA extensions
+)
+
+// hashAlgorithms are the choices of -hash-algorithm.
+var hashAlgorithms = map[string]func() hash.Hash{
+    HASH_SHA256: sha256.New,
+    HASH_CRC32C: func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+    HASH_FNV:    fnv.New128a,
+}
+
+// hashAlgorithmNames lists the choices of -hash-algorithm for messages.
+func hashAlgorithmNames() string {
+    names := make([]string, 0, len(hashAlgorithms))
+    for name := range hashAlgorithms {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ", ")
+}
+
+// hashDirs implements flag.Value for repeatable -verify-hash folders, below
+// which unchanged-looking files are also checked by content.
+type hashDirs []string
+
+func (h *hashDirs) String() string {
+    return strings.Join(*h, ",")
+}
+
+func (h *hashDirs) Set(value string) error {
+    *h = append(*h, stateKey(value))
+    return nil
+}
+
+func (h *hashDirs) redacted() string {
+    return strings.Join(redactPaths(*h), ",")
+}
+
+func (h *hashDirs) reset() {
+    *h = nil
+}
+
+// covers reports whether the state key of a file is below one of the folders.
+func (h hashDirs) covers(key string) bool {
+    for _, dir := range h {
+        if key == dir || within(dir, key) {
+            return true
+        }
+    }
+    return false
+}
+
+// quickHash hashes the size and three chunks of a file, enough to notice
+// content rewritten by applications that restore the modification time,
+// without reading files in full.
+func quickHash(path string, size int64, times *ioTimings) (string, error) {
+    waitForQuietDisk(path)
+    readSlots.acquire()
+    defer readSlots.release()
+
+    f, err := openForRead(path, times)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+
+    h := hashAlgorithms[opts.HashAlgorithm]()
+    fmt.Fprintf(h, "%d:", size)
+    buf := make([]byte, QUICK_HASH_CHUNK)
+    for _, offset := range []int64{0, size/2 - QUICK_HASH_CHUNK/2, size - QUICK_HASH_CHUNK} {
+        offset = max(offset, 0)
+        n, err := f.ReadAt(buf, offset)
+        if err != nil && err != io.EOF {
+            return "", err
+        }
+        h.Write(buf[:n])
+    }
+    sum := h.Sum(nil)
+    digest := hex.EncodeToString(sum[:min(len(sum), QUICK_HASH_BYTES)])
+    // Hashes of other algorithms never match those recorded with SHA-256,
+    // which were written without a prefix, so switching re-verifies files
+    if opts.HashAlgorithm != HASH_SHA256 {
+        digest = opts.HashAlgorithm + ":" + digest
+    }
+    return digest, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "path/filepath"
+    "sort"
+    "strings"
+    "unsafe"
+
+    "golang.org/x/sys/windows"
+)
+
+const (
+    FILE_VOLUME_QUOTAS     = 0x00000020
+    STATUS_NO_MORE_ENTRIES = 0x8000001A
+    QUOTA_BUFFER_SIZE      = 64 << 10
+
+    // FILE_QUOTA_INFORMATION field offsets
+    QUOTA_NEXT_ENTRY_OFFSET = 0
+    QUOTA_SID_LENGTH        = 4
+    QUOTA_USED              = 16
+    QUOTA_LIMIT             = 32
+    QUOTA_SID               = 40
+
+    QUOTA_NO_LIMIT = -1
+)
+
+// quotaEntry is the quota usage of one owner on a volume.
+type quotaEntry struct {
+    sid   string
+    used  int64
+    limit int64 // QUOTA_NO_LIMIT when unlimited
+}
+
+// readQuotas lists the quota entries of the volume mounted at volume
+// (e.g. C:). It needs administrative rights.
+func readQuotas(volume string) ([]quotaEntry, error) {
+    device, err := windows.UTF16PtrFromString(`\\.\` + volume)
+    if err != nil {
+        return nil, err
+    }
+    handle, err := windows.CreateFile(device, windows.GENERIC_READ, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil, windows.OPEN_EXISTING, 0, 0)
+    if err != nil {
+        return nil, err
+    }
+    defer windows.CloseHandle(handle)
+
+    var entries []quotaEntry
+    buf := make([]byte, QUOTA_BUFFER_SIZE)
+    for restart := true; ; restart = false {
+        status := ntQueryQuotaInformationFile(handle, buf, restart)
+        if status == STATUS_NO_MORE_ENTRIES {
+            return entries, nil
+        }
+        if status != 0 {
+            return nil, fmt.Errorf("NtQueryQuotaInformationFile failed with status 0x%x", status)
+        }
+
+        for offset := 0; offset < len(buf); {
+            entry := buf[offset:]
+            sidLength := int(binary.LittleEndian.Uint32(entry[QUOTA_SID_LENGTH:]))
+            if sidLength > 0 && QUOTA_SID+sidLength <= len(entry) {
+                sid := (*windows.SID)(unsafe.Pointer(&entry[QUOTA_SID]))
+                entries = append(entries, quotaEntry{
+                    sid:   sid.String(),
+                    used:  int64(binary.LittleEndian.Uint64(entry[QUOTA_USED:])),
+                    limit: int64(binary.LittleEndian.Uint64(entry[QUOTA_LIMIT:])),
+                })
+            }
+
+            next := int(binary.LittleEndian.Uint32(entry[QUOTA_NEXT_ENTRY_OFFSET:]))
+            if next == 0 {
+                break
+            }
+            offset += next
+        }
+    }
+}
+
+// printQuotaReport shows, for every volume with quotas enabled, the quota
+// usage of the owners with the most usage next to what compression saved
+// them in this run.
+func printQuotaReport(roots []string, n int) {
+    savings := mergedOwnerSavings()
+
+    seen := map[string]bool{}
+    for _, root := range roots {
+        absRoot, err := filepath.Abs(root)
+        if err != nil {
+            continue
+        }
+        volume := strings.ToUpper(filepath.VolumeName(absRoot))
+        if seen[volume] || !strings.HasSuffix(volume, ":") {
+            continue
+        }
+        seen[volume] = true
+
+        info, err := getVolumeInfo(root)
+        if err != nil || info.flags&FILE_VOLUME_QUOTAS == 0 {
+            fmt.Printf("\nNo disk quotas on %s\n", volume)
+            continue
+        }
+        entries, err := readQuotas(volume)
+        if err != nil {
+            fmt.Printf("\nError reading disk quotas of %s: %v\n", volume, err)
+            continue
+        }
+
+        sort.Slice(entries, func(i, j int) bool { return entries[i].used > entries[j].used })
+        fmt.Printf("\nDisk quota usage on %s:\n", volume)
+        for _, e := range entries[:min(n, len(entries))] {
+            limit := "no limit"
+            if e.limit != QUOTA_NO_LIMIT {
+                limit = fmt.Sprintf("%d", e.limit)
+            }
+            saved := savings[ownerKey{volume: volume, sid: e.sid}]
+            fmt.Printf("  %15d bytes used  %15s limit  %15d bytes saved  %s\n", e.used, limit, saved, accountName(e.sid))
+        }
+        fmt.Printf("  NTFS charges quotas by uncompressed size: savings free disk space but not quota\n")
+    }
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    RAMP_STEPS          = 12  // Increments the workers are added in over -ramp-up
+    RAMP_MAX_ERROR_RATE = 5.0 // Percent of failing files in a step that holds the ramp
+    RAMP_LATENCY_FACTOR = 3   // Slowdown against the first step that holds the ramp
+    RAMP_START_DIVISOR  = 8   // The ramp starts with this fraction of the workers
+)
+
+// rampGate holds back workers at the start of a run and lets them in step
+// by step while the error rate and latency stay reasonable, so antivirus
+// scanners and cold caches aren't hit by every worker at once.
+type rampGate struct {
+    active  atomic.Bool
+    mu      sync.Mutex
+    cond    *sync.Cond
+    allowed int
+
+    // Outcomes during the current step
+    files  atomic.Int64
+    errors atomic.Int64
+    nanos  atomic.Int64
+}
+
+var (
+    ramp     = newRampGate()
+    rampOnce sync.Once
+)
+
+func newRampGate() *rampGate {
+    r := &rampGate{}
+    r.cond = sync.NewCond(&r.mu)
+    return r
+}
+
+// wait blocks worker index until the ramp lets it in.
+func (r *rampGate) wait(index int) {
+    if !r.active.Load() {
+        return
+    }
+
+    r.mu.Lock()
+    for r.active.Load() && index >= r.allowed {
+        r.cond.Wait()
+    }
+    r.mu.Unlock()
+}
+
+// record counts the outcome and duration of one file while ramping.
+func (r *rampGate) record(result resultCode, took time.Duration) {
+    if !r.active.Load() {
+        return
+    }
+    r.files.Add(1)
+    r.nanos.Add(int64(took))
+    if result.isError() {
+        r.errors.Add(1)
+    }
+}
+
+func (r *rampGate) setAllowed(n int) {
+    r.mu.Lock()
+    r.allowed = n
+    r.mu.Unlock()
+    r.cond.Broadcast()
+}
+
+// finish lets every worker in, e.g. once there is nothing left to queue.
+func (r *rampGate) finish() {
+    r.mu.Lock()
+    r.active.Store(false)
+    r.mu.Unlock()
+    r.cond.Broadcast()
+}
+
+// start lets a few of total workers in and adds more every step of over,
+// holding whenever the last step failed or slowed down too much.
+func (r *rampGate) start(total int, over time.Duration) {
+    allowed := max(1, total/RAMP_START_DIVISOR)
+    if allowed >= total {
+        return
+    }
+    r.allowed = allowed
+    r.active.Store(true)
+    noticef("Ramping up from %d to %d workers over %v\n", allowed, total, over)
+
+    go func() {
+        increment := max(1, (total-allowed+RAMP_STEPS-1)/RAMP_STEPS)
+        ticker := time.NewTicker(max(over/RAMP_STEPS, time.Millisecond))
+        defer ticker.Stop()
+
+        var baseline time.Duration
+        for range ticker.C {
+            if !r.active.Load() {
+                return
+            }
+
+            files, errors, nanos := r.files.Swap(0), r.errors.Swap(0), r.nanos.Swap(0)
+            if files > 0 {
+                latency := time.Duration(nanos / files)
+                errorRate := float64(errors) / float64(files) * 100
+                if baseline == 0 {
+                    baseline = latency
+                }
+                if errorRate > RAMP_MAX_ERROR_RATE || latency > baseline*RAMP_LATENCY_FACTOR {
+                    noticef("Ramp-up holding at %d workers: %.1f%% errors, %v per file (%v at first)\n", allowed, errorRate, latency, baseline)
+                    continue
+                }
+            }
+
+            allowed = min(total, allowed+increment)
+            if allowed == total {
+                noticef("Ramp-up complete, %d workers\n", total)
+                r.finish()
+                return
+            }
+            r.setAllowed(allowed)
+        }
+    }()
+}
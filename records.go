@@ -0,0 +1,169 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// fileRecord is the outcome of processing one file, kept for per-file
+// reports.
+type fileRecord struct {
+    Path          string
+    Size          int64
+    EstimatedSize int64  // Estimated size once compressed, 0 when not estimated
+    Saved         int64  // Estimated bytes saved by compression, 0 otherwise
+    Action        string // Action taken (or planned), empty when the file was skipped
+    Result        resultCode
+
+    // Current state, only found by the inventory subcommand
+    Attributes uint32
+    Stored     int64
+    Format     string // See storedAs
+}
+
+// collectFileRecords reports whether workers need to keep a record of
+// every file for the reports requested.
+func collectFileRecords() bool {
+    return opts.Treemap != "" || opts.OutputFiles || opts.CSV != "" || opts.Inventory != ""
+}
+
+// collectRecords gathers the per-file records of every worker.
+func collectRecords() []fileRecord {
+    stats.mu.Lock()
+    defer stats.mu.Unlock()
+
+    var records []fileRecord
+    for _, shard := range stats.shards {
+        records = append(records, shard.files...)
+    }
+    return records
+}
+
+// treemapDir is a directory node while building the treemap export.
+type treemapDir struct {
+    files []fileRecord
+    dirs  map[string]*treemapDir
+}
+
+func (d *treemapDir) subdir(name string) *treemapDir {
+    if d.dirs == nil {
+        d.dirs = map[string]*treemapDir{}
+    }
+    sub, ok := d.dirs[name]
+    if !ok {
+        sub = &treemapDir{}
+        d.dirs[name] = sub
+    }
+    return sub
+}
+
+// export converts the node to the ncdu JSON layout: an array whose first
+// element describes the directory and whose remaining elements are file
+// objects or nested directory arrays. dsize is the projected allocation
+// after compression; pancake_saved and pancake_result are ignored by ncdu
+// but kept for tools that want the savings and outcome directly.
+func (d *treemapDir) export(name string) []interface{} {
+    node := []interface{}{map[string]interface{}{"name": name}}
+
+    sort.Slice(d.files, func(i, j int) bool { return d.files[i].Path < d.files[j].Path })
+    for _, rec := range d.files {
+        node = append(node, map[string]interface{}{
+            "name":           redactName(filepath.Base(rec.Path), true),
+            "asize":          rec.Size,
+            "dsize":          rec.Size - rec.Saved,
+            "pancake_saved":  rec.Saved,
+            "pancake_result": rec.Result,
+        })
+    }
+
+    names := make([]string, 0, len(d.dirs))
+    for name := range d.dirs {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        node = append(node, d.dirs[name].export(name))
+    }
+
+    return node
+}
+
+// writeTreemap writes an ncdu-compatible export (format 1.1) of the
+// records below the roots, which WinDirStat-style treemap viewers can
+// import. With several roots each becomes a top-level directory.
+func writeTreemap(path string, roots []string, records []fileRecord) error {
+    top := &treemapDir{}
+    topName := "ntfs_pancake"
+    if len(roots) == 1 {
+        topName = redactPath(filepath.Clean(roots[0]), false)
+    }
+
+    for _, rec := range records {
+        for _, root := range roots {
+            root = filepath.Clean(root)
+            rel, err := filepath.Rel(root, rec.Path)
+            if err != nil || strings.HasPrefix(rel, "..") {
+                continue
+            }
+
+            dir := top
+            if len(roots) > 1 {
+                dir = dir.subdir(redactPath(root, false))
+            }
+            parts := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+            for _, part := range parts {
+                if part != "." {
+                    dir = dir.subdir(redactName(part, false))
+                }
+            }
+            dir.files = append(dir.files, rec)
+            break
+        }
+    }
+
+    export := []interface{}{
+        1, 1,
+        map[string]interface{}{
+            "progname":  "ntfs_pancake",
+            "progver":   "1",
+            "timestamp": time.Now().Unix(),
+        },
+        top.export(topName),
+    }
+
+    data, err := json.Marshal(export)
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(path, data, 0644)
+}
+
+// writeRecordsCSV writes one row per file for spreadsheets. The estimate
+// and ratio are left empty for files that weren't estimated, and the error
+// column holds the result code of failed files.
+func writeRecordsCSV(path string, records []fileRecord) error {
+    sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+
+    header := []string{"path", "size", "estimated_size", "ratio", "action", "error"}
+    var rows [][]string
+    for _, rec := range records {
+        estimated, ratio := "", ""
+        if rec.EstimatedSize > 0 || rec.Size == 0 {
+            estimated = strconv.FormatInt(rec.EstimatedSize, 10)
+        }
+        if rec.EstimatedSize > 0 {
+            ratio = strconv.FormatFloat(float64(rec.Size-rec.EstimatedSize)/float64(rec.Size)*100, 'f', 2, 64)
+        }
+        errorCode := ""
+        if rec.Result.isError() {
+            errorCode = string(rec.Result)
+        }
+        rows = append(rows, []string{redactPath(rec.Path, true), strconv.FormatInt(rec.Size, 10), estimated, ratio, rec.Action, errorCode})
+    }
+    return writeCSV(path, header, rows)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// -redact hides names in exported reports so they can be shared outside the
+// team owning the data; sizes, extensions and the depth of paths are kept.
+const (
+    REDACT_NONE = ""
+    REDACT_HASH = "hash" // The same name always gives the same hash, so folders can still be told apart
+    REDACT_MASK = "mask" // Every name becomes *
+
+    REDACT_HASH_LENGTH  = 16 // Hex digits kept of the hash of a name
+    MIN_REDACT_KEY_SIZE = 16 // Bytes; shorter keys are too easy to guess
+)
+
+// Options holding paths or path patterns, redacted in the manifest's
+// record of the configuration
+var pathOptions = map[string]bool{
+    "config": true, "files-from": true, "state": true, "checkpoint": true, "runs-dir": true,
+    "exclude": true, "include": true,
+    "json-summary": true, "inventory": true, "treemap": true, "csv": true, "fsrm-report": true, "html-report": true,
+    "summary-file": true, "audit-log": true, "log-file": true,
+    "write-plan": true, "apply-plan": true, "plan-key": true, "redact-key": true,
+    "verify-hash": true, "reevaluate-after": true, "ignore-file": true,
+    "pre-run-hook": true, "post-run-hook": true, "directory-hook": true,
+}
+
+// readRedactKey reads the -redact-key file. Each site keeps its own, so
+// hashes can't be matched against a dictionary of likely names without it.
+func readRedactKey(path string) ([]byte, error) {
+    key, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    key = bytes.TrimSpace(key)
+    if len(key) < MIN_REDACT_KEY_SIZE {
+        return nil, fmt.Errorf("redact key %s is shorter than %d bytes", path, MIN_REDACT_KEY_SIZE)
+    }
+    return key, nil
+}
+
+// redactName redacts one path component, keeping the extension of files.
+func redactName(name string, file bool) string {
+    if opts.Redact == REDACT_NONE {
+        return name
+    }
+    ext := ""
+    if file {
+        ext = filepath.Ext(name)
+    }
+    if opts.Redact == REDACT_MASK {
+        return "*" + ext
+    }
+    mac := hmac.New(sha256.New, opts.redactKey)
+    mac.Write([]byte(strings.ToLower(strings.TrimSuffix(name, ext))))
+    return hex.EncodeToString(mac.Sum(nil))[:REDACT_HASH_LENGTH] + ext
+}
+
+// redactPath redacts every component of path after its volume; file says
+// whether the last one is a file name. Without -redact path is returned as
+// it is.
+func redactPath(path string, file bool) string {
+    if opts.Redact == REDACT_NONE {
+        return path
+    }
+    volume := filepath.VolumeName(path)
+    parts := strings.Split(path[len(volume):], string(filepath.Separator))
+    for i, part := range parts {
+        if part != "" {
+            parts[i] = redactName(part, file && i == len(parts)-1)
+        }
+    }
+    return volume + strings.Join(parts, string(filepath.Separator))
+}
+
+// redactPaths redacts a list of folders, such as the roots.
+func redactPaths(paths []string) []string {
+    if opts.Redact == REDACT_NONE {
+        return paths
+    }
+    redacted := make([]string, len(paths))
+    for i, path := range paths {
+        redacted[i] = redactPath(path, false)
+    }
+    return redacted
+}
+
+// pathValue is implemented by repeatable options holding paths, which
+// redact each of their values themselves since a joined list can't be
+// split again: patterns and commands may contain commas.
+type pathValue interface {
+    redacted() string
+}
+
+// redactOption returns the value of an option as recorded in the manifest,
+// with the paths, patterns and commands of path options redacted.
+func redactOption(f *flag.Flag) string {
+    value := f.Value.String()
+    if opts.Redact == REDACT_NONE || !pathOptions[f.Name] || value == "" {
+        return value
+    }
+    if p, ok := f.Value.(pathValue); ok {
+        return p.redacted()
+    }
+    return redactPath(value, false)
+}
+
+// redactErrors returns errors with their paths redacted.
+func redactErrors(errors []fileError) []fileError {
+    if opts.Redact == REDACT_NONE {
+        return errors
+    }
+    redacted := make([]fileError, len(errors))
+    for i, e := range errors {
+        redacted[i] = fileError{Path: redactPath(e.Path, true), Result: e.Result}
+    }
+    return redacted
+}
+
+// reportPath is how a path appears in reports for people: redacted with
+// -redact, else as on the console.
+func reportPath(path string, file bool) string {
+    if opts.Redact != REDACT_NONE {
+        return redactPath(path, file)
+    }
+    return displayPath(path)
+}
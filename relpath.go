@@ -0,0 +1,37 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+)
+
+// relativeToRoot finds the root containing path and returns its index and
+// the path relative to it.
+func relativeToRoot(roots []string, path string) (int, string, bool) {
+    for i, root := range roots {
+        rel, err := filepath.Rel(filepath.Clean(root), path)
+        if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+            continue
+        }
+        return i, rel, true
+    }
+    return 0, "", false
+}
+
+// displayPath formats path for reports. With -relative-paths it is shown
+// relative to its root, prefixed with the root's position when there are
+// several, so reports of replicas under other drive letters compare equal.
+func displayPath(path string) string {
+    if !opts.RelativePaths {
+        return path
+    }
+    i, rel, ok := relativeToRoot(opts.Roots, path)
+    if !ok {
+        return path
+    }
+    if len(opts.Roots) > 1 {
+        return fmt.Sprintf("%d:%s", i+1, rel)
+    }
+    return rel
+}
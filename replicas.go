@@ -0,0 +1,32 @@
+package main
+
+import (
+    "path/filepath"
+    "strings"
+)
+
+// DFS Replication keeps its staging, conflict and deleted files below a
+// DfsrPrivate folder in every replicated folder; those belong to the
+// replication service and are never touched.
+const DFSR_PRIVATE_DIR = "dfsrprivate"
+
+// isReplicationOwned reports whether path is, or is below, a folder owned by
+// a replication service.
+func isReplicationOwned(path string) bool {
+    for _, part := range strings.Split(filepath.Clean(path), string(filepath.Separator)) {
+        if strings.EqualFold(part, DFSR_PRIVATE_DIR) {
+            return true
+        }
+    }
+    return false
+}
+
+// replicaRoots splits the folders a relative plan is applied to into one
+// set of stand-ins for the plan's roots per replica.
+func replicaRoots(p *plan, roots []string) [][]string {
+    var replicas [][]string
+    for n := len(p.Roots); len(roots) >= n && n > 0; roots = roots[n:] {
+        replicas = append(replicas, roots[:n])
+    }
+    return replicas
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+const MAX_DIFF_LISTED = 50 // New errors and skips listed by report diff
+
+// runReport implements the report subcommand; diff is its only report.
+func runReport(args []string) error {
+    if len(args) == 0 || args[0] != "diff" {
+        return fmt.Errorf("usage: %s report diff [options]", os.Args[0])
+    }
+
+    fs := flag.NewFlagSet(os.Args[0]+" report diff", flag.ContinueOnError)
+    dir := fs.String("runs-dir", defaultRunsDir(), "directory the run manifests are kept in")
+    name := fs.String("run-name", "", "compare the runs with this -run-name (default: the runs like the latest one)")
+    if err := fs.Parse(args[1:]); err != nil {
+        return err
+    }
+
+    manifests, err := readManifests(*dir)
+    if err != nil {
+        return err
+    }
+
+    // Runs are comparable when they have the same name, or when unnamed,
+    // the same folders
+    var key string
+    switch {
+    case *name != "":
+        key = *name
+    case len(manifests) > 0:
+        key = manifestKey(manifests[len(manifests)-1])
+    }
+    var runs []*runManifest
+    for _, m := range manifests {
+        if manifestKey(m) == key {
+            runs = append(runs, m)
+        }
+    }
+    if len(runs) < 2 {
+        return fmt.Errorf("fewer than two runs to compare in %s", *dir)
+    }
+
+    if printManifestDiff(runs[len(runs)-2], runs[len(runs)-1]) {
+        return fmt.Errorf("new errors since the previous run")
+    }
+    return nil
+}
+
+func manifestKey(m *runManifest) string {
+    if m.RunName != "" {
+        return m.RunName
+    }
+    return strings.ToLower(strings.Join(m.Roots, "|"))
+}
+
+// readManifests reads the manifests in dir, sorted by start time. Files
+// that aren't manifests are ignored.
+func readManifests(dir string) ([]*runManifest, error) {
+    paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil {
+        return nil, err
+    }
+
+    var manifests []*runManifest
+    for _, path := range paths {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, err
+        }
+        m := &runManifest{}
+        if err := json.Unmarshal(data, m); err != nil || m.StartTime.IsZero() {
+            continue
+        }
+        manifests = append(manifests, m)
+    }
+    sort.Slice(manifests, func(i, j int) bool { return manifests[i].StartTime.Before(manifests[j].StartTime) })
+    return manifests, nil
+}
+
+// newPaths returns the entries of current whose path isn't in previous.
+func newPaths(previous []fileError, current []fileError) []fileError {
+    seen := map[string]bool{}
+    for _, e := range previous {
+        seen[strings.ToLower(e.Path)] = true
+    }
+    var added []fileError
+    for _, e := range current {
+        if !seen[strings.ToLower(e.Path)] {
+            added = append(added, e)
+        }
+    }
+    return added
+}
+
+func printNewPaths(title string, entries []fileError) {
+    if len(entries) == 0 {
+        return
+    }
+    fmt.Printf("\n%s: %d\n", title, len(entries))
+    for _, e := range entries[:min(len(entries), MAX_DIFF_LISTED)] {
+        fmt.Printf("  %-24s %s\n", e.Result, e.Path)
+    }
+    if len(entries) > MAX_DIFF_LISTED {
+        fmt.Printf("  ... and %d more\n", len(entries)-MAX_DIFF_LISTED)
+    }
+}
+
+// printManifestDiff compares the latest run with the previous one and
+// reports whether files failed that didn't before.
+func printManifestDiff(previous *runManifest, latest *runManifest) bool {
+    fmt.Printf("Comparing the run of %s with the run of %s\n",
+        latest.StartTime.Local().Format("2006-01-02 15:04:05"), previous.StartTime.Local().Format("2006-01-02 15:04:05"))
+
+    delta := func(label string, before int64, after int64) {
+        fmt.Printf("  %-28s %15d  %+15d\n", label, after, after-before)
+    }
+    p, l := previous.Totals, latest.Totals
+    delta("Files processed", p.FilesProcessed, l.FilesProcessed)
+    delta("Files compressed", p.FilesCompressed, l.FilesCompressed)
+    delta("Files decompressed", p.FilesDecompressed, l.FilesDecompressed)
+    delta("Space saved (bytes)", p.SpaceSaved, l.SpaceSaved)
+    delta("Projected savings (bytes)", p.SpaceProjected, l.SpaceProjected)
+    delta("Errors", int64(previous.ErrorsTotal), int64(latest.ErrorsTotal))
+    delta("Files skipped", int64(previous.SkippedTotal), int64(latest.SkippedTotal))
+
+    if len(latest.Errors) < latest.ErrorsTotal || len(previous.Errors) < previous.ErrorsTotal {
+        fmt.Printf("Only the first %d errors of each run are compared\n", MAX_MANIFEST_ERRORS)
+    }
+    errors := newPaths(previous.Errors, latest.Errors)
+    printNewPaths("New errors", errors)
+    printNewPaths("Newly skipped", newPaths(previous.Skipped, latest.Skipped))
+    return len(errors) > 0
+}
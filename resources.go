@@ -0,0 +1,83 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "unsafe"
+
+    "golang.org/x/sys/windows"
+)
+
+// ioCounters is IO_COUNTERS.
+type ioCounters struct {
+    readOperations  uint64
+    writeOperations uint64
+    otherOperations uint64
+    readBytes       uint64
+    writeBytes      uint64
+    otherBytes      uint64
+}
+
+// processMemoryCounters is PROCESS_MEMORY_COUNTERS.
+type processMemoryCounters struct {
+    cb                         uint32
+    pageFaultCount             uint32
+    peakWorkingSetSize         uintptr
+    workingSetSize             uintptr
+    quotaPeakPagedPoolUsage    uintptr
+    quotaPagedPoolUsage        uintptr
+    quotaPeakNonPagedPoolUsage uintptr
+    quotaNonPagedPoolUsage     uintptr
+    pagefileUsage              uintptr
+    peakPagefileUsage          uintptr
+}
+
+// resourceUsage is what the run itself cost, to weigh against what it saved.
+type resourceUsage struct {
+    UserSeconds    float64 `json:"user_seconds"`
+    KernelSeconds  float64 `json:"kernel_seconds"`
+    BytesRead      uint64  `json:"bytes_read"`
+    BytesWritten   uint64  `json:"bytes_written"`
+    PeakWorkingSet uint64  `json:"peak_working_set"`
+    Handles        uint32  `json:"handles"` // Open when measured, at the end of the run
+}
+
+// filetimeDuration converts a FILETIME holding an interval of 100ns units.
+func filetimeDuration(ft windows.Filetime) time.Duration {
+    return time.Duration(int64(ft.HighDateTime)<<32|int64(ft.LowDateTime)) * 100
+}
+
+// measureResources returns the resources used by the process so far. What
+// can't be queried is left at zero.
+func measureResources() resourceUsage {
+    var usage resourceUsage
+    process := windows.CurrentProcess()
+
+    var creation, exit, kernel, user windows.Filetime
+    if windows.GetProcessTimes(process, &creation, &exit, &kernel, &user) == nil {
+        usage.UserSeconds = filetimeDuration(user).Seconds()
+        usage.KernelSeconds = filetimeDuration(kernel).Seconds()
+    }
+
+    var io ioCounters
+    if r, _, _ := procGetProcessIoCounters.Call(uintptr(process), uintptr(unsafe.Pointer(&io))); r != 0 {
+        usage.BytesRead = io.readBytes
+        usage.BytesWritten = io.writeBytes
+    }
+
+    memory := processMemoryCounters{cb: uint32(unsafe.Sizeof(processMemoryCounters{}))}
+    if r, _, _ := procK32GetProcessMemoryInfo.Call(uintptr(process), uintptr(unsafe.Pointer(&memory)), uintptr(memory.cb)); r != 0 {
+        usage.PeakWorkingSet = uint64(memory.peakWorkingSetSize)
+    }
+
+    var handles uint32
+    if r, _, _ := procGetProcessHandleCount.Call(uintptr(process), uintptr(unsafe.Pointer(&handles))); r != 0 {
+        usage.Handles = handles
+    }
+    return usage
+}
+
+func printResources(usage resourceUsage) {
+    fmt.Printf("Resources used: %.1fs CPU (%.1fs user, %.1fs kernel), %d bytes read, %d bytes written, peak working set %d bytes, %d handles open at the end\n",
+        usage.UserSeconds+usage.KernelSeconds, usage.UserSeconds, usage.KernelSeconds, usage.BytesRead, usage.BytesWritten, usage.PeakWorkingSet, usage.Handles)
+}
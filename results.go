@@ -0,0 +1,63 @@
+package main
+
+import (
+    "errors"
+
+    "golang.org/x/sys/windows"
+)
+
+// resultCode says what happened to a file, for reports read by other tools
+// instead of the console messages.
+type resultCode string
+
+const (
+    RESULT_COMPRESSED              resultCode = "COMPRESSED"
+    RESULT_DECOMPRESSED            resultCode = "DECOMPRESSED"
+    RESULT_REVERTED                resultCode = "REVERTED"                // Compressed, then decompressed again, see -min-actual-savings
+    RESULT_PLANNED_COMPRESS        resultCode = "PLANNED_COMPRESS"
+    RESULT_PLANNED_DECOMPRESS      resultCode = "PLANNED_DECOMPRESS"
+    RESULT_SKIPPED_ACTIVE          resultCode = "SKIPPED_ACTIVE"          // Modified during the run
+    RESULT_SKIPPED_IN_USE          resultCode = "SKIPPED_IN_USE"          // Held under an oplock by another client
+    RESULT_SKIPPED_UNCHANGED       resultCode = "SKIPPED_UNCHANGED"       // Evaluated recently, see -reevaluate-after
+    RESULT_SKIPPED_OFFLINE         resultCode = "SKIPPED_OFFLINE"         // Offline or HSM stub, reading would recall it
+    RESULT_SKIPPED_QUARANTINED     resultCode = "SKIPPED_QUARANTINED"     // Failed in too many earlier runs
+    RESULT_SKIPPED_NOT_COMPRESSED  resultCode = "SKIPPED_NOT_COMPRESSED"  // Nothing to decompress
+    RESULT_SKIPPED_BELOW_THRESHOLD resultCode = "SKIPPED_BELOW_THRESHOLD" // Not worth compressing, left as it is
+    RESULT_EXAMINED                resultCode = "EXAMINED"                // Counted by the status subcommand
+    RESULT_DEFERRED                resultCode = "DEFERRED"                // Left for the deep pass of -two-pass
+    RESULT_ERROR_LOCKED            resultCode = "ERROR_LOCKED"            // Opened exclusively by another process
+    RESULT_ERROR_ACCESS            resultCode = "ERROR_ACCESS"
+    RESULT_ERROR_READ              resultCode = "ERROR_READ"
+    RESULT_ERROR_COMPRESSION       resultCode = "ERROR_COMPRESSION"       // Changing the compression state failed
+    RESULT_ERROR_INTERNAL          resultCode = "ERROR_INTERNAL"          // Processing panicked
+)
+
+// actionResult is the result of having applied action.
+func actionResult(action string) resultCode {
+    if action == ACTION_COMPRESS {
+        return RESULT_COMPRESSED
+    }
+    return RESULT_DECOMPRESSED
+}
+
+// plannedResult is the result of having recommended or planned action.
+func plannedResult(action string) resultCode {
+    if action == ACTION_COMPRESS {
+        return RESULT_PLANNED_COMPRESS
+    }
+    return RESULT_PLANNED_DECOMPRESS
+}
+
+// errorResult classifies err, using fallback for errors without a more
+// specific code.
+func errorResult(err error, fallback resultCode) resultCode {
+    switch {
+    case isOplockConflict(err):
+        return RESULT_SKIPPED_IN_USE
+    case errors.Is(err, windows.ERROR_SHARING_VIOLATION), errors.Is(err, windows.ERROR_LOCK_VIOLATION):
+        return RESULT_ERROR_LOCKED
+    case errors.Is(err, windows.ERROR_ACCESS_DENIED):
+        return RESULT_ERROR_ACCESS
+    }
+    return fallback
+}
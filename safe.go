@@ -0,0 +1,158 @@
+package main
+
+import (
+    "path/filepath"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    SAFE_THRESHOLD = 20    // Only recommend compression for clear wins
+    SAFE_LIMIT     = 10000 // Files considered per run at most
+)
+
+// Excluded in safe mode: locations owned by the system, and like in every
+// run unless -no-default-excludes is given, formats that are already
+// compressed, which are never worth reading.
+var (
+    safeExcludedNames = map[string]bool{
+        "$recycle.bin":              true,
+        "system volume information": true,
+        "winsxs":                    true,
+        "windowsapps":               true,
+        "pagefile.sys":              true,
+        "hiberfil.sys":              true,
+        "swapfile.sys":              true,
+    }
+    defaultExcludedExtensions = map[string]bool{
+        ".zip": true, ".7z": true, ".rar": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+        ".lz4": true, ".cab": true, ".msi": true, ".jar": true, ".apk": true,
+        ".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+        ".mp3": true, ".m4a": true, ".aac": true, ".flac": true, ".ogg": true, ".opus": true,
+        ".mp4": true, ".m4v": true, ".mkv": true, ".avi": true, ".mov": true, ".wmv": true, ".webm": true,
+        ".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".odp": true,
+    }
+)
+
+// Files left out by the default excludes, counted for the summary
+var (
+    defaultExcludedFiles atomic.Int64
+    defaultExcludedBytes atomic.Int64
+)
+
+// applySafeDefaults switches to conservative settings for -safe runs.
+func applySafeDefaults() {
+    opts.Threshold = max(opts.Threshold, SAFE_THRESHOLD)
+    if opts.Limit == 0 || opts.Limit > SAFE_LIMIT {
+        opts.Limit = SAFE_LIMIT
+    }
+}
+
+// safeExcluded reports whether safe mode leaves path out of the walk.
+func safeExcluded(path string, isDir bool) bool {
+    name := strings.ToLower(filepath.Base(path))
+    if safeExcludedNames[name] {
+        return true
+    }
+    return !isDir && defaultExcludedExtensions[filepath.Ext(name)]
+}
+
+// defaultExcluded reports whether path has an extension of the default
+// excludes with no -extension rule of its own. Decompressing and reporting
+// the current state cover every file.
+func defaultExcluded(path string) bool {
+    if opts.NoDefaultExcludes || opts.mode == MODE_DECOMPRESS || examiningOnly() {
+        return false
+    }
+    ext := strings.ToLower(filepath.Ext(path))
+    if _, ok := opts.Extensions[ext]; ok {
+        return false
+    }
+    return defaultExcludedExtensions[ext]
+}
+
+// coveredRoots returns the roots together with the folders holding the
+// file arguments that aren't below one of them: everything a run works on,
+// for the first-run check and the locks.
+func coveredRoots(roots []string, files []string) []string {
+    covered := append([]string{}, roots...)
+    keys := map[string]bool{}
+    for _, root := range roots {
+        keys[stateKey(root)] = true
+    }
+    for _, file := range files {
+        dir := filepath.Dir(file)
+        key := stateKey(dir)
+        if keys[key] {
+            continue
+        }
+        inside := false
+        for _, root := range roots {
+            if within(stateKey(root), key) {
+                inside = true
+                break
+            }
+        }
+        if !inside {
+            keys[key] = true
+            covered = append(covered, dir)
+        }
+    }
+    return covered
+}
+
+// excludedButCompressed reports whether a default-excluded file is stored
+// compressed in a run that may decompress it. Its format gains nothing
+// from compression, so it is decompressed without being read.
+func excludedButCompressed(attrs uint32) bool {
+    return compressedAttrs(attrs) && !leaveAlone(ACTION_DECOMPRESS)
+}
+
+// newRoots returns the roots no earlier run has looked at. Without a state
+// file every root is new.
+func newRoots(roots []string) []string {
+    var unknown []string
+    for _, root := range roots {
+        if state == nil {
+            unknown = append(unknown, root)
+            continue
+        }
+        if _, ok := state.KnownRoots[stateKey(root)]; !ok {
+            unknown = append(unknown, root)
+        }
+    }
+    return unknown
+}
+
+// recordKnownRoots remembers that the roots have been looked at.
+func recordKnownRoots(s *runState, roots []string, start time.Time) {
+    if s.KnownRoots == nil {
+        s.KnownRoots = map[string]time.Time{}
+    }
+    for _, root := range roots {
+        key := stateKey(root)
+        if _, ok := s.KnownRoots[key]; !ok {
+            s.KnownRoots[key] = start.UTC()
+        }
+    }
+}
+
+// checkSafeMode applies the -safe restrictions and refuses to modify anything
+// when one of the roots, or the folder of a file argument, is seen for the
+// first time.
+func checkSafeMode() {
+    applySafeDefaults()
+
+    unknown := newRoots(coveredRoots(opts.Roots, opts.Files))
+    if len(unknown) == 0 {
+        noticef("Safe mode: threshold %g%%, at most %d files\n", opts.Threshold, opts.Limit)
+        return
+    }
+
+    opts.recommendOnly = true
+    noticef("Safe mode: first run against %s, recommending only; nothing will be modified\n", strings.Join(unknown, ", "))
+    if state == nil {
+        noticef("Safe mode: use -state so later runs can recognize these folders\n")
+    }
+}
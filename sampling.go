@@ -0,0 +1,141 @@
+package main
+
+import (
+    "bytes"
+    "compress/flate"
+    "io"
+    "sync/atomic"
+)
+
+const (
+    DEFAULT_MAX_ESTIMATE_SIZE = 1 << 30 // Bytes read in full for an estimate; larger files are sampled
+    SAMPLE_COUNT              = 32
+    SAMPLE_SIZE               = 1 << 20
+    FLATE_WRITER_MEMORY       = 1 << 20 // Rough allocation of one flate writer
+)
+
+// sampleLevels are the samples estimates degrade to, in order, when the
+// -memory-limit budget can't cover a better one. The last level is used
+// regardless of the budget so the pipeline never stalls on memory.
+var sampleLevels = []struct {
+    count int64
+    size  int
+}{
+    {SAMPLE_COUNT, SAMPLE_SIZE},
+    {QUICK_SAMPLE_COUNT, QUICK_SAMPLE_SIZE},
+}
+
+// estimateMemory is the memory reserved by the estimates in progress.
+// Estimates degraded because of the budget are counted in the shards.
+var estimateMemory atomic.Int64
+
+// reserveMemory reserves n bytes of the -memory-limit budget. It fails
+// rather than waits when the budget doesn't cover them, unless force is set.
+func reserveMemory(n int64, force bool) bool {
+    for {
+        used := estimateMemory.Load()
+        if !force && opts.MemoryLimit > 0 && used+n > opts.MemoryLimit {
+            return false
+        }
+        if estimateMemory.CompareAndSwap(used, used+n) {
+            return true
+        }
+    }
+}
+
+func releaseMemory(n int64) {
+    estimateMemory.Add(-n)
+}
+
+// sampleFile estimates the compressed size of a large file from count
+// evenly spaced samples of sampleSize bytes instead of reading all of it.
+// It returns the file size and the extrapolated compressed size.
+func sampleFile(path string, count int64, sampleSize int, times *ioTimings) (int64, int64, error) {
+    waitForQuietDisk(path)
+    readSlots.acquire()
+    defer readSlots.release()
+
+    file, err := openForRead(path, times)
+    if err != nil {
+        return 0, 0, err
+    }
+    defer file.Close()
+
+    fileInfo, err := file.Stat()
+    if err != nil {
+        return 0, 0, err
+    }
+    size := fileInfo.Size()
+
+    var compressedBuffer bytes.Buffer
+    writer, err := flate.NewWriter(&compressedBuffer, flate.DefaultCompression)
+    if err != nil {
+        return 0, 0, err
+    }
+
+    var sampled, compressed int64
+    buf := make([]byte, sampleSize)
+    for i := int64(0); i < count; i++ {
+        offset := i * (size - int64(sampleSize)) / (count - 1)
+        if _, err := file.Seek(offset, io.SeekStart); err != nil {
+            return 0, 0, err
+        }
+        n, err := io.ReadFull(file, buf)
+        if err != nil && err != io.ErrUnexpectedEOF {
+            return 0, 0, err
+        }
+
+        // Samples are compressed independently, like NTFS compression units
+        compressedBuffer.Reset()
+        writer.Reset(&compressedBuffer)
+        writer.Write(buf[:n])
+        if err := writer.Close(); err != nil {
+            return 0, 0, err
+        }
+        sampled += int64(n)
+        compressed += int64(compressedBuffer.Len())
+    }
+
+    if sampled == 0 {
+        return size, 0, nil
+    }
+    return size, int64(float64(size) * float64(compressed) / float64(sampled)), nil
+}
+
+// estimateFile returns the original and estimated compressed size of a
+// file, reading it in full up to -max-estimate-size and sampling it beyond.
+// Under memory pressure it falls back to fewer and smaller samples. It also
+// reports whether the estimate was cut short or sampled.
+func estimateFile(path string, size int64, shard *statsShard) (int64, int64, bool, bool, error) {
+    // Files not much larger than the samples themselves are read in full,
+    // as are files too small to be sampled at any level
+    last := sampleLevels[len(sampleLevels)-1]
+    full := opts.MaxEstimateSize <= 0 || size <= max(opts.MaxEstimateSize, SAMPLE_COUNT*SAMPLE_SIZE)
+    if cost := FLATE_WRITER_MEMORY + size; full && reserveMemory(cost, size <= last.count*int64(last.size)) {
+        defer releaseMemory(cost)
+        originalSize, compressedSize, stoppedEarly, err := compressFileInMemory(path, &shard.io)
+        return originalSize, compressedSize, stoppedEarly, false, err
+    }
+
+    for i, level := range sampleLevels {
+        if size <= level.count*int64(level.size) {
+            continue
+        }
+        // A sample and its compressed form are held at the same time
+        cost := FLATE_WRITER_MEMORY + 2*int64(level.size)
+        if !reserveMemory(cost, i == len(sampleLevels)-1) {
+            continue
+        }
+        defer releaseMemory(cost)
+
+        if full || i > 0 {
+            shard.degradedEstimates.Add(1)
+        }
+        originalSize, compressedSize, err := sampleFile(path, level.count, level.size, &shard.io)
+        return originalSize, compressedSize, false, true, err
+    }
+
+    // Not reached: the last level is always used for files that get here
+    originalSize, compressedSize, stoppedEarly, err := compressFileInMemory(path, &shard.io)
+    return originalSize, compressedSize, stoppedEarly, false, err
+}
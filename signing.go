@@ -0,0 +1,65 @@
+package main
+
+import (
+    "crypto/ed25519"
+    "crypto/x509"
+    "encoding/pem"
+    "fmt"
+    "os"
+)
+
+// signingKey is an Ed25519 key read from a PEM file, as written by
+// "openssl genpkey -algorithm ed25519" and "openssl pkey -pubout". A private
+// key file can sign and verify; machines that only verify get the public
+// key file, so they hold nothing that could sign.
+type signingKey struct {
+    public  ed25519.PublicKey
+    private ed25519.PrivateKey // Nil for a public key file
+}
+
+func readSigningKey(path string) (*signingKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("key %s is not a PEM file", path)
+    }
+
+    switch block.Type {
+    case "PRIVATE KEY":
+        k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+        if err != nil {
+            return nil, fmt.Errorf("parsing key %s: %v", path, err)
+        }
+        private, ok := k.(ed25519.PrivateKey)
+        if !ok {
+            return nil, fmt.Errorf("key %s is not an Ed25519 key", path)
+        }
+        return &signingKey{public: private.Public().(ed25519.PublicKey), private: private}, nil
+    case "PUBLIC KEY":
+        k, err := x509.ParsePKIXPublicKey(block.Bytes)
+        if err != nil {
+            return nil, fmt.Errorf("parsing key %s: %v", path, err)
+        }
+        public, ok := k.(ed25519.PublicKey)
+        if !ok {
+            return nil, fmt.Errorf("key %s is not an Ed25519 key", path)
+        }
+        return &signingKey{public: public}, nil
+    }
+    return nil, fmt.Errorf("key %s holds a %s, not an Ed25519 private or public key", path, block.Type)
+}
+
+// sign returns the signature of data. Only a private key can sign.
+func (k *signingKey) sign(data []byte) ([]byte, error) {
+    if k.private == nil {
+        return nil, fmt.Errorf("signing needs the private key, not the public one")
+    }
+    return ed25519.Sign(k.private, data), nil
+}
+
+func (k *signingKey) verify(data []byte, signature []byte) bool {
+    return ed25519.Verify(k.public, data, signature)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Syslog severities, also used as GELF levels
+const (
+    SEVERITY_ERROR   = 3
+    SEVERITY_WARNING = 4
+    SEVERITY_INFO    = 6
+
+    SYSLOG_FACILITY_DAEMON = 3
+    SYSLOG_SD_ID           = "pancake@32473" // 32473 is the enterprise number set aside for examples
+    SINK_DIAL_TIMEOUT      = 10 * time.Second
+    SINK_WRITE_TIMEOUT     = 2 * time.Second // Events that can't be sent by then are dropped
+    SINK_QUEUE_SIZE        = 1024            // Events waiting to be sent; more are dropped
+)
+
+// logSink sends per-file and summary events to a syslog or GELF (Graylog)
+// server, for sites that collect maintenance logs off the machine. Events
+// are sent by one goroutine so a slow server never holds up the workers.
+type logSink struct {
+    mu       sync.Mutex // Guards closed against events sent while closing
+    conn     net.Conn
+    format   string // syslog or gelf
+    stream   bool   // TCP, where messages need framing
+    host     string
+    events   chan []byte
+    done     chan struct{}
+    closed   bool
+    failures atomic.Int64 // Events dropped or not delivered
+    broken   bool         // A write timed out; set and read only by run
+}
+
+var sink *logSink
+
+// openLogSink connects to a -log-sink URL such as syslog+udp://host:514 or
+// gelf+tcp://host:12201.
+func openLogSink(rawURL string) (*logSink, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+    s := &logSink{}
+    var network string
+    switch u.Scheme {
+    case "syslog+udp", "syslog":
+        s.format, network = "syslog", "udp"
+    case "syslog+tcp":
+        s.format, network = "syslog", "tcp"
+    case "gelf+udp", "gelf":
+        s.format, network = "gelf", "udp"
+    case "gelf+tcp":
+        s.format, network = "gelf", "tcp"
+    default:
+        return nil, fmt.Errorf("unsupported log sink %q (want syslog+udp, syslog+tcp, gelf+udp or gelf+tcp)", u.Scheme)
+    }
+    s.stream = network == "tcp"
+
+    conn, err := net.DialTimeout(network, u.Host, SINK_DIAL_TIMEOUT)
+    if err != nil {
+        return nil, err
+    }
+    s.conn = conn
+    s.host, _ = os.Hostname()
+    s.events = make(chan []byte, SINK_QUEUE_SIZE)
+    s.done = make(chan struct{})
+    go s.run()
+    return s, nil
+}
+
+// run sends the queued events until the sink is closed. Once a write times
+// out the server is taken to be stalled, and since a stream can't be
+// resynchronised after a partial write, the rest are dropped.
+func (s *logSink) run() {
+    defer close(s.done)
+    for data := range s.events {
+        if s.broken {
+            s.failures.Add(1)
+            continue
+        }
+        s.conn.SetWriteDeadline(time.Now().Add(SINK_WRITE_TIMEOUT))
+        _, err := s.conn.Write(data)
+        if err == nil {
+            continue
+        }
+        if s.failures.Add(1) == 1 {
+            noticef("Error sending to log sink: %v\n", err)
+        }
+        if ne, ok := err.(net.Error); ok && ne.Timeout() {
+            noticef("Log sink stalled, dropping the events still to come\n")
+            s.broken = true
+        }
+    }
+}
+
+// syslogSD formats fields as an RFC 5424 structured data element.
+func syslogSD(fields map[string]any) string {
+    if len(fields) == 0 {
+        return "-"
+    }
+    names := make([]string, 0, len(fields))
+    for name := range fields {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+    var b strings.Builder
+    b.WriteString("[" + SYSLOG_SD_ID)
+    for _, name := range names {
+        var value string
+        switch v := fields[name].(type) {
+        case time.Time:
+            value = v.Format(time.RFC3339Nano)
+        case []string:
+            value = strings.Join(v, ",")
+        default:
+            value = fmt.Sprint(v)
+        }
+        fmt.Fprintf(&b, ` %s="%s"`, name, escape.Replace(value))
+    }
+    b.WriteString("]")
+    return b.String()
+}
+
+// send formats one event and queues it for sending, dropping it if the
+// queue is full. fields become structured data in syslog and additional
+// fields in GELF. Without -log-sink it does nothing.
+func (s *logSink) send(severity int, message string, fields map[string]any) {
+    if s == nil {
+        return
+    }
+
+    var data []byte
+    if s.format == "gelf" {
+        event := map[string]any{
+            "version":       "1.1",
+            "host":          s.host,
+            "short_message": message,
+            "timestamp":     float64(time.Now().UnixMilli()) / 1000,
+            "level":         severity,
+            "_run_name":     opts.RunName,
+        }
+        for name, value := range fields {
+            event["_"+name] = value
+        }
+        data, _ = json.Marshal(event)
+        if s.stream {
+            data = append(data, 0)
+        }
+    } else {
+        line := fmt.Sprintf("<%d>1 %s %s ntfs_pancake %d - %s %s",
+            SYSLOG_FACILITY_DAEMON*8+severity, time.Now().UTC().Format(time.RFC3339Nano), s.host, os.Getpid(), syslogSD(fields), message)
+        if s.stream {
+            line = fmt.Sprintf("%d %s", len(line), line)
+        }
+        data = []byte(line)
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return
+    }
+    select {
+    case s.events <- data:
+    default:
+        s.failures.Add(1)
+    }
+}
+
+// file sends the outcome of one file.
+func (s *logSink) file(rec fileRecord) {
+    if s == nil {
+        return
+    }
+    severity := SEVERITY_INFO
+    switch {
+    case rec.Result.isError():
+        severity = SEVERITY_ERROR
+    case rec.Result.isUnexpectedSkip():
+        severity = SEVERITY_WARNING
+    }
+    s.send(severity, fmt.Sprintf("%s %s", rec.Result, rec.Path), map[string]any{
+        "path":   rec.Path,
+        "result": string(rec.Result),
+        "action": rec.Action,
+        "size":   rec.Size,
+        "saved":  rec.Saved,
+    })
+}
+
+// summary sends the totals of the run.
+func (s *logSink) summary(summary statsSnapshot, usage resourceUsage, startTime time.Time, endTime time.Time) {
+    if s == nil {
+        return
+    }
+    s.send(SEVERITY_INFO, fmt.Sprintf("Run finished: %d files processed, %d bytes saved", summary.FilesProcessed, summary.SpaceSaved), map[string]any{
+        "event":        "summary",
+        "roots":        opts.Roots,
+        "start_time":   startTime.UTC(),
+        "end_time":     endTime.UTC(),
+        "processed":    summary.FilesProcessed,
+        "compressed":   summary.FilesCompressed,
+        "decompressed": summary.FilesDecompressed,
+        "space_saved":  summary.SpaceSaved,
+        "projected":    summary.SpaceProjected,
+        "cpu_seconds":  usage.UserSeconds + usage.KernelSeconds,
+        "bytes_read":   usage.BytesRead,
+        "peak_memory":  usage.PeakWorkingSet,
+        "handles":      usage.Handles,
+    })
+}
+
+func (s *logSink) close() {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    if !s.closed {
+        s.closed = true
+        close(s.events)
+    }
+    s.mu.Unlock()
+    <-s.done
+
+    if failures := s.failures.Load(); failures > 1 {
+        fmt.Printf("Events not delivered to the log sink: %d\n", failures)
+    }
+    s.conn.Close()
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/sys/windows"
+)
+
+const STATE_VERSION = 5
+
+// stateMigrations upgrade a state from the version they are keyed by to the
+// next one. Versions are bumped whenever older binaries would lose data on
+// saving a newer state, so they refuse it instead.
+var stateMigrations = map[int]func(s *runState) error{
+    // Version 2 added last_run and known_roots, both optional
+    1: func(s *runState) error { return nil },
+    // Version 3 added failures, also optional
+    2: func(s *runState) error { return nil },
+    // Version 4 added the quick hash of files, missing ones are recomputed
+    3: func(s *runState) error { return nil },
+    // Version 5 added the savings of directories, empty until the next run
+    4: func(s *runState) error { return nil },
+}
+
+// runState is what is remembered between runs in the -state file.
+type runState struct {
+    Version int                   `json:"version"`
+    Files   map[string]*fileState `json:"files"`
+    LastRun map[string]time.Time  `json:"last_run,omitempty"` // Start of the last applying run per root
+
+    KnownRoots map[string]time.Time `json:"known_roots,omitempty"` // First run over each root
+
+    Failures map[string]*fileFailure `json:"failures,omitempty"` // Files failing in consecutive runs
+
+    Directories map[string]*dirHistory `json:"directories,omitempty"` // Savings of directories, see recordDirHistory
+}
+
+// fileState is the last evaluation recorded for a file.
+type fileState struct {
+    Size      int64     `json:"size"`
+    ModTime   time.Time `json:"mod_time"`
+    Evaluated time.Time `json:"evaluated"`
+    Action    string    `json:"action"`
+    Policy    string    `json:"policy"`
+    Hash      string    `json:"hash,omitempty"` // With -verify-hash, see quickHash
+}
+
+// state is loaded before the run and only read while workers are running;
+// their updates are kept in their shards and merged afterwards.
+var state *runState
+
+func loadState(path string) (*runState, error) {
+    s := &runState{Version: STATE_VERSION, Files: map[string]*fileState{}}
+
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return s, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if err := json.Unmarshal(data, s); err != nil {
+        return nil, fmt.Errorf("parsing state %s: %v", path, err)
+    }
+    if s.Version > STATE_VERSION {
+        return nil, fmt.Errorf("state %s was written by a newer version (%d, this one supports %d)", path, s.Version, STATE_VERSION)
+    }
+    if s.Version < STATE_VERSION {
+        if err := migrateState(path, data, s); err != nil {
+            return nil, err
+        }
+    }
+    if s.Files == nil {
+        s.Files = map[string]*fileState{}
+    }
+    return s, nil
+}
+
+// migrateState upgrades s to the current version, keeping a copy of the
+// original file in case the upgrade has to be rolled back.
+func migrateState(path string, data []byte, s *runState) error {
+    from := s.Version
+    backup := fmt.Sprintf("%s.v%d.bak", path, from)
+    if err := os.WriteFile(backup, data, 0644); err != nil {
+        return fmt.Errorf("backing up state %s: %v", path, err)
+    }
+
+    for s.Version < STATE_VERSION {
+        migrate, ok := stateMigrations[s.Version]
+        if !ok {
+            return fmt.Errorf("state %s has unsupported version %d", path, s.Version)
+        }
+        if err := migrate(s); err != nil {
+            return fmt.Errorf("migrating state %s from version %d: %v", path, s.Version, err)
+        }
+        s.Version++
+    }
+
+    noticef("Migrated state %s from version %d to %d (original kept as %s)\n", path, from, s.Version, backup)
+    return nil
+}
+
+// saveState replaces the state file atomically so an interrupted save
+// doesn't lose the accumulated history.
+func saveState(path string, s *runState) error {
+    data, err := json.Marshal(s)
+    if err != nil {
+        return err
+    }
+
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+// stateKey normalizes a path for lookups; NTFS paths are case-insensitive.
+func stateKey(path string) string {
+    if absPath, err := filepath.Abs(path); err == nil {
+        path = absPath
+    }
+    return strings.ToLower(path)
+}
+
+// policyFingerprint summarizes the settings a decision depends on, so files
+// are re-evaluated when the policy changes.
+func policyFingerprint() string {
+    fingerprint := fmt.Sprintf("threshold=%g", opts.Threshold)
+    if usingWof() {
+        fingerprint += " backend=" + opts.Backend
+    }
+    if len(opts.Extensions) > 0 {
+        fingerprint += " extensions=" + opts.Extensions.String()
+    }
+    if opts.MaxAccessCost > 0 {
+        fingerprint += fmt.Sprintf(" max-access-cost=%g", opts.MaxAccessCost)
+    }
+    return fingerprint
+}
+
+// recordState remembers the evaluation of a file in the worker's shard.
+func recordState(shard *statsShard, task fileTask, action string) {
+    if shard.stateUpdates == nil {
+        shard.stateUpdates = map[string]*fileState{}
+    }
+    key := stateKey(task.path)
+    update := &fileState{
+        Size:      task.size,
+        ModTime:   task.modTime,
+        Evaluated: time.Now().UTC(),
+        Action:    action,
+        Policy:    policyFingerprint(),
+    }
+    if opts.VerifyHash.covers(key) {
+        if hash, err := quickHash(task.path, task.size, &shard.io); err == nil {
+            update.Hash = hash
+        }
+    }
+    shard.stateUpdates[key] = update
+}
+
+// mergeState folds the updates of all workers into the state.
+func mergeState(s *runState) {
+    stats.mu.Lock()
+    defer stats.mu.Unlock()
+
+    for _, shard := range stats.shards {
+        for key, update := range shard.stateUpdates {
+            s.Files[key] = update
+        }
+        for key, failure := range shard.failureUpdates {
+            if failure == nil {
+                delete(s.Failures, key)
+                continue
+            }
+            if s.Failures == nil {
+                s.Failures = map[string]*fileFailure{}
+            }
+            s.Failures[key] = failure
+        }
+    }
+}
+
+// reevaluateRule sets how long evaluations stay valid below a directory;
+// an empty dir is the default for everything else.
+type reevaluateRule struct {
+    dir   string
+    after time.Duration
+}
+
+// reevaluateRules implements flag.Value for repeatable -reevaluate-after
+// values of the form 180d or D:\Logs=7d.
+type reevaluateRules []reevaluateRule
+
+func (r *reevaluateRules) String() string {
+    var parts []string
+    for _, rule := range *r {
+        if rule.dir == "" {
+            parts = append(parts, rule.after.String())
+        } else {
+            parts = append(parts, rule.dir+"="+rule.after.String())
+        }
+    }
+    return strings.Join(parts, ",")
+}
+
+func (r *reevaluateRules) Set(value string) error {
+    rule := reevaluateRule{}
+    if i := strings.LastIndex(value, "="); i >= 0 {
+        rule.dir = stateKey(value[:i])
+        value = value[i+1:]
+    }
+
+    after, err := parseAge(value)
+    if err != nil {
+        return err
+    }
+    rule.after = after
+    *r = append(*r, rule)
+    return nil
+}
+
+func (r *reevaluateRules) redacted() string {
+    var parts []string
+    for _, rule := range *r {
+        if rule.dir == "" {
+            parts = append(parts, rule.after.String())
+        } else {
+            parts = append(parts, redactPath(rule.dir, false)+"="+rule.after.String())
+        }
+    }
+    return strings.Join(parts, ",")
+}
+
+func (r *reevaluateRules) reset() {
+    *r = nil
+}
+
+// reevaluateAfter returns the interval for path: the rule of the deepest
+// directory containing it, else the default rule. 0 means always.
+func (r reevaluateRules) reevaluateAfter(key string) time.Duration {
+    var after time.Duration
+    best := -1
+    for _, rule := range r {
+        if rule.dir != "" && key != rule.dir && !strings.HasPrefix(key, rule.dir+`\`) {
+            continue
+        }
+        if len(rule.dir) > best {
+            best = len(rule.dir)
+            after = rule.after
+        }
+    }
+    return after
+}
+
+// parseAge parses a duration that may also be given in days, e.g. 180d.
+func parseAge(value string) (time.Duration, error) {
+    if strings.HasSuffix(value, "d") {
+        days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+        if err != nil || days < 0 {
+            return 0, fmt.Errorf("invalid duration %q", value)
+        }
+        return time.Duration(days * float64(24*time.Hour)), nil
+    }
+
+    d, err := time.ParseDuration(value)
+    if err != nil || d < 0 {
+        return 0, fmt.Errorf("invalid duration %q", value)
+    }
+    return d, nil
+}
+
+// checkDrift compares the compression attribute of a file with the last
+// decision recorded for it. It returns the recorded action when they
+// disagree, e.g. because an application rewrote the file uncompressed or
+// someone ran compact /u, and an empty string otherwise.
+func checkDrift(task fileTask) string {
+    // WOF compression doesn't show in the attributes
+    if state == nil || usingWof() {
+        return ""
+    }
+
+    last, ok := state.Files[stateKey(task.path)]
+    if !ok {
+        return ""
+    }
+
+    compressed := task.attrs&windows.FILE_ATTRIBUTE_COMPRESSED != 0
+    if (last.Action == ACTION_COMPRESS) == compressed {
+        return ""
+    }
+    return last.Action
+}
+
+// lastRunStart returns when the last run over root started, or the zero
+// time if there was none.
+func lastRunStart(root string) time.Time {
+    if state == nil {
+        return time.Time{}
+    }
+    return state.LastRun[stateKey(root)]
+}
+
+// recordRunStart remembers the start of this run for each root.
+func recordRunStart(s *runState, roots []string, start time.Time) {
+    if s.LastRun == nil {
+        s.LastRun = map[string]time.Time{}
+    }
+    for _, root := range roots {
+        s.LastRun[stateKey(root)] = start.UTC()
+    }
+}
+
+// parseSince parses a -since value: a date, a date and time, or an age
+// such as 30d counted back from now.
+func parseSince(value string) (time.Time, error) {
+    for _, layout := range []string{"2006-01-02", "2006-01-02T15:04:05", time.RFC3339} {
+        if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+            return t, nil
+        }
+    }
+    if age, err := parseAge(value); err == nil {
+        return time.Now().Add(-age), nil
+    }
+    return time.Time{}, fmt.Errorf("invalid -since value %q (want a date such as 2024-01-01 or an age such as 30d)", value)
+}
+
+// recentlyEvaluated reports whether a file is unchanged, was evaluated under
+// the current policy and is still within its re-evaluation interval.
+func recentlyEvaluated(task fileTask, shard *statsShard) bool {
+    if state == nil {
+        return false
+    }
+
+    key := stateKey(task.path)
+    after := opts.ReevaluateAfter.reevaluateAfter(key)
+    if after <= 0 {
+        return false
+    }
+
+    last, ok := state.Files[key]
+    if !ok {
+        return false
+    }
+    if last.Size != task.size ||
+        !last.ModTime.Equal(task.modTime) ||
+        last.Policy != policyFingerprint() ||
+        time.Since(last.Evaluated) >= after {
+        return false
+    }
+
+    // Some applications restore the modification time after rewriting
+    if opts.VerifyHash.covers(key) {
+        hash, err := quickHash(task.path, task.size, &shard.io)
+        if err != nil || hash != last.Hash {
+            return false
+        }
+    }
+    return true
+}
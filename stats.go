@@ -0,0 +1,234 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// statsShard holds the counters of a single worker or walker. Only the
+// owner writes to it, so updates never contend; the atomics are there so
+// merged snapshots can be taken while the run is in progress.
+type statsShard struct {
+    filesProcessed     atomic.Int64
+    filesCompressed    atomic.Int64
+    filesDecompressed  atomic.Int64
+    filesActiveSkipped atomic.Int64
+    earlyStops         atomic.Int64
+    filesSampled       atomic.Int64
+    filesPanicked      atomic.Int64
+    filesQuarantined   atomic.Int64
+    filesBorderline    atomic.Int64
+    filesVerified      atomic.Int64
+    filesVerifyChanged atomic.Int64
+    filesUnchanged     atomic.Int64
+    filesDrifted       atomic.Int64
+    filesReverted      atomic.Int64 // Decompressed again for saving too little
+    filesTooCostly     atomic.Int64 // Worth compressing but for the CPU cost of reading them
+    filesResumed       atomic.Int64 // Done by the run resumed from, see -resume
+    spaceSaved         atomic.Int64
+    spaceReexpanded    atomic.Int64 // Allocation given up by the decompress subcommand
+    filesFinished      atomic.Int64 // Whatever the result, for -progress
+    bytesFinished      atomic.Int64
+
+    // Decisions recommended (or planned) but not applied
+    filesPlannedCompress   atomic.Int64
+    filesPlannedDecompress atomic.Int64
+    spaceProjected         atomic.Int64
+
+    // Current state found by the status subcommand
+    sizeExamined          atomic.Int64
+    storedExamined        atomic.Int64
+    filesAttrCompressed   atomic.Int64 // With FILE_ATTRIBUTE_COMPRESSED set
+    filesFoundCompressed  atomic.Int64
+    sizeFoundCompressed   atomic.Int64
+    storedFoundCompressed atomic.Int64
+
+    // Offline and HSM stubs, counted but never read so they aren't recalled
+    stubFiles atomic.Int64
+    stubBytes atomic.Int64
+
+    // Estimates degraded to smaller samples by -memory-limit
+    degradedEstimates atomic.Int64
+
+    // Files compressed with each WOF algorithm by -backend auto, indexed by
+    // FILE_PROVIDER_COMPRESSION_* value
+    wofChosen [4]atomic.Int64
+
+    // Time spent in file system calls for -measure-filters
+    io ioTimings
+
+    // Decisions recorded for -write-plan, owned by the worker like the counters
+    plan []planEntry
+
+    // Space saved per directory, merged into the directory report at the end
+    dirSavings map[string]int64
+
+    // Estimates per extension, for the analyze breakdown
+    extensionTotals map[string]*extensionTotals
+
+    // Space saved per file owner, for the quota report
+    ownerSavings map[ownerKey]int64
+
+    // Projected allocation per backend and directory for -forecast
+    dirForecasts map[string]*backendForecast
+
+    // Evaluations to remember in the -state file
+    stateUpdates map[string]*fileState
+
+    // Files whose processing failed or that were skipped unexpectedly, for
+    // the run manifest
+    errors  []fileError
+    skipped []fileError
+
+    // Failure history to remember in the -state file, and the files skipped
+    // because of it
+    failureUpdates map[string]*fileFailure
+    quarantined    []string
+
+    // Compressed files likely to suffer read amplification
+    randomAccess []fileRecord
+
+    // Files the quick pass of -two-pass left for the deep pass
+    deferred []fileTask
+
+    // File being processed, read by the stall watchdog
+    current atomic.Pointer[inFlight]
+
+    // Oplock held on the file being processed, see takeOplock
+    oplock *oplockGuard
+
+    // Per-file outcomes, only kept when a per-file report was requested
+    files []fileRecord
+
+    _ [64]byte // Keep neighbouring shards off the same cache line
+}
+
+// statsSnapshot is a point-in-time merge of all shards.
+type statsSnapshot struct {
+    FilesProcessed     int64
+    FilesCompressed    int64
+    FilesDecompressed  int64
+    FilesActiveSkipped int64
+    EarlyStops         int64
+    FilesSampled       int64
+    FilesPanicked      int64
+    FilesQuarantined   int64
+    FilesBorderline    int64
+    FilesVerified      int64
+    FilesVerifyChanged int64
+    FilesUnchanged     int64
+    FilesDrifted       int64
+    FilesReverted      int64
+    FilesTooCostly     int64
+    FilesResumed       int64
+    SpaceSaved         int64
+    SpaceReexpanded    int64
+    FilesFinished      int64
+    BytesFinished      int64
+
+    FilesPlannedCompress   int64
+    FilesPlannedDecompress int64
+    SpaceProjected         int64
+
+    SizeExamined          int64
+    StoredExamined        int64
+    FilesAttrCompressed   int64
+    FilesFoundCompressed  int64
+    SizeFoundCompressed   int64
+    StoredFoundCompressed int64
+
+    // Only printed in the summary
+    stubFiles         int64
+    stubBytes         int64
+    degradedEstimates int64
+    wofChosen         [4]int64
+    io                ioTotals
+}
+
+// statsRegistry tracks the shards of all workers. Its lock is only taken
+// when a worker starts and when a snapshot is merged, never per file.
+type statsRegistry struct {
+    mu     sync.Mutex
+    shards []*statsShard
+}
+
+var stats statsRegistry
+
+func (r *statsRegistry) newShard() *statsShard {
+    shard := &statsShard{}
+    r.mu.Lock()
+    r.shards = append(r.shards, shard)
+    r.mu.Unlock()
+    return shard
+}
+
+func (r *statsRegistry) snapshot() statsSnapshot {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    var s statsSnapshot
+    for _, shard := range r.shards {
+        s.FilesProcessed += shard.filesProcessed.Load()
+        s.FilesCompressed += shard.filesCompressed.Load()
+        s.FilesDecompressed += shard.filesDecompressed.Load()
+        s.FilesActiveSkipped += shard.filesActiveSkipped.Load()
+        s.EarlyStops += shard.earlyStops.Load()
+        s.FilesSampled += shard.filesSampled.Load()
+        s.FilesPanicked += shard.filesPanicked.Load()
+        s.FilesQuarantined += shard.filesQuarantined.Load()
+        s.FilesBorderline += shard.filesBorderline.Load()
+        s.FilesVerified += shard.filesVerified.Load()
+        s.FilesVerifyChanged += shard.filesVerifyChanged.Load()
+        s.FilesUnchanged += shard.filesUnchanged.Load()
+        s.FilesDrifted += shard.filesDrifted.Load()
+        s.FilesReverted += shard.filesReverted.Load()
+        s.FilesTooCostly += shard.filesTooCostly.Load()
+        s.FilesResumed += shard.filesResumed.Load()
+        s.FilesFinished += shard.filesFinished.Load()
+        s.BytesFinished += shard.bytesFinished.Load()
+        s.SpaceSaved += shard.spaceSaved.Load()
+        s.SpaceReexpanded += shard.spaceReexpanded.Load()
+        s.FilesPlannedCompress += shard.filesPlannedCompress.Load()
+        s.FilesPlannedDecompress += shard.filesPlannedDecompress.Load()
+        s.SpaceProjected += shard.spaceProjected.Load()
+        s.SizeExamined += shard.sizeExamined.Load()
+        s.StoredExamined += shard.storedExamined.Load()
+        s.FilesAttrCompressed += shard.filesAttrCompressed.Load()
+        s.FilesFoundCompressed += shard.filesFoundCompressed.Load()
+        s.SizeFoundCompressed += shard.sizeFoundCompressed.Load()
+        s.StoredFoundCompressed += shard.storedFoundCompressed.Load()
+        s.stubFiles += shard.stubFiles.Load()
+        s.stubBytes += shard.stubBytes.Load()
+        s.degradedEstimates += shard.degradedEstimates.Load()
+        for i := range shard.wofChosen {
+            s.wofChosen[i] += shard.wofChosen[i].Load()
+        }
+        s.io.opens += shard.io.opens.Load()
+        for i := range shard.io.times {
+            s.io.times[i] += time.Duration(shard.io.times[i].Load())
+        }
+    }
+    return s
+}
+
+func printStatus(s statsSnapshot) {
+    fmt.Printf("Status: %d processed, %d compressed, %d decompressed, %d bytes saved\n",
+        s.FilesProcessed, s.FilesCompressed, s.FilesDecompressed, s.SpaceSaved)
+}
+
+// reportStatus prints a merged snapshot every interval until done is closed.
+func reportStatus(interval time.Duration, done <-chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            printStatus(stats.snapshot())
+        case <-done:
+            return
+        }
+    }
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "os"
+    "strings"
+    "time"
+
+    "golang.org/x/sys/windows/registry"
+)
+
+const (
+    STATUS_REGISTRY_KEY = `SOFTWARE\ntfs_pancake\Runs`
+    DEFAULT_RUN_NAME    = "default"
+
+    RUN_STATE_RUNNING   = "Running"
+    RUN_STATE_COMPLETED = "Completed"
+)
+
+// runStatusKey returns the registry key holding the status of the current
+// run name, so each logical job keeps its own last-run summary.
+func runStatusKey() string {
+    name := opts.RunName
+    if name == "" {
+        name = DEFAULT_RUN_NAME
+    }
+    return STATUS_REGISTRY_KEY + `\` + name
+}
+
+// publishRunStarted records that a run is in progress for management tools
+// (SCCM/Intune compliance scripts, Get-PancakeStatus.ps1).
+func publishRunStarted(startTime time.Time) error {
+    key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, runStatusKey(), registry.SET_VALUE)
+    if err != nil {
+        return err
+    }
+    defer key.Close()
+
+    values := map[string]string{
+        "State":     RUN_STATE_RUNNING,
+        "Root":      strings.Join(opts.Roots, "; "),
+        "StartTime": startTime.UTC().Format(time.RFC3339),
+        "EndTime":   "",
+    }
+    for name, value := range values {
+        if err := key.SetStringValue(name, value); err != nil {
+            return err
+        }
+    }
+    return key.SetDWordValue("ProcessId", uint32(os.Getpid()))
+}
+
+// publishRunCompleted records the summary of a finished run.
+func publishRunCompleted(endTime time.Time, summary statsSnapshot) error {
+    key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, runStatusKey(), registry.SET_VALUE)
+    if err != nil {
+        return err
+    }
+    defer key.Close()
+
+    if err := key.SetStringValue("State", RUN_STATE_COMPLETED); err != nil {
+        return err
+    }
+    if err := key.SetStringValue("EndTime", endTime.UTC().Format(time.RFC3339)); err != nil {
+        return err
+    }
+
+    counters := map[string]int64{
+        "FilesProcessed":     summary.FilesProcessed,
+        "FilesCompressed":    summary.FilesCompressed,
+        "FilesDecompressed":  summary.FilesDecompressed,
+        "FilesActiveSkipped": summary.FilesActiveSkipped,
+        "SpaceSaved":         summary.SpaceSaved,
+    }
+    for name, value := range counters {
+        if err := key.SetQWordValue(name, uint64(value)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+)
+
+// Kinds of problems that make a -strict run fail
+const (
+    PROBLEM_VOLUME      = "volume"      // Root on a volume that can't be used
+    PROBLEM_WALK        = "walk"        // Path the walk couldn't list or read
+    PROBLEM_FILE        = "file"        // File whose processing failed
+    PROBLEM_QUARANTINED = "quarantined" // File skipped for failing in earlier runs
+)
+
+// strictProblem is something -strict doesn't let pass: anything leaving a
+// file unprocessed for a reason other than the policy.
+type strictProblem struct {
+    kind   string
+    path   string
+    detail string
+}
+
+var (
+    problemsMu sync.Mutex
+    problems   []strictProblem
+)
+
+// recordProblem remembers a problem for the -strict report. File errors and
+// quarantined files are collected from the shards instead.
+func recordProblem(kind string, path string, detail string) {
+    if !opts.Strict {
+        return
+    }
+    problemsMu.Lock()
+    defer problemsMu.Unlock()
+    problems = append(problems, strictProblem{kind: kind, path: path, detail: detail})
+}
+
+// strictProblems returns all problems of the run, sorted by path.
+func strictProblems() []strictProblem {
+    problemsMu.Lock()
+    all := append([]strictProblem(nil), problems...)
+    problemsMu.Unlock()
+
+    stats.mu.Lock()
+    for _, shard := range stats.shards {
+        for _, e := range shard.errors {
+            all = append(all, strictProblem{kind: PROBLEM_FILE, path: e.Path, detail: string(e.Result)})
+        }
+        for _, path := range shard.quarantined {
+            all = append(all, strictProblem{kind: PROBLEM_QUARANTINED, path: path})
+        }
+    }
+    stats.mu.Unlock()
+
+    sort.Slice(all, func(i, j int) bool {
+        if all[i].path != all[j].path {
+            return all[i].path < all[j].path
+        }
+        return all[i].kind < all[j].kind
+    })
+    return all
+}
+
+// reportStrict lists every problem of a -strict run and reports whether
+// there were any, in which case the run has to fail.
+func reportStrict() bool {
+    all := strictProblems()
+    // The JSON summary lists the problems already
+    if opts.Output == OUTPUT_JSON {
+        return len(all) > 0
+    }
+    if len(all) == 0 {
+        fmt.Printf("Strict mode: every file was covered\n")
+        return false
+    }
+
+    fmt.Printf("\nStrict mode: %d unexpected conditions, failing the run:\n", len(all))
+    for _, p := range all {
+        if p.detail != "" {
+            fmt.Printf("  %-12s %s: %s\n", p.kind, displayPath(p.path), p.detail)
+        } else {
+            fmt.Printf("  %-12s %s\n", p.kind, displayPath(p.path))
+        }
+    }
+    return true
+}
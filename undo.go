@@ -0,0 +1,158 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "sort"
+)
+
+// undoTarget is what the undo subcommand does to one path: restore how it
+// was stored before the first change in the log, provided it is still
+// stored as the last change left it.
+type undoTarget struct {
+    original string
+    last     string
+}
+
+// readUndoTargets reads an -audit-log. Entries written before the log
+// recorded previous states can't be undone and are counted instead.
+func readUndoTargets(path string) (map[string]*undoTarget, int, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer f.Close()
+
+    targets := map[string]*undoTarget{}
+    unknown := 0
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 1<<20)
+    for scanner.Scan() {
+        var entry auditEntry
+        // A line torn by a crash leaves the change it would have described
+        if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+            continue
+        }
+        if entry.Previous == "" || entry.New == "" {
+            unknown++
+            continue
+        }
+        t, ok := targets[entry.Path]
+        if !ok {
+            t = &undoTarget{original: entry.Previous}
+            targets[entry.Path] = t
+        }
+        t.last = entry.New
+    }
+    return targets, unknown, scanner.Err()
+}
+
+// restoreStorage stores path as stored again, from current.
+func restoreStorage(path string, current string, stored string) error {
+    switch stored {
+    case STORED_UNCOMPRESSED:
+        return removeWofCompression(path, nil)
+    case BACKEND_NAME_NTFS:
+        if current != STORED_UNCOMPRESSED {
+            if err := removeWofCompression(path, nil); err != nil {
+                return err
+            }
+        }
+        return setCompression(path, COMPRESSION_FORMAT_DEFAULT, nil)
+    }
+
+    algorithm, ok := wofAlgorithms[stored]
+    if !ok {
+        return fmt.Errorf("unknown compression %q", stored)
+    }
+    if current != STORED_UNCOMPRESSED && current != BACKEND_NAME_NTFS {
+        if err := removeWofCompression(path, nil); err != nil {
+            return err
+        }
+    }
+    return setWofCompression(path, algorithm, nil)
+}
+
+// runUndo restores the compression state every file and folder in an
+// -audit-log had before the runs that wrote it. Paths changed since by
+// something else are left alone.
+func runUndo(args []string) error {
+    fs := flag.NewFlagSet(os.Args[0]+" undo", flag.ContinueOnError)
+    dryRun := fs.Bool("dry-run", false, "only list what would be restored")
+    fs.BoolVar(&opts.Verbose, "v", false, "print a line for every path restored")
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "Usage: %s undo [options] <audit log>\n\nOptions:\n", os.Args[0])
+        fs.PrintDefaults()
+    }
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() != 1 {
+        fs.Usage()
+        return fmt.Errorf("no audit log given")
+    }
+    opts.Verbosity = VERBOSITY_NORMAL
+    if opts.Verbose || *dryRun {
+        opts.Verbosity = VERBOSITY_VERBOSE
+    }
+
+    targets, unknown, err := readUndoTargets(fs.Arg(0))
+    if err != nil {
+        return fmt.Errorf("reading audit log %s: %v", fs.Arg(0), err)
+    }
+    paths := make([]string, 0, len(targets))
+    for path := range targets {
+        paths = append(paths, path)
+    }
+    sort.Strings(paths)
+
+    restored, unchanged, changed, failed := 0, 0, 0, 0
+    for _, path := range paths {
+        t := targets[path]
+        attrs, err := getFileAttributes(path)
+        if err != nil {
+            noticef("Error accessing %s: %v\n", path, err)
+            failed++
+            continue
+        }
+        current := storedAs(path, attrs, nil)
+        switch {
+        case current == t.original:
+            unchanged++
+            continue
+        case current != t.last:
+            noticef("Leaving %s alone, it was changed since (%s, the log left it %s)\n", path, current, t.last)
+            changed++
+            continue
+        }
+
+        if *dryRun {
+            verbosef("Would restore %s from %s to %s\n", path, current, t.original)
+            restored++
+            continue
+        }
+        if err := restoreStorage(path, current, t.original); err != nil {
+            noticef("Error restoring %s to %s: %v\n", path, t.original, err)
+            failed++
+            continue
+        }
+        verbosef("Restored %s from %s to %s\n", path, current, t.original)
+        restored++
+    }
+
+    verb := "Restored"
+    if *dryRun {
+        verb = "Would restore"
+    }
+    fmt.Printf("\n%s: %d, already as before: %d, changed since and left alone: %d, failed: %d\n", verb, restored, unchanged, changed, failed)
+    if unknown > 0 {
+        fmt.Printf("Changes logged without their previous state, by older versions, not undone: %d\n", unknown)
+    }
+    if failed > 0 {
+        return fmt.Errorf("%d paths could not be restored", failed)
+    }
+    return nil
+}
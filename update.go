@@ -0,0 +1,245 @@
+package main
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+const (
+    UPDATE_POLICY_KEY    = POLICY_REGISTRY_KEY + `\SelfUpdate`
+    UPDATE_TIMEOUT       = 5 * time.Minute
+    GITHUB_SOURCE_PREFIX = "github:"
+    DEFAULT_UPDATE_ASSET = "ntfs_pancake.exe"
+)
+
+// updateSource is a binary to update to, with where to find its checksum
+// and signature.
+type updateSource struct {
+    version      string // Release tag, empty when unknown
+    binaryURL    string
+    checksumURL  string
+    signatureURL string
+}
+
+// githubRelease is the part of the GitHub releases API response used here.
+type githubRelease struct {
+    TagName string `json:"tag_name"`
+    Assets  []struct {
+        Name string `json:"name"`
+        URL  string `json:"browser_download_url"`
+    } `json:"assets"`
+}
+
+func download(url string) ([]byte, error) {
+    client := &http.Client{Timeout: UPDATE_TIMEOUT}
+    resp, err := client.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+    }
+    return io.ReadAll(resp.Body)
+}
+
+// resolveUpdateSource turns -url into the URLs to download. A URL of the
+// form github:owner/repo means the latest release of that repository, whose
+// assets must include the binary, <binary>.sha256 and <binary>.sig.
+func resolveUpdateSource(url string, asset string) (updateSource, error) {
+    if !strings.HasPrefix(url, GITHUB_SOURCE_PREFIX) {
+        return updateSource{binaryURL: url, checksumURL: url + ".sha256", signatureURL: url + ".sig"}, nil
+    }
+
+    repo := strings.TrimPrefix(url, GITHUB_SOURCE_PREFIX)
+    data, err := download("https://api.github.com/repos/" + repo + "/releases/latest")
+    if err != nil {
+        return updateSource{}, err
+    }
+    var release githubRelease
+    if err := json.Unmarshal(data, &release); err != nil {
+        return updateSource{}, fmt.Errorf("parsing release of %s: %v", repo, err)
+    }
+
+    source := updateSource{version: release.TagName}
+    for _, a := range release.Assets {
+        switch a.Name {
+        case asset:
+            source.binaryURL = a.URL
+        case asset + ".sha256":
+            source.checksumURL = a.URL
+        case asset + ".sig":
+            source.signatureURL = a.URL
+        }
+    }
+    if source.binaryURL == "" || source.checksumURL == "" || source.signatureURL == "" {
+        return updateSource{}, fmt.Errorf("release %s of %s has no %s with a checksum and signature", release.TagName, repo, asset)
+    }
+    return source, nil
+}
+
+// parseChecksum finds the SHA-256 in a checksum file, which may hold just
+// the hash or lines of hash and file name in either order.
+func parseChecksum(data []byte) ([]byte, error) {
+    for _, field := range strings.Fields(string(data)) {
+        if sum, err := hex.DecodeString(field); err == nil && len(sum) == sha256.Size {
+            return sum, nil
+        }
+    }
+    return nil, fmt.Errorf("no SHA-256 checksum found")
+}
+
+// parseSignature reads a signature file, holding either the raw Ed25519
+// signature, as "openssl pkeyutl -sign -rawin" writes it, or its base64.
+func parseSignature(data []byte) ([]byte, error) {
+    if len(data) == ed25519.SignatureSize {
+        return data, nil
+    }
+    signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+    if err != nil || len(signature) != ed25519.SignatureSize {
+        return nil, fmt.Errorf("not an Ed25519 signature")
+    }
+    return signature, nil
+}
+
+// replaceExecutable swaps the running binary for data. Windows doesn't allow
+// overwriting a running executable but does allow renaming it, so the old
+// binary is moved aside and removed by the next run.
+func replaceExecutable(data []byte) error {
+    exe, err := os.Executable()
+    if err != nil {
+        return err
+    }
+
+    next := exe + ".new"
+    if err := os.WriteFile(next, data, 0755); err != nil {
+        return err
+    }
+    old := exe + ".old"
+    os.Remove(old)
+    if err := os.Rename(exe, old); err != nil {
+        os.Remove(next)
+        return err
+    }
+    if err := os.Rename(next, exe); err != nil {
+        // Put the original back so the machine isn't left without a binary
+        os.Rename(old, exe)
+        return err
+    }
+    return nil
+}
+
+// removeReplacedExecutable deletes the binary left behind by an update.
+func removeReplacedExecutable() {
+    if exe, err := os.Executable(); err == nil {
+        os.Remove(exe + ".old")
+    }
+}
+
+// updateOptions are the options of the self-update subcommand.
+type updateOptions struct {
+    url     string
+    asset   string
+    keyFile string
+    force   bool
+}
+
+func (u *updateOptions) defineFlags(fs *flag.FlagSet) {
+    fs.StringVar(&u.url, "url", "",
+        "binary to update to, with its checksum at <url>.sha256, or github:owner/repo for the latest release")
+    fs.StringVar(&u.asset, "asset", DEFAULT_UPDATE_ASSET,
+        "name of the binary among the release assets for github: URLs")
+    fs.StringVar(&u.keyFile, "key", "",
+        "Ed25519 public key in a PEM file that the binary's signature at <url>.sig must verify with; required, unsigned updates are refused")
+    fs.BoolVar(&u.force, "force", false,
+        "update even when the release matches the running version")
+}
+
+// selfUpdate implements the self-update subcommand.
+func selfUpdate(args []string) error {
+    var u updateOptions
+    fs := flag.NewFlagSet(os.Args[0]+" self-update", flag.ContinueOnError)
+    u.defineFlags(fs)
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if err := applyPolicyKey(fs, UPDATE_POLICY_KEY); err != nil {
+        return err
+    }
+    if u.url == "" {
+        return fmt.Errorf("no update -url given or configured under HKLM\\%s", UPDATE_POLICY_KEY)
+    }
+
+    // The checksum comes from wherever the binary does, so only the
+    // signature says who built it
+    if u.keyFile == "" {
+        return fmt.Errorf("no update signing -key given or configured under HKLM\\%s; unsigned updates are refused", UPDATE_POLICY_KEY)
+    }
+    key, err := readSigningKey(u.keyFile)
+    if err != nil {
+        return err
+    }
+
+    source, err := resolveUpdateSource(u.url, u.asset)
+    if err != nil {
+        return err
+    }
+    // buildVersion adds the revision after the module version, which must
+    // match exactly: a build of v1.2.3 is not already at v1.2.30
+    current, _, _ := strings.Cut(buildVersion(), " ")
+    if source.version != "" && current == source.version && !u.force {
+        fmt.Printf("Already at %s\n", source.version)
+        return nil
+    }
+
+    binary, err := download(source.binaryURL)
+    if err != nil {
+        return err
+    }
+    checksumFile, err := download(source.checksumURL)
+    if err != nil {
+        return err
+    }
+    want, err := parseChecksum(checksumFile)
+    if err != nil {
+        return fmt.Errorf("checksum %s: %v", source.checksumURL, err)
+    }
+    got := sha256.Sum256(binary)
+    if !bytes.Equal(got[:], want) {
+        return fmt.Errorf("checksum mismatch for %s", source.binaryURL)
+    }
+
+    signatureFile, err := download(source.signatureURL)
+    if err != nil {
+        return err
+    }
+    signature, err := parseSignature(signatureFile)
+    if err != nil {
+        return fmt.Errorf("signature %s: %v", source.signatureURL, err)
+    }
+    if !key.verify(binary, signature) {
+        return fmt.Errorf("invalid signature for %s", source.binaryURL)
+    }
+
+    if err := replaceExecutable(binary); err != nil {
+        return fmt.Errorf("replacing binary: %v", err)
+    }
+    if source.version != "" {
+        fmt.Printf("Updated from %s to %s\n", current, source.version)
+    } else {
+        fmt.Printf("Updated from %s\n", current)
+    }
+    return nil
+}
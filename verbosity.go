@@ -0,0 +1,37 @@
+package main
+
+import "fmt"
+
+// Output levels selected with -q, -v and -vv. The summary and errors that
+// end the run are printed at every level.
+const (
+    VERBOSITY_QUIET   = iota // Summary only
+    VERBOSITY_NORMAL         // Warnings, errors and notices about the run too
+    VERBOSITY_VERBOSE        // A line for every file
+    VERBOSITY_DEBUG          // Details of every decision
+)
+
+// noticef prints warnings, per-file errors and notices about the run.
+// Each of these also goes to the -log-file, whatever the verbosity.
+func noticef(format string, args ...any) {
+    runLog.logf(LOG_NOTICE, format, args...)
+    if opts.Verbosity >= VERBOSITY_NORMAL {
+        fmt.Printf(format, args...)
+    }
+}
+
+// verbosef prints what happens to each file.
+func verbosef(format string, args ...any) {
+    runLog.logf(LOG_FILE, format, args...)
+    if opts.Verbosity >= VERBOSITY_VERBOSE {
+        fmt.Printf(format, args...)
+    }
+}
+
+// debugf prints how decisions were reached.
+func debugf(format string, args ...any) {
+    runLog.logf(LOG_DEBUG, format, args...)
+    if opts.Verbosity >= VERBOSITY_DEBUG {
+        fmt.Printf(format, args...)
+    }
+}
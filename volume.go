@@ -0,0 +1,164 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "unicode/utf16"
+
+    "golang.org/x/sys/windows"
+)
+
+const (
+    IOCTL_DISK_IS_WRITABLE = 0x00070024
+    FVE_E_LOCKED_VOLUME    = syscall.Errno(0x80310000) // BitLocker volume that hasn't been unlocked
+)
+
+// Folders at the top of a volume that belong to the system. Runs over a
+// whole volume leave them out instead of failing on them with access denied.
+var volumeSystemDirs = map[string]bool{
+    "$recycle.bin":              true,
+    "system volume information": true,
+}
+
+// volumeRoot turns a bare drive letter such as D: into the root of the
+// volume; on its own, D: would mean the current directory of that drive.
+func volumeRoot(root string) string {
+    if len(root) == 2 && root[1] == ':' && 'a' <= root[0]|0x20 && root[0]|0x20 <= 'z' {
+        return root + `\`
+    }
+    return root
+}
+
+// isVolumeRoot reports whether path is the root of a volume or share.
+func isVolumeRoot(path string) bool {
+    path = filepath.Clean(path)
+    return filepath.Dir(path) == path
+}
+
+// volumeInfo describes the volume a root lives on.
+type volumeInfo struct {
+    mountPoint string // e.g. D:\
+    volumeName string // e.g. \\?\Volume{...}\
+    fileSystem string
+    flags      uint32
+}
+
+func getVolumeInfo(path string) (*volumeInfo, error) {
+    absPath, err := filepath.Abs(path)
+    if err != nil {
+        return nil, err
+    }
+    name, err := windows.UTF16PtrFromString(absPath)
+    if err != nil {
+        return nil, err
+    }
+
+    mountPoint := make([]uint16, windows.MAX_PATH+1)
+    if err := windows.GetVolumePathName(name, &mountPoint[0], uint32(len(mountPoint))); err != nil {
+        return nil, err
+    }
+
+    info := &volumeInfo{mountPoint: windows.UTF16ToString(mountPoint)}
+
+    volumeName := make([]uint16, windows.MAX_PATH+1)
+    if err := windows.GetVolumeNameForVolumeMountPoint(&mountPoint[0], &volumeName[0], uint32(len(volumeName))); err == nil {
+        info.volumeName = windows.UTF16ToString(volumeName)
+    }
+
+    fileSystem := make([]uint16, windows.MAX_PATH+1)
+    err = windows.GetVolumeInformation(&mountPoint[0], nil, 0, nil, nil, &info.flags, &fileSystem[0], uint32(len(fileSystem)))
+    if err != nil {
+        return nil, err
+    }
+    info.fileSystem = windows.UTF16ToString(fileSystem)
+
+    return info, nil
+}
+
+// isWriteProtected asks the disk driver whether the media is writable. Media
+// write protection (SD card switch, write-blocked USB) is not always
+// reflected in the volume flags. Any failure to ask counts as writable.
+func isWriteProtected(info *volumeInfo) bool {
+    if info.volumeName == "" {
+        return false
+    }
+
+    device, err := windows.UTF16PtrFromString(strings.TrimSuffix(info.volumeName, `\`))
+    if err != nil {
+        return false
+    }
+    handle, err := windows.CreateFile(device, 0, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil, windows.OPEN_EXISTING, 0, 0)
+    if err != nil {
+        return false
+    }
+    defer windows.CloseHandle(handle)
+
+    var bytesReturned uint32
+    err = windows.DeviceIoControl(handle, IOCTL_DISK_IS_WRITABLE, nil, 0, nil, 0, &bytesReturned, nil)
+    return err == windows.ERROR_WRITE_PROTECT
+}
+
+// checkVolume verifies up front that the volume holding root can be
+// processed, so locked, read-only or unsupported volumes are reported once
+// rather than failing for every file. needWrite is false for runs that
+// only read (writing a plan).
+func checkVolume(root string, needWrite bool) error {
+    info, err := getVolumeInfo(root)
+    switch {
+    case err == FVE_E_LOCKED_VOLUME:
+        return fmt.Errorf("the volume is locked by BitLocker")
+    case err == windows.ERROR_NOT_READY:
+        return fmt.Errorf("the volume is not ready (no media or locked)")
+    case err != nil:
+        return fmt.Errorf("querying volume: %v", err)
+    }
+
+    if info.flags&windows.FILE_FILE_COMPRESSION == 0 {
+        return fmt.Errorf("the %s volume %s does not support file compression", info.fileSystem, info.mountPoint)
+    }
+
+    if !needWrite {
+        return nil
+    }
+    if info.flags&windows.FILE_READ_ONLY_VOLUME != 0 {
+        return fmt.Errorf("the volume %s is read-only", info.mountPoint)
+    }
+    if isWriteProtected(info) {
+        return fmt.Errorf("the media of volume %s is write-protected", info.mountPoint)
+    }
+
+    return nil
+}
+
+// localNtfsVolumes returns the roots of the fixed NTFS volumes that have a
+// drive letter, e.g. C:\ and D:\, for -all-volumes.
+func localNtfsVolumes() ([]string, error) {
+    buffer := make([]uint16, 256)
+    n, err := windows.GetLogicalDriveStrings(uint32(len(buffer)), &buffer[0])
+    if err != nil {
+        return nil, err
+    }
+
+    // The drives are separated by NULs
+    var roots []string
+    for _, drive := range strings.Split(string(utf16.Decode(buffer[:n])), "\x00") {
+        if drive == "" {
+            continue
+        }
+        p, err := windows.UTF16PtrFromString(drive)
+        if err != nil || windows.GetDriveType(p) != windows.DRIVE_FIXED {
+            continue
+        }
+        info, err := getVolumeInfo(drive)
+        if err != nil {
+            noticef("Skipping %s: querying volume: %v\n", drive, err)
+            continue
+        }
+        if strings.EqualFold(info.fileSystem, "NTFS") {
+            roots = append(roots, drive)
+        }
+    }
+    return roots, nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+)
+
+const ROOT_QUEUE_SIZE = 64 // Files each root's walker may list ahead of the workers
+
+// stopWalk is closed to make all walkers give up, e.g. once -limit is reached.
+var (
+    stopWalk     = make(chan struct{})
+    stopWalkOnce sync.Once
+)
+
+func stopWalking() {
+    stopWalkOnce.Do(func() { close(stopWalk) })
+}
+
+// walkStopped reports whether the walk was ended before it got through
+// every file.
+func walkStopped() bool {
+    select {
+    case <-stopWalk:
+        return true
+    default:
+        return false
+    }
+}
+
+// pathDepth returns how many levels below root path is.
+func pathDepth(root string, path string) int {
+    rel, err := filepath.Rel(root, path)
+    if err != nil || rel == "." {
+        return 0
+    }
+    return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// walkRoot lists the files below root, recording directory sizes in dirs,
+// and queues them for processing.
+func walkRoot(root string, paths chan<- fileTask, dirs dirStats, shard *statsShard) {
+    // Cheap incremental mode based on modification times alone
+    since := opts.Since
+    if opts.SinceLastRun {
+        if last := lastRunStart(root); last.After(since) {
+            since = last
+        }
+    }
+
+    wholeVolume := isVolumeRoot(root)
+
+    // Directories the walk is inside of, for the directory hook and the
+    // change journal; the walk lists each subtree in one go, so leaving it
+    // means it is complete
+    var open []string
+    defer func() {
+        for i := len(open) - 1; i >= 0; i-- {
+            directories.listed(open[i])
+            journal.listed(open[i])
+        }
+    }()
+
+    // Ignore files of the folders the walk is inside of, starting with
+    // those above the root
+    var ignores ignoreStack
+    if opts.IgnoreFile != "" {
+        above, ignored, by := ignoresAbove(root)
+        if ignored {
+            debugf("Skipping %s, ignored by %s\n", root, by)
+            return
+        }
+        ignores = above
+    }
+
+    var visit filepath.WalkFunc
+    visit = func(path string, info os.FileInfo, err error) error {
+        if directories != nil || journal != nil {
+            for len(open) > 0 && !within(open[len(open)-1], path) {
+                directories.listed(open[len(open)-1])
+                journal.listed(open[len(open)-1])
+                open = open[:len(open)-1]
+            }
+        }
+        if err != nil {
+            noticef("Error accessing path %s: %v\n", path, err)
+            recordProblem(PROBLEM_WALK, path, err.Error())
+            return err
+        }
+
+        // Files directly in the root are at depth 1
+        depth := pathDepth(root, path)
+
+        // Symbolic links and junctions are only traversed when asked to,
+        // except for a folder given as one
+        if isLink(info) && depth == 0 {
+            return walkTree(path+`\`, visit)
+        }
+        if isLink(info) {
+            if !opts.FollowLinks {
+                return nil
+            }
+            target, ok := linkTarget(path)
+            if !ok {
+                return nil
+            }
+            if target.IsDir() {
+                if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+                    return nil
+                }
+                // The trailing separator makes the walk follow the link
+                return walkTree(path+`\`, visit)
+            }
+            info = target
+        }
+
+        if opts.IgnoreFile != "" {
+            ignores.enter(path)
+            if ignored, by := ignores.ignored(path, info.IsDir()); ignored {
+                debugf("Skipping %s, ignored by %s\n", path, by)
+                if info.IsDir() {
+                    return filepath.SkipDir
+                }
+                return nil
+            }
+        }
+
+        if info.IsDir() {
+            if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+                return filepath.SkipDir
+            }
+            if opts.Safe && depth > 0 && safeExcluded(path, true) {
+                return filepath.SkipDir
+            }
+            if isReplicationOwned(path) {
+                return filepath.SkipDir
+            }
+            if wholeVolume && depth == 1 && volumeSystemDirs[strings.ToLower(info.Name())] {
+                return filepath.SkipDir
+            }
+            if depth > 0 && opts.Exclude.matches(path) {
+                return filepath.SkipDir
+            }
+            if directories != nil || journal != nil {
+                open = append(open, filepath.Clean(path))
+            }
+            if opts.IgnoreFile != "" {
+                if ignore := loadIgnoreFile(path); ignore != nil {
+                    ignores = append(ignores, ignore)
+                }
+            }
+            if opts.DecompressDirectories {
+                if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+                    decompressDirectory(path, data.FileAttributes)
+                }
+            }
+            return nil
+        }
+        if opts.Safe && safeExcluded(path, false) {
+            return nil
+        }
+        // Excludes win over includes, which only select files
+        if opts.Exclude.matches(path) || opts.Extensions.skipped(path) || (opts.SkipRandomAccess && isRandomAccess(path)) {
+            return nil
+        }
+        if len(opts.Include.patterns) > 0 && !opts.Include.matches(path) {
+            return nil
+        }
+        var attrs uint32
+        if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+            attrs = data.FileAttributes
+        }
+        action := ""
+        if info.Mode().IsRegular() && defaultExcluded(path) {
+            if !excludedButCompressed(attrs) {
+                defaultExcludedFiles.Add(1)
+                defaultExcludedBytes.Add(info.Size())
+                return nil
+            }
+            action = ACTION_DECOMPRESS
+        }
+        if depth < opts.MinDepth {
+            return nil
+        }
+        if info.ModTime().Before(since) {
+            return nil
+        }
+
+        // Only process normal files
+        if info.Mode().IsRegular() {
+            task := fileTask{path: path, modTime: info.ModTime(), size: info.Size(), attrs: attrs, action: action}
+            if isStub(task.attrs) {
+                shard.stubFiles.Add(1)
+                shard.stubBytes.Add(info.Size())
+                return nil
+            }
+            if info.Size() < int64(opts.MinSize) || (opts.MaxSize > 0 && info.Size() > int64(opts.MaxSize)) {
+                return nil
+            }
+            if len(opts.Owners) > 0 && !opts.Owners.matches(path) {
+                return nil
+            }
+            // Counted before a worker can be done with it, and taken back
+            // if the walk stops instead
+            journal.queued(path)
+            select {
+            case paths <- task:
+                // Only files that pass every filter and reach a worker
+                // count towards their folder
+                totals := dirs.get(filepath.Dir(path))
+                totals.size += info.Size()
+                totals.files++
+                directories.queued(path)
+            case <-stopWalk:
+                journal.finished(path)
+                return filepath.SkipAll
+            }
+        }
+
+        return nil
+    }
+
+    if err := walkTree(root, visit); err != nil {
+        noticef("Error scanning folder %s: %v\n", root, err)
+    }
+}
+
+// Targets of the links followed so far, so data reachable through several
+// links is only processed once
+var followedTargets sync.Map
+
+// isLink reports whether info describes a symbolic link or a junction.
+// Other reparse points, like WOF compressed files, are regular files.
+func isLink(info os.FileInfo) bool {
+    data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+    if !ok || data.FileAttributes&syscall.FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+        return false
+    }
+    return info.Mode()&(os.ModeSymlink|os.ModeIrregular) != 0
+}
+
+// linkTarget returns what a link points to, unless it is broken, inside a
+// folder being walked anyway or already followed through another link.
+func linkTarget(path string) (os.FileInfo, bool) {
+    resolved, err := filepath.EvalSymlinks(path)
+    if err != nil {
+        noticef("Error resolving link %s: %v\n", path, err)
+        return nil, false
+    }
+    key := stateKey(resolved)
+    for _, root := range opts.Roots {
+        if rootKey := stateKey(root); key == rootKey || within(rootKey, key) {
+            return nil, false
+        }
+    }
+    if _, seen := followedTargets.LoadOrStore(key, true); seen {
+        return nil, false
+    }
+
+    info, err := os.Stat(path)
+    if err != nil {
+        noticef("Error accessing link target %s: %v\n", path, err)
+        return nil, false
+    }
+    return info, true
+}
+
+// scanAndCompressFolders walks all roots at once and hands their files to
+// the workers round-robin, one root at a time, so a partial run covers
+// every root evenly instead of finishing the first before starting the next.
+func scanAndCompressFolders(roots []string) {
+    feeds := make([]chan fileTask, len(roots))
+    for i, root := range roots {
+        feeds[i] = make(chan fileTask, ROOT_QUEUE_SIZE)
+        dirs := dirStats{}
+        walkDirStats = append(walkDirStats, dirs)
+        shard := stats.newShard() // The walker's own, for the stubs it passes over
+
+        go func(root string, feed chan fileTask) {
+            defer close(feed)
+            walkRoot(root, feed, dirs, shard)
+        }(root, feeds[i])
+    }
+
+    // Files given on their own take their turn like one more root
+    if len(opts.Files) > 0 {
+        feed := make(chan fileTask, ROOT_QUEUE_SIZE)
+        feeds = append(feeds, feed)
+        dirs := dirStats{}
+        walkDirStats = append(walkDirStats, dirs)
+        shard := stats.newShard()
+
+        go func() {
+            defer close(feed)
+            queueFiles(opts.Files, feed, dirs, shard)
+        }()
+    }
+
+    runWorkers(func(paths chan<- fileTask) {
+        queued := 0
+
+        // Roots drop out of the rotation as their walk finishes
+        for len(feeds) > 0 {
+            for i := 0; i < len(feeds); {
+                task, ok := <-feeds[i]
+                if !ok {
+                    feeds = append(feeds[:i], feeds[i+1:]...)
+                    continue
+                }
+                if opts.Limit > 0 && queued >= opts.Limit {
+                    noticef("Reached the limit of %d files, stopping the walk\n", opts.Limit)
+                    stopWalking()
+                    return
+                }
+                task.quick = opts.TwoPass
+                paths <- task
+                countQueued(task)
+                queued++
+                i++
+            }
+        }
+    })
+}
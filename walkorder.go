@@ -0,0 +1,126 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "sort"
+    "time"
+)
+
+const DIR_HISTORY_MIN_SAVED = 1 << 20 // Savings below which a directory is dropped from the state
+
+// dirHistory is what the state remembers of a directory: the space saved
+// in its subtree by the last applying runs, for -order-by-savings.
+type dirHistory struct {
+    Saved   int64     `json:"saved"`
+    Updated time.Time `json:"updated"`
+}
+
+// recordDirHistory updates the directories seen by this run. Those saving
+// nothing this time keep half their savings, so a directory compressed long
+// ago falls behind ones still yielding space without being forgotten at once.
+func recordDirHistory(s *runState, merged dirStats, now time.Time) {
+    if s.Directories == nil {
+        s.Directories = map[string]*dirHistory{}
+    }
+    for dir, t := range merged {
+        key := stateKey(dir)
+        saved := t.saved
+        if last, ok := s.Directories[key]; ok && saved < last.Saved/2 {
+            saved = last.Saved / 2
+        }
+        if saved < DIR_HISTORY_MIN_SAVED {
+            delete(s.Directories, key)
+            continue
+        }
+        s.Directories[key] = &dirHistory{Saved: saved, Updated: now.UTC()}
+    }
+}
+
+// historicalSavings returns what the subtree of dir saved before.
+func historicalSavings(dir string) int64 {
+    if last, ok := state.Directories[stateKey(dir)]; ok {
+        return last.Saved
+    }
+    return 0
+}
+
+// walkTree is filepath.Walk, except that with -order-by-savings the
+// subdirectories that saved the most before are visited first, so an
+// interrupted run still gets most of what there is to save.
+func walkTree(root string, fn filepath.WalkFunc) error {
+    if !opts.OrderBySavings || state == nil || len(state.Directories) == 0 {
+        return filepath.Walk(root, fn)
+    }
+
+    info, err := os.Lstat(root)
+    if err != nil {
+        err = fn(root, nil, err)
+    } else {
+        err = walkOrdered(root, info, fn)
+    }
+    if err == filepath.SkipDir || err == filepath.SkipAll {
+        return nil
+    }
+    return err
+}
+
+// walkOrdered walks path like filepath.Walk does, with the entries of each
+// directory sorted by historicalSavings and then by name.
+func walkOrdered(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+    if !info.IsDir() {
+        return fn(path, info, nil)
+    }
+
+    names, err := readDirNames(path)
+    err1 := fn(path, info, err)
+    if err != nil || err1 != nil {
+        return err1
+    }
+
+    type entry struct {
+        path  string
+        info  os.FileInfo
+        err   error
+        saved int64
+    }
+    entries := make([]entry, len(names))
+    for i, name := range names {
+        e := entry{path: filepath.Join(path, name)}
+        e.info, e.err = os.Lstat(e.path)
+        if e.err == nil && e.info.IsDir() {
+            e.saved = historicalSavings(e.path)
+        }
+        entries[i] = e
+    }
+    sort.SliceStable(entries, func(i, j int) bool { return entries[i].saved > entries[j].saved })
+
+    for _, e := range entries {
+        if e.err != nil {
+            if err := fn(e.path, e.info, e.err); err != nil && err != filepath.SkipDir {
+                return err
+            }
+            continue
+        }
+        err = walkOrdered(e.path, e.info, fn)
+        if err != nil && (!e.info.IsDir() || err != filepath.SkipDir) {
+            return err
+        }
+    }
+    return nil
+}
+
+// readDirNames returns the sorted names of the entries of dir.
+func readDirNames(dir string) ([]string, error) {
+    f, err := os.Open(dir)
+    if err != nil {
+        return nil, err
+    }
+    names, err := f.Readdirnames(-1)
+    f.Close()
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(names)
+    return names, nil
+}
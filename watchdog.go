@@ -0,0 +1,63 @@
+package main
+
+import (
+    "runtime"
+    "sync/atomic"
+    "time"
+)
+
+const DEFAULT_STALL_TIMEOUT = 10 * time.Minute
+
+// inFlight is the file a worker is busy with.
+type inFlight struct {
+    path     string
+    start    time.Time
+    reported atomic.Bool
+}
+
+// startFile and finishFile track the file the shard's worker is on, for
+// the stall watchdog.
+func (shard *statsShard) startFile(path string) {
+    shard.current.Store(&inFlight{path: path, start: time.Now()})
+}
+
+func (shard *statsShard) finishFile() {
+    shard.current.Store(nil)
+}
+
+// watchStalls reports workers stuck on one file for longer than timeout,
+// typically inside a hung filter driver, until done is closed. Each stuck
+// file is reported once; the stacks of all goroutines are dumped with the
+// first report.
+func watchStalls(timeout time.Duration, done <-chan struct{}) {
+    ticker := time.NewTicker(min(timeout, time.Minute))
+    defer ticker.Stop()
+
+    dumped := false
+    for {
+        select {
+        case <-ticker.C:
+        case <-done:
+            return
+        }
+
+        stats.mu.Lock()
+        shards := append([]*statsShard(nil), stats.shards...)
+        stats.mu.Unlock()
+
+        for _, shard := range shards {
+            f := shard.current.Load()
+            if f == nil || time.Since(f.start) < timeout || f.reported.Swap(true) {
+                continue
+            }
+
+            noticef("Worker stalled for %v on %s (%d goroutines running)\n",
+                time.Since(f.start).Round(time.Second), f.path, runtime.NumGoroutine())
+            if !dumped {
+                dumped = true
+                buf := make([]byte, 1<<20)
+                noticef("Goroutine stacks:\n%s\n", buf[:runtime.Stack(buf, true)])
+            }
+        }
+    }
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "unsafe"
+
+    "golang.org/x/sys/windows"
+)
+
+// Wrappers around the Windows calls that take raw pointers, keeping the
+// pointer and word-size handling in one place so callers are the same on
+// amd64, arm64 and 386. Pointers are converted inside the Call argument
+// lists, where the runtime keeps their targets alive for the call.
+
+var (
+    ntdll                              = windows.NewLazySystemDLL("ntdll.dll")
+    procRtlCompressBuffer              = ntdll.NewProc("RtlCompressBuffer")
+    procRtlGetCompressionWorkSpaceSize = ntdll.NewProc("RtlGetCompressionWorkSpaceSize")
+)
+
+// ioctlIn issues a control code whose input buffer is the fixed-size value
+// in and which returns no output.
+func ioctlIn[T any](handle windows.Handle, code uint32, in *T) error {
+    var bytesReturned uint32
+    return windows.DeviceIoControl(handle, code, (*byte)(unsafe.Pointer(in)), uint32(unsafe.Sizeof(*in)), nil, 0, &bytesReturned, nil)
+}
+
+// NTSTATUS is 32 bits wide; on 64-bit systems the upper half of the return
+// register is undefined, so only the low 32 bits are looked at.
+func ntStatus(r uintptr) uint32 {
+    return uint32(r)
+}
+
+func rtlGetCompressionWorkSpaceSize(format uint16) (uint32, uint32, uint32) {
+    var workspaceSize, fragmentSize uint32
+    r, _, _ := procRtlGetCompressionWorkSpaceSize.Call(
+        uintptr(format),
+        uintptr(unsafe.Pointer(&workspaceSize)),
+        uintptr(unsafe.Pointer(&fragmentSize)),
+    )
+    return ntStatus(r), workspaceSize, fragmentSize
+}
+
+// rtlCompressBuffer compresses in into out and returns the status and the
+// compressed size. None of the buffers may be empty.
+func rtlCompressBuffer(format uint16, in []byte, out []byte, chunkSize uint32, workspace []byte) (uint32, uint32) {
+    var finalSize uint32
+    r, _, _ := procRtlCompressBuffer.Call(
+        uintptr(format),
+        uintptr(unsafe.Pointer(&in[0])),
+        uintptr(uint32(len(in))),
+        uintptr(unsafe.Pointer(&out[0])),
+        uintptr(uint32(len(out))),
+        uintptr(chunkSize),
+        uintptr(unsafe.Pointer(&finalSize)),
+        uintptr(unsafe.Pointer(&workspace[0])),
+    )
+    return ntStatus(r), finalSize
+}
+
+var procNtQueryQuotaInformationFile = ntdll.NewProc("NtQueryQuotaInformationFile")
+
+// ntQueryQuotaInformationFile reads quota entries of the volume behind
+// handle into buf, which is then parsed byte by byte rather than through a
+// struct so the layout doesn't depend on the architecture.
+func ntQueryQuotaInformationFile(handle windows.Handle, buf []byte, restart bool) uint32 {
+    var iosb windows.IO_STATUS_BLOCK
+    var restartScan uintptr
+    if restart {
+        restartScan = 1
+    }
+    r, _, _ := procNtQueryQuotaInformationFile.Call(
+        uintptr(handle),
+        uintptr(unsafe.Pointer(&iosb)),
+        uintptr(unsafe.Pointer(&buf[0])),
+        uintptr(uint32(len(buf))),
+        0, // Return as many entries as fit
+        0, // No SID list: all users
+        0,
+        0,
+        restartScan,
+    )
+    return ntStatus(r)
+}
+
+const INVALID_FILE_SIZE = 0xFFFFFFFF
+
+var (
+    kernel32                    = windows.NewLazySystemDLL("kernel32.dll")
+    procGetCompressedFileSizeW  = kernel32.NewProc("GetCompressedFileSizeW")
+    procGetConsoleProcessList   = kernel32.NewProc("GetConsoleProcessList")
+    procGetProcessIoCounters    = kernel32.NewProc("GetProcessIoCounters")
+    procGetProcessHandleCount   = kernel32.NewProc("GetProcessHandleCount")
+    procK32GetProcessMemoryInfo = kernel32.NewProc("K32GetProcessMemoryInfo")
+)
+
+// parentProcessName returns the executable name of the process that
+// started us, or an empty string when it can't be found.
+func parentProcessName() string {
+    snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+    if err != nil {
+        return ""
+    }
+    defer windows.CloseHandle(snapshot)
+
+    processes := map[uint32]windows.ProcessEntry32{}
+    entry := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+    for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+        processes[entry.ProcessID] = entry
+    }
+    self, ok := processes[windows.GetCurrentProcessId()]
+    if !ok {
+        return ""
+    }
+    parent, ok := processes[self.ParentProcessID]
+    if !ok {
+        return ""
+    }
+    return windows.UTF16ToString(parent.ExeFile[:])
+}
+
+// consoleProcessCount returns how many processes share our console, or 0
+// when there is none.
+func consoleProcessCount() uint32 {
+    pids := make([]uint32, 4)
+    r, _, _ := procGetConsoleProcessList.Call(uintptr(unsafe.Pointer(&pids[0])), uintptr(len(pids)))
+    return uint32(r)
+}
+
+// getCompressedFileSize returns the bytes a file takes on disk, which is
+// less than its size when it is compressed (by NTFS or WOF) or sparse.
+func getCompressedFileSize(path string) (int64, error) {
+    name, err := windows.UTF16PtrFromString(path)
+    if err != nil {
+        return 0, err
+    }
+    var high uint32
+    r, _, e := procGetCompressedFileSizeW.Call(
+        uintptr(unsafe.Pointer(name)),
+        uintptr(unsafe.Pointer(&high)),
+    )
+    // The low half may legitimately be 0xFFFFFFFF; only the error tells
+    if low := uint32(r); low == INVALID_FILE_SIZE && e != windows.ERROR_SUCCESS {
+        return 0, e
+    }
+    return int64(high)<<32 | int64(uint32(r)), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "strings"
+    "syscall"
+    "time"
+    "unsafe"
+
+    "golang.org/x/sys/windows"
+)
+
+const (
+    FSCTL_SET_EXTERNAL_BACKING    = 0x9030C
+    FSCTL_GET_EXTERNAL_BACKING    = 0x90310
+    FSCTL_DELETE_EXTERNAL_BACKING = 0x90314
+
+    WOF_CURRENT_VERSION           = 1
+    WOF_PROVIDER_FILE             = 2
+    FILE_PROVIDER_CURRENT_VERSION = 1
+
+    ERROR_OBJECT_NOT_EXTERNALLY_BACKED = 342
+
+    STORED_UNCOMPRESSED = "none" // How a file without NTFS or WOF compression is stored, see storedAs
+
+    BACKEND_NAME_NTFS  = "ntfs" // Regular NTFS compression with LZNT1
+    COMPACT_OS_BACKEND = "xpress4k"
+    COMPACT_OS_CONFIRM = "COMPACTOS" // What has to be typed to confirm -compact-os
+)
+
+// wofAlgorithms are the -backend values that compress through the Windows
+// Overlay Filter instead of NTFS, with their FILE_PROVIDER_COMPRESSION_*
+// values. WOF files stay readable by everything; on the first write the
+// file is decompressed transparently.
+var wofAlgorithms = map[string]uint32{
+    "xpress4k":  0,
+    "lzx":       1,
+    "xpress8k":  2,
+    "xpress16k": 3,
+}
+
+// wofExternalInfo is WOF_EXTERNAL_INFO followed by
+// FILE_PROVIDER_EXTERNAL_INFO_V1, the input of FSCTL_SET_EXTERNAL_BACKING
+// and output of FSCTL_GET_EXTERNAL_BACKING.
+type wofExternalInfo struct {
+    version         uint32
+    provider        uint32
+    providerVersion uint32
+    algorithm       uint32
+    flags           uint32
+}
+
+// usingWof reports whether compression goes through WOF.
+func usingWof() bool {
+    return opts.Backend != BACKEND_NAME_NTFS
+}
+
+// withFileHandle opens path for a compression FSCTL with the given access,
+// timing the open and close for -measure-filters, and runs fn on it.
+func withFileHandle(path string, access uint32, times *ioTimings, fn func(handle windows.Handle) error) error {
+    fsctlSlots.acquire()
+    defer fsctlSlots.release()
+
+    if err := chaosFailure("open", path); err != nil {
+        return err
+    }
+
+    start := time.Now()
+    file, err := syscall.CreateFile(
+        syscall.StringToUTF16Ptr(path),
+        access,
+        SHARE_ALL,
+        nil,
+        syscall.OPEN_EXISTING,
+        syscall.FILE_FLAG_BACKUP_SEMANTICS,
+        0,
+    )
+    times.measure(IO_OPEN, start)
+    times.opened()
+    if err != nil {
+        return err
+    }
+    defer func() {
+        start := time.Now()
+        syscall.CloseHandle(file)
+        times.measure(IO_CLOSE, start)
+    }()
+
+    if err := chaosFailure("fsctl", path); err != nil {
+        return err
+    }
+
+    start = time.Now()
+    err = fn(windows.Handle(file))
+    times.measure(IO_FSCTL, start)
+    return err
+}
+
+// setWofCompression compresses a file with a WOF algorithm. NTFS
+// compression is removed first, as WOF doesn't back compressed files.
+func setWofCompression(path string, algorithm uint32, times *ioTimings) error {
+    if attrs, err := getFileAttributes(path); err == nil && attrs&windows.FILE_ATTRIBUTE_COMPRESSED != 0 {
+        if err := setCompression(path, COMPRESSION_FORMAT_NONE, times); err != nil {
+            return err
+        }
+    }
+
+    info := wofExternalInfo{
+        version:         WOF_CURRENT_VERSION,
+        provider:        WOF_PROVIDER_FILE,
+        providerVersion: FILE_PROVIDER_CURRENT_VERSION,
+        algorithm:       algorithm,
+    }
+    return withFileHandle(path, syscall.GENERIC_READ|windows.FILE_WRITE_ATTRIBUTES, times, func(handle windows.Handle) error {
+        return ioctlIn(handle, FSCTL_SET_EXTERNAL_BACKING, &info)
+    })
+}
+
+// removeWofCompression restores a file's data from WOF, and removes NTFS
+// compression a file may have from an earlier run with -backend ntfs.
+func removeWofCompression(path string, times *ioTimings) error {
+    err := withFileHandle(path, syscall.GENERIC_READ|syscall.GENERIC_WRITE, times, func(handle windows.Handle) error {
+        var bytesReturned uint32
+        return windows.DeviceIoControl(handle, FSCTL_DELETE_EXTERNAL_BACKING, nil, 0, nil, 0, &bytesReturned, nil)
+    })
+    if err != nil && err != syscall.Errno(ERROR_OBJECT_NOT_EXTERNALLY_BACKED) {
+        return err
+    }
+
+    if attrs, err := getFileAttributes(path); err == nil && attrs&windows.FILE_ATTRIBUTE_COMPRESSED != 0 {
+        return setCompression(path, COMPRESSION_FORMAT_NONE, times)
+    }
+    return nil
+}
+
+// storedAs returns how the file at path with attrs is stored: ntfs, the
+// WOF algorithm or STORED_UNCOMPRESSED, as recorded in the audit log so the
+// undo subcommand can restore it.
+func storedAs(path string, attrs uint32, times *ioTimings) string {
+    if attrs&windows.FILE_ATTRIBUTE_COMPRESSED != 0 {
+        return BACKEND_NAME_NTFS
+    }
+    if attrs&windows.FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+        return STORED_UNCOMPRESSED
+    }
+
+    var info wofExternalInfo
+    err := withFileHandle(path, syscall.GENERIC_READ, times, func(handle windows.Handle) error {
+        var bytesReturned uint32
+        return windows.DeviceIoControl(handle, FSCTL_GET_EXTERNAL_BACKING, nil, 0, (*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)), &bytesReturned, nil)
+    })
+    if err != nil || info.provider != WOF_PROVIDER_FILE {
+        return STORED_UNCOMPRESSED
+    }
+    for name, algorithm := range wofAlgorithms {
+        if algorithm == info.algorithm {
+            return name
+        }
+    }
+    return STORED_UNCOMPRESSED
+}
+
+// confirmCompactOS asks before -compact-os modifies system files. Without
+// a console the run needs -yes instead.
+func confirmCompactOS() error {
+    fmt.Printf("-compact-os compresses the system files below %s with WOF %s, like compact /compactos:always.\n",
+        strings.Join(opts.Roots, ", "), strings.ToUpper(opts.Backend))
+    fmt.Printf("Files replaced by Windows Update come back uncompressed until the next run.\n")
+    if opts.Yes {
+        return nil
+    }
+
+    var mode uint32
+    if windows.GetConsoleMode(windows.Handle(os.Stdin.Fd()), &mode) != nil {
+        return fmt.Errorf("-compact-os needs -yes when not run from a console")
+    }
+    fmt.Printf("Type %s to continue: ", COMPACT_OS_CONFIRM)
+    answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+    if strings.TrimSpace(answer) != COMPACT_OS_CONFIRM {
+        return fmt.Errorf("not confirmed")
+    }
+    return nil
+}
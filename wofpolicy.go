@@ -0,0 +1,52 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+)
+
+const (
+    BACKEND_NAME_AUTO = "auto" // WOF with the algorithm chosen per file
+
+    WOF_SMALL_FILE = 64 << 10 // Files below this gain little from larger chunks
+    WOF_LARGE_FILE = 1 << 20
+    WOF_HIGH_RATIO = 50 // Saving ratio above which large files get 16K chunks
+)
+
+// With -backend auto the chunk size follows how a file is read. WOF
+// decompresses a whole chunk for every read into it, so files read at
+// random offsets get the smallest chunks, while files read start to end
+// can use larger chunks, or LZX, which compress better.
+var sequentialArchiveExtensions = map[string]bool{
+    ".bak": true, ".iso": true, ".img": true, ".tar": true, ".dmp": true,
+}
+
+// compressionBackend returns the backend to compress a file with: the one
+// given by -backend, or for auto one picked from the file's type, size and
+// estimated saving ratio.
+func compressionBackend(path string, size int64, savingRatio float64) string {
+    if opts.Backend != BACKEND_NAME_AUTO {
+        return opts.Backend
+    }
+
+    ext := strings.ToLower(filepath.Ext(path))
+    switch {
+    case isRandomAccess(path), size < WOF_SMALL_FILE:
+        return "xpress4k"
+    case sequentialArchiveExtensions[ext]:
+        return "lzx"
+    case size >= WOF_LARGE_FILE && savingRatio >= WOF_HIGH_RATIO:
+        return "xpress16k"
+    }
+    return "xpress8k"
+}
+
+// printWofChoices lists how many files -backend auto gave each algorithm.
+func printWofChoices(s statsSnapshot) {
+    fmt.Printf("WOF algorithms chosen:")
+    for _, name := range []string{"xpress4k", "xpress8k", "xpress16k", "lzx"} {
+        fmt.Printf(" %s %d", strings.ToUpper(name), s.wofChosen[wofAlgorithms[name]])
+    }
+    fmt.Printf("\n")
+}